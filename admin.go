@@ -0,0 +1,24 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AdminStatus is what the admin endpoint reports.
+type AdminStatus struct {
+	Pool     PoolStats               `json:"pool"`
+	Breakers map[string]BreakerState `json:"breakers"`
+}
+
+// Admin is an http handler reporting the worker pool and circuit breakers as
+// JSON. mount it somewhere only operators can reach.
+func (magic *Magic) Admin(writer http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(AdminStatus{Pool: magic.PoolStats(), Breakers: magic.BreakerStates()})
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
@@ -0,0 +1,549 @@
+package ensemble
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Authentication answers "who is calling" and authorization answers "what may
+ * they call". An Authenticator turns an inbound http request into a Principal,
+ * and the Policies on Magic restrict which services, hosts and methods that
+ * principal's workloads may use.
+ */
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request carries
+	// none of the credentials it understands, so the next one can have a go.
+	ErrNoCredentials = errors.New("no credentials presented")
+	// ErrBadCredentials is returned when credentials are present but invalid.
+	ErrBadCredentials = errors.New("invalid credentials")
+)
+
+// the HMAC signing headers. the signature is a hex encoded HMAC-SHA256 of
+// the method, path and query, date and hex encoded SHA256 of the body,
+// separated by \n
+const (
+	HMACKeyHeader       = "X-Ensemble-Key"
+	HMACDateHeader      = "X-Ensemble-Date"
+	HMACSignatureHeader = "X-Ensemble-Signature"
+)
+
+// Principal is the authenticated caller of a workload.
+type Principal struct {
+	Name   string // used to look up the caller's Policy
+	Scheme string // how the caller authenticated, e.g. apikey, hmac or jwt
+}
+
+// Authenticator identifies the caller of an http request.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// Authenticators tries each Authenticator in turn, moving on only when one
+// reports ErrNoCredentials.
+type Authenticators []Authenticator
+
+func (auths Authenticators) Authenticate(req *http.Request) (principal *Principal, err error) {
+	for _, auth := range auths {
+		principal, err = auth.Authenticate(req)
+		if err != ErrNoCredentials {
+			return
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// APIKeyAuthenticator accepts static keys, sent in Header or as a bearer token.
+// A bearer token that isn't one of the keys is left for the next
+// Authenticator, it may be a JWT.
+type APIKeyAuthenticator struct {
+	Header string            // defaults to X-API-Key
+	Keys   map[string]string // api key -> principal name
+}
+
+func (auth *APIKeyAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	header := auth.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+	key, bearer := req.Header.Get(header), false
+	if key == "" {
+		key, bearer = bearerToken(req), true
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	for candidate, name := range auth.Keys {
+		if hmac.Equal([]byte(candidate), []byte(key)) {
+			return &Principal{Name: name, Scheme: "apikey"}, nil
+		}
+	}
+	if bearer {
+		return nil, ErrNoCredentials
+	}
+	return nil, ErrBadCredentials
+}
+
+// HMACAuthenticator accepts requests signed with SignRequest.
+type HMACAuthenticator struct {
+	Secrets map[string][]byte // key id -> shared secret. the key id is the principal name
+	MaxSkew time.Duration     // how far the signed date may drift, defaults to 5 minutes
+}
+
+func (auth *HMACAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	keyId := req.Header.Get(HMACKeyHeader)
+	signature := req.Header.Get(HMACSignatureHeader)
+	if keyId == "" || signature == "" {
+		return nil, ErrNoCredentials
+	}
+	secret, ok := auth.Secrets[keyId]
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+
+	date := req.Header.Get(HMACDateHeader)
+	signed, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return nil, ErrBadCredentials
+	}
+	skew := auth.MaxSkew
+	if skew <= 0 {
+		skew = 5 * time.Minute
+	}
+	if drift := time.Since(time.Unix(signed, 0)); drift > skew || drift < -skew {
+		return nil, ErrBadCredentials
+	}
+
+	body, err := readAndRestoreBody(req)
+	if err != nil {
+		return nil, err
+	}
+	expected := hmacSignature(secret, req.Method, signedURI(req), date, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrBadCredentials
+	}
+	return &Principal{Name: keyId, Scheme: "hmac"}, nil
+}
+
+// SignRequest adds the HMAC headers to req. clients use this, and so do tests.
+func SignRequest(req *http.Request, keyId string, secret []byte) (err error) {
+	var body []byte
+	if req.Body != nil {
+		if body, err = readAndRestoreBody(req); err != nil {
+			return
+		}
+	}
+	date := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(HMACKeyHeader, keyId)
+	req.Header.Set(HMACDateHeader, date)
+	req.Header.Set(HMACSignatureHeader, hmacSignature(secret, req.Method, signedURI(req), date, body))
+	return
+}
+
+// signedURI is the path and query that's signed, as it went over the wire.
+// a client's request doesn't have a RequestURI yet
+func signedURI(req *http.Request) string {
+	if req.RequestURI != "" {
+		return req.RequestURI
+	}
+	return req.URL.RequestURI()
+}
+
+func hmacSignature(secret []byte, method, uri, date string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.ToUpper(method) + "\n" + uri + "\n" + date + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// JWTAuthenticator validates bearer tokens against a set of JSON Web Keys.
+// RS256/384/512, ES256/384/512 and HS256/384/512 are supported.
+type JWTAuthenticator struct {
+	Issuer   string // if set, the iss claim must match
+	Audience string // if set, the aud claim must contain it
+	Claim    string // the claim naming the principal, defaults to sub
+	keys     map[string]interface{}
+}
+
+// NewJWTAuthenticator loads the JWKS file at path.
+func NewJWTAuthenticator(path, issuer, audience string) (auth *JWTAuthenticator, err error) {
+	var (
+		data []byte
+		set  struct {
+			Keys []jwk `json:"keys"`
+		}
+	)
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("unable to parse JWKS %s: %s", path, err)
+	}
+	auth = &JWTAuthenticator{Issuer: issuer, Audience: audience, keys: make(map[string]interface{})}
+	for _, key := range set.Keys {
+		var public interface{}
+		if public, err = key.publicKey(); err != nil {
+			return nil, fmt.Errorf("unable to load key %q from %s: %s", key.Kid, path, err)
+		}
+		auth.keys[key.Kid] = public
+	}
+	return
+}
+
+func (auth *JWTAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	token := bearerToken(req)
+	if token == "" || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims, err := auth.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	claim := auth.Claim
+	if claim == "" {
+		claim = "sub"
+	}
+	name, _ := claims[claim].(string)
+	if name == "" {
+		return nil, ErrBadCredentials
+	}
+	return &Principal{Name: name, Scheme: "jwt"}, nil
+}
+
+func (auth *JWTAuthenticator) verify(token string) (claims map[string]interface{}, err error) {
+	var (
+		header struct {
+			Alg string `json:"alg"`
+			Kid string `json:"kid"`
+		}
+		raw []byte
+		sig []byte
+	)
+	parts := strings.Split(token, ".")
+	if raw, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, ErrBadCredentials
+	}
+	if err = json.Unmarshal(raw, &header); err != nil {
+		return nil, ErrBadCredentials
+	}
+	if sig, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, ErrBadCredentials
+	}
+	key, ok := auth.keys[header.Kid]
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+	if err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, ErrBadCredentials
+	}
+
+	if raw, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, ErrBadCredentials
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims); err != nil {
+		return nil, ErrBadCredentials
+	}
+
+	now := time.Now().Unix()
+	if exp, ok := numericClaim(claims, "exp"); ok && now >= exp {
+		return nil, ErrBadCredentials
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now < nbf {
+		return nil, ErrBadCredentials
+	}
+	if auth.Issuer != "" && claims["iss"] != auth.Issuer {
+		return nil, ErrBadCredentials
+	}
+	if auth.Audience != "" && !hasAudience(claims["aud"], auth.Audience) {
+		return nil, ErrBadCredentials
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	var hasher func() hash.Hash
+	var algo crypto.Hash
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	switch alg[2:] {
+	case "256":
+		hasher, algo = sha256.New, crypto.SHA256
+	case "384":
+		hasher, algo = sha512.New384, crypto.SHA384
+	case "512":
+		hasher, algo = sha512.New, crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key is not a shared secret")
+		}
+		mac := hmac.New(hasher, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case strings.HasPrefix(alg, "RS"):
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA key")
+		}
+		h := hasher()
+		h.Write(signed)
+		return rsa.VerifyPKCS1v15(public, algo, h.Sum(nil), sig)
+	case strings.HasPrefix(alg, "ES"):
+		public, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an EC key")
+		}
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature length")
+		}
+		h := hasher()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(public, h.Sum(nil), r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %s", alg)
+}
+
+// a single JSON Web Key, only the members we need
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func (key jwk) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch key.Kty {
+	case "RSA":
+		n, err := decode(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Crv)
+		}
+		x, err := decode(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "oct":
+		return decode(key.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", key.Kty)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	value, err := number.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, item := range aud {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bearerToken(req *http.Request) string {
+	value := req.Header.Get("Authorization")
+	if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+		return strings.TrimSpace(value[7:])
+	}
+	return ""
+}
+
+// read the body for a signature check and put it back for Handle
+func readAndRestoreBody(req *http.Request) (body []byte, err error) {
+	if req.Body == nil {
+		return
+	}
+	if body, err = ioutil.ReadAll(req.Body); err != nil {
+		return
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return
+}
+
+// Policy restricts what a principal's workloads may call. An empty list
+// leaves that dimension unrestricted and "*" matches anything. Hosts may
+// use a leading wildcard e.g. *.example.com
+type Policy struct {
+	Services []string `json:"services"`
+	Hosts    []string `json:"hosts"`
+	Methods  []string `json:"methods"`
+}
+
+// Authorize checks every request in the workload, dependencies included,
+// and an async workload's callback against the Magic's AllowedHosts and the
+// principal's Policy. Without Policies, anyone authenticated may do anything
+// AllowedHosts permits.
+func (magic *Magic) Authorize(principal *Principal, workload *Workload) error {
+	if magic.Authenticator != nil && principal == nil {
+		return ErrNoCredentials
+	}
+	if len(magic.AllowedHosts) > 0 {
+		allowlist := Policy{Hosts: magic.AllowedHosts}
+		for index := range workload.Requests {
+			if err := allowlist.allows(&workload.Requests[index]); err != nil {
+				return err
+			}
+		}
+		if err := allowlist.allowsCallback(workload.Callback); err != nil {
+			return err
+		}
+	}
+	if magic.Policies == nil {
+		return nil
+	}
+	if principal == nil {
+		return errors.New("no principal to authorize")
+	}
+	policy, ok := magic.Policies[principal.Name]
+	if !ok {
+		return fmt.Errorf("no policy for %s", principal.Name)
+	}
+	for index := range workload.Requests {
+		if err := policy.allows(&workload.Requests[index]); err != nil {
+			return err
+		}
+	}
+	return policy.allowsCallback(workload.Callback)
+}
+
+func (policy Policy) allows(req *Request) error {
+	if len(policy.Services) > 0 && (req.Service == "" || !matchAny(policy.Services, req.Service, strings.EqualFold)) {
+		return fmt.Errorf("request %s may not use service %q", req.Id, req.Service)
+	}
+	if len(policy.Methods) > 0 && !matchAny(policy.Methods, req.Method, strings.EqualFold) {
+		return fmt.Errorf("request %s may not use method %s", req.Id, req.Method)
+	}
+	if len(policy.Hosts) > 0 {
+		target, err := url.Parse(req.URL)
+		if err != nil || !matchAny(policy.Hosts, target.Hostname(), matchHost) {
+			return fmt.Errorf("request %s may not call %s", req.Id, req.URL)
+		}
+	}
+	for index := range req.Dependents {
+		if err := policy.allows(&req.Dependents[index].Request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// an async workload's callback is a call like any other
+func (policy Policy) allowsCallback(callback string) error {
+	if callback == "" || len(policy.Hosts) == 0 {
+		return nil
+	}
+	target, err := url.Parse(callback)
+	if err != nil || !matchAny(policy.Hosts, target.Hostname(), matchHost) {
+		return fmt.Errorf("may not call back %s", callback)
+	}
+	return nil
+}
+
+func matchAny(patterns []string, value string, match func(pattern, value string) bool) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(pattern[1:]))
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+type principalKey struct{}
+
+// NewContext returns a context carrying the principal, for go-kit transports.
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stored by NewContext, if any.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
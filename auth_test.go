@@ -0,0 +1,205 @@
+package ensemble
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	auth := &APIKeyAuthenticator{Keys: map[string]string{"s3cret": "mobile"}}
+
+	req := httptest.NewRequest("POST", "/magic", nil)
+	if _, err := auth.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("expected ErrNoCredentials, got %v", err)
+	}
+
+	req.Header.Set("X-API-Key", "wrong")
+	if _, err := auth.Authenticate(req); err != ErrBadCredentials {
+		t.Errorf("expected ErrBadCredentials, got %v", err)
+	}
+
+	req.Header.Set("X-API-Key", "s3cret")
+	principal, err := auth.Authenticate(req)
+	if err != nil || principal.Name != "mobile" {
+		t.Errorf("expected mobile, got %v %v", principal, err)
+	}
+
+	// someone else's bearer token, e.g. a JWT
+	req = httptest.NewRequest("POST", "/magic", nil)
+	req.Header.Set("Authorization", "Bearer eyJ.unknown")
+	if _, err = auth.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("expected an unknown bearer token to be passed on, got %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if principal, err = auth.Authenticate(req); err != nil || principal.Name != "mobile" {
+		t.Errorf("expected mobile from the bearer token, got %v %v", principal, err)
+	}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	secret := []byte("shared")
+	auth := &HMACAuthenticator{Secrets: map[string][]byte{"web": secret}}
+	body := `{"requests":[]}`
+
+	req := httptest.NewRequest("POST", "/magic", strings.NewReader(body))
+	if err := SignRequest(req, "web", secret); err != nil {
+		t.Fatal(err)
+	}
+	principal, err := auth.Authenticate(req)
+	if err != nil || principal.Name != "web" {
+		t.Fatalf("expected web, got %v %v", principal, err)
+	}
+	// the body must still be there for Handle
+	if read, _ := ioutil.ReadAll(req.Body); string(read) != body {
+		t.Errorf("body was not restored, got %s", read)
+	}
+
+	req = httptest.NewRequest("POST", "/magic", strings.NewReader(`{"requests":[{}]}`))
+	SignRequest(req, "web", secret)
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	if _, err = auth.Authenticate(req); err != ErrBadCredentials {
+		t.Errorf("tampered body should fail, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/magic?service=a", strings.NewReader(body))
+	SignRequest(req, "web", secret)
+	req.URL.RawQuery, req.RequestURI = "service=b", "/magic?service=b"
+	if _, err = auth.Authenticate(req); err != ErrBadCredentials {
+		t.Errorf("tampered query should fail, got %v", err)
+	}
+}
+
+func TestAuthenticateLimitsBody(t *testing.T) {
+	magic := &Magic{
+		Authenticator: &HMACAuthenticator{Secrets: map[string][]byte{"web": []byte("shared")}},
+		Limits:        Limits{MaxRequestBytes: 16},
+	}
+	req := httptest.NewRequest("POST", "/magic", strings.NewReader(strings.Repeat("x", 1024)))
+	req.Header.Set(HMACKeyHeader, "web")
+	req.Header.Set(HMACSignatureHeader, "forged")
+	req.Header.Set(HMACDateHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, req)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "test",
+		"n":   encode(key.N.Bytes()),
+		"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewJWTAuthenticator(path, "issuer", "ensemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+		payload, _ := json.Marshal(claims)
+		signed := encode(header) + "." + encode(payload)
+		sum := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		return signed + "." + encode(sig)
+	}
+
+	req := httptest.NewRequest("POST", "/magic", nil)
+	req.Header.Set("Authorization", "Bearer "+sign(map[string]interface{}{
+		"sub": "web", "iss": "issuer", "aud": "ensemble", "exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	principal, err := auth.Authenticate(req)
+	if err != nil || principal.Name != "web" {
+		t.Fatalf("expected web, got %v %v", principal, err)
+	}
+
+	// behind api keys, as ensemble-server chains them
+	chain := Authenticators{&APIKeyAuthenticator{Keys: map[string]string{"s3cret": "mobile"}}, &HMACAuthenticator{}, auth}
+	if principal, err = chain.Authenticate(req); err != nil || principal.Name != "web" || principal.Scheme != "jwt" {
+		t.Errorf("expected the jwt to get through the chain, got %v %v", principal, err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+sign(map[string]interface{}{
+		"sub": "web", "iss": "issuer", "aud": "ensemble", "exp": time.Now().Add(-time.Hour).Unix(),
+	}))
+	if _, err = auth.Authenticate(req); err != ErrBadCredentials {
+		t.Errorf("expired token should fail, got %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+sign(map[string]interface{}{"sub": "web", "iss": "other", "aud": "ensemble"}))
+	if _, err = auth.Authenticate(req); err != ErrBadCredentials {
+		t.Errorf("wrong issuer should fail, got %v", err)
+	}
+}
+
+func TestHandleAuthorization(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(ATest1))
+	defer backend.Close()
+
+	magic := &Magic{
+		Services:      map[string]Service{"test": {Name: "test", BaseURL: backend.URL}},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]string{"k1": "mobile"}},
+		Policies:      map[string]Policy{"mobile": {Services: []string{"test"}, Methods: []string{"GET"}}},
+	}
+
+	call := func(key, workload string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/magic", strings.NewReader(workload))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		recorder := httptest.NewRecorder()
+		magic.Handle(recorder, req)
+		return recorder
+	}
+
+	allowed := `{"requests":[{"id":"1","service":"test","url":"/test1","method":"GET"}],"strictorder":true}`
+	if code := call("", allowed).Code; code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a key, got %d", code)
+	}
+
+	recorder := call("k1", allowed)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var result Result
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	if len(result.Responses) != 1 || result.Responses[0].Data != "This worked" {
+		t.Errorf("unexpected result %#v", result)
+	}
+
+	forbidden := []string{
+		`{"requests":[{"id":"1","service":"test","url":"/test1","method":"POST"}]}`,
+		`{"requests":[{"id":"1","url":"` + backend.URL + `/test1","method":"GET"}]}`,
+		`{"requests":[{"id":"1","service":"test","url":"/test1","method":"GET","dependency":[{"request":{"id":"2","url":"http://elsewhere/","method":"GET"}}]}]}`,
+	}
+	for _, workload := range forbidden {
+		if code := call("k1", workload).Code; code != http.StatusForbidden {
+			t.Errorf("expected 403 for %s, got %d", workload, code)
+		}
+	}
+}
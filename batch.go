@@ -0,0 +1,418 @@
+package ensemble
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Clients that already speak a batch format can send it to Handle instead of
+ * a workload. Two are understood, picked by the Content-Type:
+ *
+ *   multipart/mixed                  OData $batch, changesets included
+ *   application/vnd.api+json; ext="https://jsonapi.org/ext/atomic"
+ *                                    JSON:API atomic operations
+ *
+ * The batch becomes a strict order workload, one request per part or
+ * operation, and the Result is written back in the same format. Relative
+ * urls are resolved against the service named by the service query
+ * parameter, e.g. POST /magic?service=odata. Ensemble can't roll back
+ * upstream calls, so changesets and atomic operations are run in order but
+ * aren't atomic. Once one of their calls fails, the rest aren't made.
+ */
+
+const jsonAPIAtomic = "https://jsonapi.org/ext/atomic"
+
+// ErrNotRun is the Response.Err of a call in a changeset or atomic
+// operations that wasn't made because an earlier one failed.
+const ErrNotRun = "not-run"
+
+// batchFormat translates a batch format to a workload and the result back.
+// decode keeps what encode needs, so use a new one per request.
+type batchFormat interface {
+	decode(req *http.Request, body []byte) (Workload, error)
+	encode(writer http.ResponseWriter, result Result)
+}
+
+// batchFor picks the batch format for a Content-Type, nil for a workload
+func batchFor(contentType string) batchFormat {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch mediaType {
+	case "multipart/mixed":
+		return &odataBatch{}
+	case "application/vnd.api+json":
+		for _, ext := range strings.Fields(params["ext"]) {
+			if ext == jsonAPIAtomic {
+				return &jsonAPIBatch{}
+			}
+		}
+	}
+	return nil
+}
+
+// batchRequest fills in a request for a batch part, relative urls are
+// resolved against the service query parameter
+func batchRequest(req *http.Request, id, method, target string, header http.Header, data string) (Request, error) {
+	request := Request{Id: id, Method: method, URL: target, Header: header, Data: data}
+	if !strings.Contains(target, "://") {
+		if request.Service = req.URL.Query().Get("service"); request.Service == "" {
+			return request, fmt.Errorf("%s %s is relative, name a service with ?service=", method, target)
+		}
+	}
+	return request, nil
+}
+
+// the http status to report for a response, a call that was never made is
+// a bad gateway
+func batchStatus(response *Response) int {
+	if response.Code == 0 {
+		return http.StatusBadGateway
+	}
+	return response.Code
+}
+
+// the body to report for a response, the pruned object if fields were used
+func batchBody(response *Response) []byte {
+	if response.Object != nil {
+		body, _ := json.Marshal(response.Object)
+		return body
+	}
+	if response.Data == "" && response.Err != "" {
+		return []byte(response.Err)
+	}
+	if response.Encoding == EncodingBase64 {
+		if body, err := base64.StdEncoding.DecodeString(response.Data); err == nil {
+			return body
+		}
+	}
+	return []byte(response.Data)
+}
+
+func batchBoundary(prefix string) string {
+	random := make([]byte, 12)
+	rand.Read(random)
+	return prefix + hex.EncodeToString(random)
+}
+
+// odataBatch is an OData $batch: a multipart/mixed body of application/http
+// parts, and multipart/mixed changesets of them
+type odataBatch struct {
+	parts      []odataPart
+	changesets int
+}
+
+type odataPart struct {
+	id        string
+	contentID string
+	changeset int // 0 outside a changeset
+}
+
+func (batch *odataBatch) decode(req *http.Request, body []byte) (work Workload, err error) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return work, err
+	}
+	if params["boundary"] == "" {
+		return work, errors.New("$batch: multipart/mixed without a boundary")
+	}
+	work.StrictOrder = true
+	err = batch.read(req, multipart.NewReader(bytes.NewReader(body), params["boundary"]), 0, &work)
+	if err == nil && len(work.Requests) == 0 {
+		err = errors.New("$batch: no requests")
+	}
+	return work, err
+}
+
+func (batch *odataBatch) read(req *http.Request, reader *multipart.Reader, changeset int, work *Workload) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("$batch: %s", err)
+		}
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch mediaType {
+		case "multipart/mixed":
+			if changeset != 0 {
+				return errors.New("$batch: changesets can't be nested")
+			}
+			batch.changesets++
+			if err = batch.read(req, multipart.NewReader(part, params["boundary"]), batch.changesets, work); err != nil {
+				return err
+			}
+		case "application/http":
+			request, err := batch.request(req, part, len(batch.parts)+1)
+			if err != nil {
+				return err
+			}
+			request.atomic = changeset
+			batch.parts = append(batch.parts, odataPart{id: request.Id, contentID: part.Header.Get("Content-ID"), changeset: changeset})
+			work.Requests = append(work.Requests, request)
+		default:
+			return fmt.Errorf("$batch: unexpected part of type %q", mediaType)
+		}
+	}
+}
+
+// request reads an application/http part: a request line, headers and body
+func (batch *odataBatch) request(req *http.Request, part *multipart.Part, index int) (Request, error) {
+	reader := textproto.NewReader(bufio.NewReader(part))
+	line, err := reader.ReadLine()
+	for err == nil && strings.TrimSpace(line) == "" {
+		line, err = reader.ReadLine()
+	}
+	if err != nil {
+		return Request{}, fmt.Errorf("$batch: part %d: %s", index, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Request{}, fmt.Errorf("$batch: part %d: bad request line %q", index, line)
+	}
+	method, target := strings.ToUpper(fields[0]), fields[1]
+	if method == "MERGE" {
+		method = "PATCH"
+	}
+	mimeHeader, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return Request{}, fmt.Errorf("$batch: part %d: %s", index, err)
+	}
+	header := http.Header(mimeHeader)
+	header.Del("Host")
+	data, err := ioutil.ReadAll(reader.R)
+	if err != nil {
+		return Request{}, fmt.Errorf("$batch: part %d: %s", index, err)
+	}
+
+	if len(header) == 0 {
+		header = nil
+	}
+	// Content-IDs are only unique within a changeset, so requests are numbered
+	return batchRequest(req, strconv.Itoa(index), method, target, header, strings.TrimRight(string(data), "\r\n"))
+}
+
+func (batch *odataBatch) encode(writer http.ResponseWriter, result Result) {
+	responses := make(map[string]*Response, len(result.Responses))
+	for index := range result.Responses {
+		responses[result.Responses[index].Id] = &result.Responses[index]
+	}
+
+	var body bytes.Buffer
+	outer := multipart.NewWriter(&body)
+	outer.SetBoundary(batchBoundary("batchresponse_"))
+	for index := 0; index < len(batch.parts); {
+		part := batch.parts[index]
+		if part.changeset == 0 {
+			writeODataPart(outer, part, responses[part.id])
+			index++
+			continue
+		}
+		var changeset bytes.Buffer
+		inner := multipart.NewWriter(&changeset)
+		inner.SetBoundary(batchBoundary("changesetresponse_"))
+		for ; index < len(batch.parts) && batch.parts[index].changeset == part.changeset; index++ {
+			writeODataPart(inner, batch.parts[index], responses[batch.parts[index].id])
+		}
+		inner.Close()
+		w, _ := outer.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/mixed; boundary=" + inner.Boundary()}})
+		w.Write(changeset.Bytes())
+	}
+	outer.Close()
+
+	writer.Header().Set("Content-Type", "multipart/mixed; boundary="+outer.Boundary())
+	writer.Header().Set("OData-Version", "4.0")
+	writer.Write(body.Bytes())
+}
+
+func writeODataPart(writer *multipart.Writer, part odataPart, response *Response) {
+	header := textproto.MIMEHeader{"Content-Type": {"application/http"}, "Content-Transfer-Encoding": {"binary"}}
+	if part.contentID != "" {
+		header.Set("Content-ID", part.contentID)
+	}
+	w, _ := writer.CreatePart(header)
+	if response == nil {
+		response = &Response{Id: part.id, Err: "no response"}
+	}
+	code, body := batchStatus(response), batchBody(response)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	response.Header.Clone().WriteSubset(w, map[string]bool{"Content-Length": true, "Transfer-Encoding": true, "Connection": true})
+	fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(body))
+	w.Write(body)
+}
+
+// jsonAPIBatch is a JSON:API atomic:operations document
+type jsonAPIBatch struct {
+	operations int
+}
+
+type jsonAPIOperation struct {
+	Op   string          `json:"op"`
+	Ref  *jsonAPIRef     `json:"ref"`
+	Href string          `json:"href"`
+	Data json.RawMessage `json:"data"`
+	Meta json.RawMessage `json:"meta"`
+}
+
+type jsonAPIRef struct {
+	Type         string `json:"type"`
+	Id           string `json:"id"`
+	Lid          string `json:"lid"`
+	Relationship string `json:"relationship"`
+}
+
+func (batch *jsonAPIBatch) decode(req *http.Request, body []byte) (work Workload, err error) {
+	var document struct {
+		Operations []jsonAPIOperation `json:"atomic:operations"`
+	}
+	if err = json.Unmarshal(body, &document); err != nil {
+		return work, err
+	}
+	if len(document.Operations) == 0 {
+		return work, errors.New("atomic: no operations")
+	}
+	work.StrictOrder = true
+	header := http.Header{
+		"Content-Type": {"application/vnd.api+json"},
+		"Accept":       {"application/vnd.api+json"},
+	}
+	for index, operation := range document.Operations {
+		method, target, err := operation.target()
+		if err != nil {
+			return work, fmt.Errorf("atomic: operation %d: %s", index, err)
+		}
+		data := ""
+		if operation.Data != nil || operation.Meta != nil {
+			payload, _ := json.Marshal(struct {
+				Data json.RawMessage `json:"data,omitempty"`
+				Meta json.RawMessage `json:"meta,omitempty"`
+			}{operation.Data, operation.Meta})
+			data = string(payload)
+		}
+		request, err := batchRequest(req, strconv.Itoa(index), method, target, header.Clone(), data)
+		if err != nil {
+			return work, fmt.Errorf("atomic: operation %d: %s", index, err)
+		}
+		request.atomic = 1
+		work.Requests = append(work.Requests, request)
+	}
+	batch.operations = len(work.Requests)
+	return work, nil
+}
+
+// target maps an operation onto a method and url: add is a POST, update a
+// PATCH and remove a DELETE, of the href or the ref's resource
+func (operation *jsonAPIOperation) target() (method, target string, err error) {
+	switch operation.Op {
+	case "add":
+		method = "POST"
+	case "update":
+		method = "PATCH"
+	case "remove":
+		method = "DELETE"
+	default:
+		return "", "", fmt.Errorf("unknown op %q", operation.Op)
+	}
+	if operation.Href != "" {
+		return method, operation.Href, nil
+	}
+
+	ref := operation.Ref
+	if ref == nil && operation.Op == "add" {
+		var resource jsonAPIRef
+		json.Unmarshal(operation.Data, &resource)
+		ref = &jsonAPIRef{Type: resource.Type}
+	}
+	switch {
+	case ref == nil || ref.Type == "":
+		return "", "", errors.New("needs an href or a ref")
+	case ref.Lid != "":
+		return "", "", errors.New("local ids (lid) aren't supported")
+	case ref.Id == "" && operation.Op != "add":
+		return "", "", errors.New("ref has no id")
+	}
+	target = "/" + ref.Type
+	if ref.Id != "" {
+		target += "/" + ref.Id
+	}
+	if ref.Relationship != "" {
+		target += "/relationships/" + ref.Relationship
+	}
+	return method, target, nil
+}
+
+// encode writes the atomic:results, or the errors of the operations that
+// failed with the status of the first
+func (batch *jsonAPIBatch) encode(writer http.ResponseWriter, result Result) {
+	var (
+		results []interface{}
+		errs    []interface{}
+		status  int
+	)
+	for index := range result.Responses {
+		response := &result.Responses[index]
+		code := batchStatus(response)
+		var document map[string]interface{}
+		json.Unmarshal(batchBody(response), &document)
+
+		if code < 300 {
+			out := make(map[string]interface{})
+			for _, key := range []string{"data", "meta"} {
+				if value, ok := document[key]; ok {
+					out[key] = value
+				}
+			}
+			results = append(results, out)
+			continue
+		}
+
+		if status == 0 {
+			status = code
+		}
+		pointer := map[string]interface{}{"pointer": fmt.Sprintf("/atomic:operations/%s", response.Id)}
+		upstream, _ := document["errors"].([]interface{})
+		for _, item := range upstream {
+			if object, ok := item.(map[string]interface{}); ok {
+				if _, ok := object["source"]; !ok {
+					object["source"] = pointer
+				}
+				errs = append(errs, object)
+			}
+		}
+		if len(upstream) == 0 {
+			errs = append(errs, map[string]interface{}{
+				"status": strconv.Itoa(code),
+				"title":  http.StatusText(code),
+				"detail": string(batchBody(response)),
+				"source": pointer,
+			})
+		}
+	}
+
+	writer.Header().Set("Content-Type", `application/vnd.api+json; ext="`+jsonAPIAtomic+`"`)
+	if status != 0 {
+		writer.WriteHeader(status)
+		json.NewEncoder(writer).Encode(map[string]interface{}{"errors": errs})
+		return
+	}
+	if len(results) < batch.operations {
+		results = append(results, make([]interface{}, batch.operations-len(results))...)
+	}
+	json.NewEncoder(writer).Encode(map[string]interface{}{"atomic:results": results})
+}
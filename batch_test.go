@@ -0,0 +1,260 @@
+package ensemble
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func batchBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/missing"):
+			writer.Header().Set("Content-Type", "application/vnd.api+json")
+			writer.WriteHeader(http.StatusNotFound)
+			writer.Write([]byte(`{"errors":[{"status":"404","title":"Not Found"}]}`))
+		case req.Method == "DELETE":
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writer.Header().Set("Content-Type", "application/json")
+			echo, _ := json.Marshal(map[string]string{"method": req.Method, "path": req.URL.Path, "body": string(body), "type": req.Header.Get("Content-Type")})
+			writer.Write([]byte(`{"data":` + string(echo) + `}`))
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestODataBatch(t *testing.T) {
+	backend := batchBackend(t)
+	magic := &Magic{Services: map[string]Service{"odata": {Name: "odata", BaseURL: backend.URL}}}
+
+	body := strings.ReplaceAll(`--batch_1
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+
+GET Customers('ALFKI') HTTP/1.1
+Accept: application/json
+
+
+--batch_1
+Content-Type: multipart/mixed; boundary=changeset_1
+
+--changeset_1
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+Content-ID: 1
+
+POST Customers HTTP/1.1
+Content-Type: application/json
+
+{"name":"Alfreds"}
+--changeset_1
+Content-Type: application/http
+Content-ID: 2
+
+MERGE Customers('ALFKI') HTTP/1.1
+Content-Type: application/json
+
+{"city":"Berlin"}
+--changeset_1--
+
+--batch_1--
+`, "\n", "\r\n")
+	req := httptest.NewRequest("POST", "/magic?service=odata", strings.NewReader(body))
+	req.Header.Set("Content-Type", "multipart/mixed; boundary=batch_1")
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, req)
+
+	mediaType, params, err := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected response %d %q %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body)
+	}
+	reader := multipart.NewReader(recorder.Body, params["boundary"])
+
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != 200 || !strings.Contains(string(data), `"path":"/Customers('ALFKI')"`) {
+		t.Errorf("unexpected first response %d %s", response.StatusCode, data)
+	}
+
+	part, err = reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	changeset := multipart.NewReader(part, params["boundary"])
+	for _, want := range []struct{ id, method, body string }{
+		{"1", "POST", `{\"name\":\"Alfreds\"}`},
+		{"2", "PATCH", `{\"city\":\"Berlin\"}`},
+	} {
+		inner, err := changeset.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inner.Header.Get("Content-ID") != want.id {
+			t.Errorf("expected Content-ID %s, got %q", want.id, inner.Header.Get("Content-ID"))
+		}
+		response, err := http.ReadResponse(bufio.NewReader(inner), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(response.Body)
+		if !strings.Contains(string(data), `"method":"`+want.method+`"`) || !strings.Contains(string(data), want.body) {
+			t.Errorf("unexpected changeset response %s", data)
+		}
+	}
+	if _, err = reader.NextPart(); err == nil {
+		t.Error("expected two parts")
+	}
+}
+
+func TestODataChangesetStopsAtFailure(t *testing.T) {
+	backend := batchBackend(t)
+	magic := &Magic{Services: map[string]Service{"odata": {Name: "odata", BaseURL: backend.URL}}}
+
+	body := strings.ReplaceAll(`--batch_1
+Content-Type: multipart/mixed; boundary=changeset_1
+
+--changeset_1
+Content-Type: application/http
+
+POST missing HTTP/1.1
+
+
+--changeset_1
+Content-Type: application/http
+
+POST Customers HTTP/1.1
+
+
+--changeset_1--
+
+--batch_1
+Content-Type: application/http
+
+GET Customers HTTP/1.1
+
+
+--batch_1--
+`, "\n", "\r\n")
+	req := httptest.NewRequest("POST", "/magic?service=odata", strings.NewReader(body))
+	req.Header.Set("Content-Type", "multipart/mixed; boundary=batch_1")
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, req)
+
+	_, params, _ := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	reader := multipart.NewReader(recorder.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	changeset := multipart.NewReader(part, params["boundary"])
+	for _, want := range []int{http.StatusNotFound, http.StatusFailedDependency} {
+		inner, err := changeset.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.ReadResponse(bufio.NewReader(inner), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != want {
+			t.Errorf("expected %d, got %d %s", want, response.StatusCode, data)
+		}
+	}
+
+	// a failed changeset doesn't stop the rest of the batch
+	if part, err = reader.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := http.ReadResponse(bufio.NewReader(part), nil); err != nil || response.StatusCode != 200 {
+		t.Errorf("expected the part after the changeset to run, got %v %v", response, err)
+	}
+}
+
+func TestODataBatchNeedsService(t *testing.T) {
+	body := "--b\r\nContent-Type: application/http\r\n\r\nGET Customers HTTP/1.1\r\n\r\n\r\n--b--\r\n"
+	req := httptest.NewRequest("POST", "/magic", strings.NewReader(body))
+	req.Header.Set("Content-Type", "multipart/mixed; boundary=b")
+	recorder := httptest.NewRecorder()
+	(&Magic{}).Handle(recorder, req)
+	if recorder.Code != 500 || !strings.Contains(recorder.Body.String(), "?service=") {
+		t.Errorf("unexpected response %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestJSONAPIAtomic(t *testing.T) {
+	backend := batchBackend(t)
+	magic := &Magic{Services: map[string]Service{"api": {Name: "api", BaseURL: backend.URL}}}
+	handler := MakeHTTPHandler(magic)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/magic?service=api", strings.NewReader(body))
+		req.Header.Set("Content-Type", `application/vnd.api+json; ext="https://jsonapi.org/ext/atomic"`)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := post(`{"atomic:operations":[
+		{"op":"add","data":{"type":"articles","attributes":{"title":"JSON API paints my bikeshed!"}}},
+		{"op":"update","ref":{"type":"articles","id":"13"},"data":{"type":"articles","id":"13","attributes":{"title":"Hi"}}},
+		{"op":"remove","ref":{"type":"articles","id":"13"}}]}`)
+	if recorder.Code != 200 || !strings.Contains(recorder.Header().Get("Content-Type"), "ext=") {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body)
+	}
+	var document struct {
+		Results []struct {
+			Data map[string]string `json:"data"`
+		} `json:"atomic:results"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil || len(document.Results) != 3 {
+		t.Fatalf("unexpected body %s", recorder.Body)
+	}
+	if add := document.Results[0].Data; add["method"] != "POST" || add["path"] != "/articles" || add["type"] != "application/vnd.api+json" ||
+		add["body"] != `{"data":{"type":"articles","attributes":{"title":"JSON API paints my bikeshed!"}}}` {
+		t.Errorf("unexpected add %v", add)
+	}
+	if update := document.Results[1].Data; update["method"] != "PATCH" || update["path"] != "/articles/13" {
+		t.Errorf("unexpected update %v", update)
+	}
+	if document.Results[2].Data != nil {
+		t.Errorf("expected an empty result for remove, got %v", document.Results[2])
+	}
+
+	recorder = post(`{"atomic:operations":[
+		{"op":"add","href":"/articles","data":{"type":"articles"}},
+		{"op":"update","ref":{"type":"missing","id":"1"},"data":{"type":"missing","id":"1"}}]}`)
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), `"pointer":"/atomic:operations/1"`) {
+		t.Errorf("unexpected failure %d %s", recorder.Code, recorder.Body)
+	}
+
+	// operations after a failure aren't run
+	recorder = post(`{"atomic:operations":[
+		{"op":"update","ref":{"type":"missing","id":"1"},"data":{"type":"missing","id":"1"}},
+		{"op":"add","href":"/articles","data":{"type":"articles"}}]}`)
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), `"detail":"not-run","source":{"pointer":"/atomic:operations/1"},"status":"424"`) {
+		t.Errorf("expected the second operation not to run, got %d %s", recorder.Code, recorder.Body)
+	}
+
+	if recorder = post(`{"atomic:operations":[{"op":"update","ref":{"type":"articles","lid":"a"}}]}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected lid to be refused, got %d %s", recorder.Code, recorder.Body)
+	}
+}
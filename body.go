@@ -0,0 +1,265 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+ * A request's body is its data, or built by ensemble from form params, a json
+ * value or multipart parts with the right Content-Type. Its query params are
+ * added to the url, escaped and with repeated keys. Data is a string, which
+ * is fine for JSON and forms but not for images or PDFs. A request's data
+ * can be base64 encoded with "dataEncoding": "base64", or its body can be
+ * built as multipart/form-data from "multipart" parts, each of which may be
+ * base64 encoded too. A binary response body comes back base64 encoded with
+ * "encoding": "base64" on the response. A body is binary if its Content-Type
+ * isn't a text type or it isn't valid UTF-8; a request's responseEncoding of
+ * base64 or text overrides that.
+ */
+
+const (
+	EncodingBase64 = "base64"
+	EncodingText   = "text"
+)
+
+// Part is one part of a multipart/form-data request body.
+type Part struct {
+	Name        string `json:"name"`        // the form field
+	Value       string `json:"value"`       // the content, base64 encoded if Encoding is base64
+	Filename    string `json:"filename"`    // makes the part a file upload
+	ContentType string `json:"contentType"` // application/octet-stream for files if empty
+	Encoding    string `json:"encoding"`    // base64 if Value is base64 encoded
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// Params are query or form parameters. In JSON a value is a string, number
+// or bool, or an array of them for a repeated key.
+type Params map[string][]string
+
+func (params *Params) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*params = nil
+		return nil
+	}
+	decoded := make(Params, len(raw))
+	for key, value := range raw {
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			switch item := item.(type) {
+			case string:
+				decoded[key] = append(decoded[key], item)
+			case json.Number:
+				decoded[key] = append(decoded[key], item.String())
+			case bool:
+				decoded[key] = append(decoded[key], strconv.FormatBool(item))
+			default:
+				return fmt.Errorf("param %s must be a string, number or bool", key)
+			}
+		}
+	}
+	*params = decoded
+	return nil
+}
+
+// withQuery adds the params to the url's query string, leaving what's
+// already there alone
+func withQuery(raw string, params Params) string {
+	if len(params) == 0 {
+		return raw
+	}
+	base, fragment, hasFragment := strings.Cut(raw, "#")
+	separator := "?"
+	if strings.HasSuffix(base, "?") || strings.HasSuffix(base, "&") {
+		separator = ""
+	} else if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	raw = base + separator + url.Values(params).Encode()
+	if hasFragment {
+		raw += "#" + fragment
+	}
+	return raw
+}
+
+// requestBody is what MakeRequest sends and its Content-Type
+func requestBody(req *Request) (body io.Reader, contentType string, err error) {
+	switch {
+	case len(req.Multipart) > 0:
+		return multipartBody(req.Multipart)
+	case len(req.Form) > 0:
+		return strings.NewReader(url.Values(req.Form).Encode()), "application/x-www-form-urlencoded", nil
+	case req.JSON != nil:
+		data, err := json.Marshal(req.JSON)
+		if err != nil {
+			return nil, "", fmt.Errorf("json: %s", err)
+		}
+		return bytes.NewReader(data), "application/json", nil
+	case req.DataEncoding == EncodingBase64:
+		data, err := base64.StdEncoding.DecodeString(req.Data)
+		if err != nil {
+			return nil, "", fmt.Errorf("data isn't base64: %s", err)
+		}
+		return bytes.NewReader(data), "application/octet-stream", nil
+	case len(req.Data) > 0:
+		return strings.NewReader(req.Data), dataType(req.Data), nil
+	}
+	return nil, "", nil
+}
+
+// dataType guesses the Content-Type of raw data: JSON if it's an object or
+// array, otherwise a form as it always has been
+func dataType(data string) string {
+	trimmed := strings.TrimSpace(data)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "application/json"
+	}
+	return "application/x-www-form-urlencoded"
+}
+
+func multipartBody(parts []Part) (io.Reader, string, error) {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	for _, part := range parts {
+		value := []byte(part.Value)
+		if part.Encoding == EncodingBase64 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(part.Value); err != nil {
+				return nil, "", fmt.Errorf("part %s isn't base64: %s", part.Name, err)
+			}
+		}
+		header := make(textproto.MIMEHeader)
+		disposition := fmt.Sprintf(`form-data; name="%s"`, quoteEscaper.Replace(part.Name))
+		if part.Filename != "" {
+			disposition += fmt.Sprintf(`; filename="%s"`, quoteEscaper.Replace(part.Filename))
+		}
+		header.Set("Content-Disposition", disposition)
+		contentType := part.ContentType
+		if contentType == "" && part.Filename != "" {
+			contentType = "application/octet-stream"
+		}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		w.Write(value)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buffer, writer.FormDataContentType(), nil
+}
+
+// setBody puts the response body in Data, base64 encoded if it's binary
+func setBody(req *Request, response *Response, body []byte) {
+	if isBinary(req.ResponseEncoding, response.Header.Get("Content-Type"), body) {
+		response.Data = base64.StdEncoding.EncodeToString(body)
+		response.Encoding = EncodingBase64
+		return
+	}
+	response.Data = string(body)
+}
+
+func isBinary(encoding, contentType string, body []byte) bool {
+	switch encoding {
+	case EncodingBase64:
+		return true
+	case EncodingText:
+		return false
+	}
+	if len(body) == 0 {
+		return false
+	}
+	return (contentType != "" && !isText(contentType)) || !utf8.Valid(body)
+}
+
+// isText says if a Content-Type is text that's safe to return as a string
+func isText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded",
+		"application/yaml", "application/x-yaml", "application/graphql", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+// checkBody checks the encodings and parts of a request
+func checkBody(req *Request) (problems []error) {
+	if req.DataEncoding != "" && req.DataEncoding != EncodingBase64 {
+		problems = append(problems, fmt.Errorf("unknown dataEncoding %q", req.DataEncoding))
+	}
+	if req.ResponseEncoding != "" && req.ResponseEncoding != EncodingBase64 && req.ResponseEncoding != EncodingText {
+		problems = append(problems, fmt.Errorf("unknown responseEncoding %q", req.ResponseEncoding))
+	}
+	if req.DataEncoding == EncodingBase64 {
+		if req.UseData {
+			problems = append(problems, errors.New("useData can't fill in base64 data"))
+		} else if _, err := base64.StdEncoding.DecodeString(req.Data); err != nil {
+			problems = append(problems, fmt.Errorf("data isn't base64: %s", err))
+		}
+	}
+	var bodies []string
+	for _, body := range []struct {
+		name string
+		set  bool
+	}{
+		{"multipart", len(req.Multipart) > 0},
+		{"form", len(req.Form) > 0},
+		{"json", req.JSON != nil},
+		{"data", req.Data != "" || req.UseData},
+	} {
+		if body.set {
+			bodies = append(bodies, body.name)
+		}
+	}
+	switch {
+	case len(bodies) == 2:
+		problems = append(problems, fmt.Errorf("%s and %s can't both be set", bodies[0], bodies[1]))
+	case len(bodies) > 2:
+		problems = append(problems, fmt.Errorf("%s and %s can't all be set", strings.Join(bodies[:len(bodies)-1], ", "), bodies[len(bodies)-1]))
+	}
+	for _, part := range req.Multipart {
+		if part.Name == "" {
+			problems = append(problems, errors.New("a multipart part has no name"))
+		}
+		if part.Encoding == EncodingBase64 {
+			if _, err := base64.StdEncoding.DecodeString(part.Value); err != nil {
+				problems = append(problems, fmt.Errorf("part %s isn't base64: %s", part.Name, err))
+			}
+		} else if part.Encoding != "" {
+			problems = append(problems, fmt.Errorf("part %s has unknown encoding %q", part.Name, part.Encoding))
+		}
+	}
+	return
+}
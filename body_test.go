@@ -0,0 +1,173 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var pngBytes = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0xff, 0xfe}
+
+func TestBinaryBodies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/upload":
+			body, _ := ioutil.ReadAll(req.Body)
+			if !bytes.Equal(body, pngBytes) {
+				http.Error(writer, "corrupted upload", http.StatusBadRequest)
+				return
+			}
+			writer.Write([]byte("stored"))
+		case "/form":
+			if err := req.ParseMultipartForm(1 << 20); err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			file, header, err := req.FormFile("avatar")
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(file)
+			echo, _ := json.Marshal(map[string]interface{}{
+				"title":    req.FormValue("title"),
+				"filename": header.Filename,
+				"type":     header.Header.Get("Content-Type"),
+				"intact":   bytes.Equal(data, pngBytes),
+			})
+			writer.Header().Set("Content-Type", "application/json")
+			writer.Write(echo)
+		case "/image.png":
+			writer.Header().Set("Content-Type", "image/png")
+			writer.Write(pngBytes)
+		case "/untyped":
+			writer.Header()["Content-Type"] = nil
+			writer.Write(pngBytes)
+		}
+	}))
+	defer backend.Close()
+
+	encoded := base64.StdEncoding.EncodeToString(pngBytes)
+	workload := Workload{Requests: []Request{
+		{Id: "upload", URL: backend.URL + "/upload", Method: "PUT", Data: encoded, DataEncoding: "base64"},
+		{Id: "form", URL: backend.URL + "/form", Method: "POST", Multipart: []Part{
+			{Name: "title", Value: "me"},
+			{Name: "avatar", Filename: "me.png", ContentType: "image/png", Value: encoded, Encoding: "base64"},
+		}},
+		{Id: "download", URL: backend.URL + "/image.png", Method: "GET"},
+		{Id: "untyped", URL: backend.URL + "/untyped", Method: "GET"},
+		{Id: "text", URL: backend.URL + "/form", Method: "GET", ResponseEncoding: "text"},
+		{Id: "forced", URL: backend.URL + "/upload", Method: "POST", Data: encoded, DataEncoding: "base64", ResponseEncoding: "base64"},
+	}}
+	magic := &Magic{}
+	if err := magic.Validate(&workload); err != nil {
+		t.Fatal(err)
+	}
+	var result Result
+	magic.process(workload, &result)
+	responses := make(map[string]Response)
+	for _, response := range result.Responses {
+		responses[response.Id] = response
+	}
+
+	if upload := responses["upload"]; upload.Code != 200 || upload.Data != "stored" || upload.Encoding != "" {
+		t.Errorf("unexpected upload %+v", upload)
+	}
+	if form := responses["form"]; form.Code != 200 || form.Data != `{"filename":"me.png","intact":true,"title":"me","type":"image/png"}` {
+		t.Errorf("unexpected form %+v", form)
+	}
+	for _, id := range []string{"download", "untyped"} {
+		if response := responses[id]; response.Encoding != "base64" || response.Data != encoded {
+			t.Errorf("expected %s to be base64, got %+v", id, response)
+		}
+	}
+	if text := responses["text"]; text.Encoding != "" || !strings.Contains(text.Data, "request Content-Type") {
+		t.Errorf("unexpected text %+v", text)
+	}
+	if forced := responses["forced"]; forced.Encoding != "base64" || forced.Data != base64.StdEncoding.EncodeToString([]byte("stored")) {
+		t.Errorf("unexpected forced %+v", forced)
+	}
+}
+
+func TestValidateBodies(t *testing.T) {
+	workload := Workload{Requests: []Request{
+		{Id: "1", URL: "http://example.com", Method: "POST", Data: "not base64!", DataEncoding: "base64"},
+		{Id: "2", URL: "http://example.com", Method: "POST", Data: "x", Multipart: []Part{{Value: "v", Encoding: "rot13"}}},
+		{Id: "3", URL: "http://example.com", Method: "GET", ResponseEncoding: "hex"},
+	}}
+	err := (&Magic{}).Validate(&workload)
+	if err == nil {
+		t.Fatal("expected problems")
+	}
+	for _, want := range []string{
+		"request 1: data isn't base64",
+		"request 2: multipart and data can't both be set",
+		"request 2: a multipart part has no name",
+		`request 2: part  has unknown encoding "rot13"`,
+		`request 3: unknown responseEncoding "hex"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %s", want, err)
+		}
+	}
+}
+
+func TestStructuredParams(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		echo, _ := json.Marshal(map[string]string{"query": req.URL.RawQuery, "type": req.Header.Get("Content-Type"), "body": string(body)})
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(echo)
+	}))
+	defer backend.Close()
+
+	workload, err := DecodeWorkload("application/json", []byte(strings.ReplaceAll(`{"requests": [
+		{"id": "query", "url": "{{backend}}/search?page=2", "method": "GET", "query": {"q": "a b&c", "tag": ["x", "y"], "n": 5, "exact": true}},
+		{"id": "form", "url": "{{backend}}/form", "method": "POST", "form": {"boo": "far", "list": [1, 2]}},
+		{"id": "json", "url": "{{backend}}/json", "method": "POST", "json": {"name": "x", "ids": [1, 2]}},
+		{"id": "typed", "url": "{{backend}}/json", "method": "PATCH", "json": {"data": null}, "headers": {"Content-Type": ["application/vnd.api+json"]}},
+		{"id": "rawjson", "url": "{{backend}}/raw", "method": "POST", "data": "{\"a\":1}"},
+		{"id": "rawform", "url": "{{backend}}/raw", "method": "POST", "data": "boo=far"},
+		{"id": "nobody", "url": "{{backend}}/get", "method": "GET"}
+	]}`, "{{backend}}", backend.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	magic := &Magic{}
+	if err = magic.Validate(&workload); err != nil {
+		t.Fatal(err)
+	}
+	var result Result
+	magic.process(workload, &result)
+
+	for index, want := range []map[string]string{
+		{"query": "page=2&exact=true&n=5&q=a+b%26c&tag=x&tag=y", "type": "", "body": ""},
+		{"query": "", "type": "application/x-www-form-urlencoded", "body": "boo=far&list=1&list=2"},
+		{"query": "", "type": "application/json", "body": `{"ids":[1,2],"name":"x"}`},
+		{"query": "", "type": "application/vnd.api+json", "body": `{"data":null}`},
+		{"query": "", "type": "application/json", "body": `{"a":1}`},
+		{"query": "", "type": "application/x-www-form-urlencoded", "body": "boo=far"},
+		{"query": "", "type": "", "body": ""},
+	} {
+		var got map[string]string
+		json.Unmarshal([]byte(result.Responses[index].Data), &got)
+		for key, value := range want {
+			if got[key] != value {
+				t.Errorf("request %s: expected %s %q, got %q", result.Responses[index].Id, key, value, got[key])
+			}
+		}
+	}
+
+	if _, err = DecodeWorkload("application/json", []byte(`{"requests":[{"id":"1","query":{"q":{"nested":1}}}]}`)); err == nil {
+		t.Error("expected an object param to be refused")
+	}
+	bad := Workload{Requests: []Request{{Id: "1", URL: "http://example.com", Method: "POST", Form: Params{"a": {"b"}}, JSON: map[string]interface{}{}, Data: "x"}}}
+	if err = magic.Validate(&bad); err == nil || !strings.Contains(err.Error(), "form, json and data can't all be set") {
+		t.Errorf("unexpected problems %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package ensemble
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+/*
+ * When a backend is down there is no point making every workload wait out the
+ * client timeout on it. Each upstream host gets a circuit breaker: once enough
+ * calls fail it opens and calls fail fast, after the cooldown a few probes are
+ * let through (half open) and if they succeed the breaker closes again.
+ */
+
+// ErrCircuitOpen is the Response.Err of a call refused by an open breaker.
+const ErrCircuitOpen = "circuit-open"
+
+// the breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerConfig sets when the per host circuit breakers trip.
+type BreakerConfig struct {
+	FailureRate float64       `json:"failure_rate"` // fraction of failed calls that opens the breaker, defaults to 0.5
+	MinRequests int           `json:"min_requests"` // calls needed in a window before it can open, defaults to 10
+	Window      time.Duration `json:"window"`       // how long calls are counted for, defaults to a minute
+	Cooldown    time.Duration `json:"cooldown"`     // how long it stays open, defaults to 30 seconds
+	Probes      int           `json:"probes"`       // calls let through while half open, defaults to 1
+
+	// if set, each host's breaker state with a "host" label, see BreakerGaugeValue
+	Gauge metrics.Gauge `json:"-"`
+}
+
+// BreakerGaugeValue is the value of BreakerConfig.Gauge for a state: 0 closed,
+// 1 half open and 2 open.
+func BreakerGaugeValue(state string) float64 {
+	switch state {
+	case BreakerHalfOpen:
+		return 1
+	case BreakerOpen:
+		return 2
+	}
+	return 0
+}
+
+// BreakerState is a snapshot of one host's breaker.
+type BreakerState struct {
+	State    string    `json:"state"`
+	Requests int       `json:"requests"` // calls in the current window
+	Failures int       `json:"failures"` // failed calls in the current window
+	Opened   time.Time `json:"opened,omitempty"`
+}
+
+type breaker struct {
+	state    string
+	requests int
+	failures int
+	window   time.Time // when the current window started
+	opened   time.Time
+	probes   int // probes in flight while half open
+}
+
+// closed breakers whose window has run out are dropped, they're no different
+// from a new one
+type breakers struct {
+	mutex sync.Mutex
+	hosts map[string]*breaker
+	swept time.Time
+}
+
+func (config BreakerConfig) withDefaults() BreakerConfig {
+	if config.FailureRate <= 0 {
+		config.FailureRate = 0.5
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = 10
+	}
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = 30 * time.Second
+	}
+	if config.Probes <= 0 {
+		config.Probes = 1
+	}
+	return config
+}
+
+// allow says if a call to host may go ahead, and if it's a half open probe
+func (set *breakers) allow(host string, config BreakerConfig) (ok, probe bool) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if now := time.Now(); now.Sub(set.swept) >= sweepEvery {
+		for h, b := range set.hosts {
+			if b.state == BreakerClosed && now.Sub(b.window) > config.Window {
+				delete(set.hosts, h)
+			}
+		}
+		set.swept = now
+	}
+	b := set.get(host)
+	defer config.report(host, b)
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.opened) < config.Cooldown {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= config.Probes {
+			return false, false
+		}
+		b.probes++
+		return true, true
+	}
+	return true, false
+}
+
+// record counts the outcome of a call to host, opening or closing its breaker.
+// only probes decide a half open breaker, calls that started while it was
+// closed don't count
+func (set *breakers) record(host string, failed, probe bool, config BreakerConfig) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	b := set.get(host)
+	defer config.report(host, b)
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if !probe {
+			return
+		}
+		if b.probes > 0 {
+			b.probes--
+		}
+		if failed {
+			b.state, b.opened = BreakerOpen, now
+		} else {
+			b.state, b.requests, b.failures, b.window = BreakerClosed, 0, 0, now
+		}
+	case BreakerClosed:
+		if now.Sub(b.window) > config.Window {
+			b.requests, b.failures, b.window = 0, 0, now
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= config.MinRequests && float64(b.failures)/float64(b.requests) >= config.FailureRate {
+			b.state, b.opened = BreakerOpen, now
+		}
+	}
+}
+
+func (config BreakerConfig) report(host string, b *breaker) {
+	if config.Gauge != nil {
+		config.Gauge.With("host", host).Set(BreakerGaugeValue(b.state))
+	}
+}
+
+func (set *breakers) get(host string) *breaker {
+	if set.hosts == nil {
+		set.hosts = make(map[string]*breaker)
+	}
+	b, ok := set.hosts[host]
+	if !ok {
+		b = &breaker{state: BreakerClosed, window: time.Now()}
+		set.hosts[host] = b
+	}
+	return b
+}
+
+func (set *breakers) states() map[string]BreakerState {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	states := make(map[string]BreakerState, len(set.hosts))
+	for host, b := range set.hosts {
+		state := BreakerState{State: b.state, Requests: b.requests, Failures: b.failures}
+		if b.state != BreakerClosed {
+			state.Opened = b.opened
+		}
+		states[host] = state
+	}
+	return states
+}
+
+// callBreaker runs call unless the breaker for req's host is open, in which
+// case the response says so straight away.
+func (magic *Magic) callBreaker(req *Request, response *Response, call func() error) error {
+	if magic.Breakers == nil {
+		return call()
+	}
+	target, err := url.Parse(req.URL)
+	if err != nil {
+		return call()
+	}
+	config := magic.Breakers.withDefaults()
+	ok, probe := magic.breakers.allow(target.Host, config)
+	if !ok {
+		response.Id = req.Id
+		response.Code = http.StatusServiceUnavailable
+		response.Err = ErrCircuitOpen
+		return nil
+	}
+	err = call()
+	magic.breakers.record(target.Host, err != nil || response.Code == 0 || response.Code >= 500, probe, config)
+	return err
+}
+
+// BreakerStates reports the circuit breaker of every host called recently.
+func (magic *Magic) BreakerStates() map[string]BreakerState {
+	return magic.breakers.states()
+}
@@ -0,0 +1,121 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	host, _ := url.Parse(backend.URL)
+
+	magic := &Magic{Breakers: &BreakerConfig{MinRequests: 2, Cooldown: 20 * time.Millisecond}}
+	call := func() Response {
+		result, _ := magic.DoMagic(Workload{StrictOrder: true, Requests: []Request{{Id: "1", URL: backend.URL, Method: "GET"}}})
+		return result.Responses[0]
+	}
+
+	call()
+	call()
+	if response := call(); response.Err != ErrCircuitOpen || response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the breaker to be open, got %#v", response)
+	}
+	if state := magic.BreakerStates()[host.Host]; state.State != BreakerOpen {
+		t.Errorf("expected open, got %+v", state)
+	}
+
+	// after the cooldown a probe is let through and closes the breaker
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(30 * time.Millisecond)
+	if response := call(); response.Code != http.StatusOK {
+		t.Fatalf("expected the probe to go through, got %#v", response)
+	}
+
+	recorder := httptest.NewRecorder()
+	magic.Admin(recorder, httptest.NewRequest("GET", "/admin", nil))
+	var status AdminStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Breakers[host.Host].State != BreakerClosed {
+		t.Errorf("expected the admin endpoint to show the breaker closed, got %s", recorder.Body)
+	}
+}
+
+func TestBreakerCountsOnlyProbes(t *testing.T) {
+	var set breakers
+	config := BreakerConfig{MinRequests: 1, Cooldown: time.Millisecond, Probes: 1}.withDefaults()
+
+	// a call starts while closed, the breaker opens and goes half open
+	// before it finishes
+	ok, early := set.allow("a", config)
+	set.record("a", true, false, config)
+	time.Sleep(2 * time.Millisecond)
+	ok, probe := set.allow("a", config)
+	if !ok || !probe || early {
+		t.Fatalf("expected a probe, got %v %v %v", ok, probe, early)
+	}
+	set.record("a", false, early, config)
+	if b := set.hosts["a"]; b.state != BreakerHalfOpen || b.probes != 1 {
+		t.Errorf("expected the late call not to count, got %s with %d probes", b.state, b.probes)
+	}
+	set.record("a", false, probe, config)
+	if b := set.hosts["a"]; b.state != BreakerClosed || b.probes != 0 {
+		t.Errorf("expected the probe to close the breaker, got %s with %d probes", b.state, b.probes)
+	}
+}
+
+// hostGauge keeps the last value set for each host
+type hostGauge struct {
+	values map[string]float64
+	host   string
+}
+
+func (gauge *hostGauge) With(labelValues ...string) metrics.Gauge {
+	return &hostGauge{values: gauge.values, host: labelValues[1]}
+}
+func (gauge *hostGauge) Set(value float64) { gauge.values[gauge.host] = value }
+func (gauge *hostGauge) Add(delta float64) { gauge.values[gauge.host] += delta }
+
+func TestBreakerGauge(t *testing.T) {
+	gauge := &hostGauge{values: make(map[string]float64)}
+	var set breakers
+	config := BreakerConfig{MinRequests: 1, Gauge: gauge}.withDefaults()
+
+	set.allow("a", config)
+	if value, ok := gauge.values["a"]; !ok || value != BreakerGaugeValue(BreakerClosed) {
+		t.Errorf("expected the gauge to show closed, got %v", gauge.values)
+	}
+	set.record("a", true, false, config)
+	if value := gauge.values["a"]; value != BreakerGaugeValue(BreakerOpen) {
+		t.Errorf("expected the gauge to show open, got %v", value)
+	}
+}
+
+func TestBreakersSweep(t *testing.T) {
+	var set breakers
+	config := BreakerConfig{MinRequests: 1, Window: time.Minute}.withDefaults()
+	for _, host := range []string{"idle", "open", "busy"} {
+		set.allow(host, config)
+	}
+	set.record("open", true, false, config)
+	set.hosts["idle"].window = time.Now().Add(-2 * time.Minute)
+	set.swept = time.Now().Add(-sweepEvery)
+	set.allow("busy", config)
+	if _, found := set.hosts["idle"]; found || len(set.hosts) != 2 {
+		t.Errorf("expected only the idle breaker to be swept, have %v", set.hosts)
+	}
+}
@@ -0,0 +1,272 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+ * A cassette records the upstream calls a Magic makes and plays them back
+ * later, so workloads and recipes can be exercised without their backends.
+ * Set it as the Magic's Transport. Calls are matched on method, url and body
+ * and replayed in the order they were recorded. Request headers are never
+ * written to the cassette, they carry credentials. Multipart boundaries are
+ * random, so they're numbered before bodies are compared or recorded. Bodies
+ * that aren't valid UTF-8 are written base64 encoded. gRPC calls don't go through the
+ * Transport, so they aren't recorded and fail when replaying.
+ */
+
+type CassetteMode int
+
+const (
+	CassetteReplay CassetteMode = iota // answer from the cassette, never call upstream
+	CassetteRecord                     // call upstream and remember every exchange, see Save
+)
+
+// the most of a response body the caller will read, in the request's context
+type responseLimitKey struct{}
+
+// ErrNoInteraction is returned when replaying a call the cassette doesn't have.
+var ErrNoInteraction = errors.New("no recorded interaction")
+
+// Interaction is one recorded call.
+type Interaction struct {
+	Request struct {
+		Method       string `json:"method"`
+		URL          string `json:"url"`
+		Body         string `json:"body,omitempty"`
+		BodyEncoding string `json:"bodyEncoding,omitempty"` // "base64" or empty for text
+	} `json:"request"`
+	Response struct {
+		Code         int         `json:"code"`
+		Header       http.Header `json:"headers,omitempty"`
+		Body         string      `json:"body"`
+		BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	} `json:"response"`
+}
+
+// Cassette is an http.RoundTripper that records or replays upstream calls.
+type Cassette struct {
+	Path      string
+	Mode      CassetteMode
+	Transport http.RoundTripper // makes the real calls when recording, http.DefaultTransport if nil
+
+	mutex        sync.Mutex
+	interactions []Interaction
+	played       []bool
+}
+
+// NewCassette opens the cassette at path. Replaying loads it, recording starts
+// an empty one that Save writes to path.
+func NewCassette(path string, mode CassetteMode) (cassette *Cassette, err error) {
+	cassette = &Cassette{Path: path, Mode: mode}
+	if mode == CassetteRecord {
+		return
+	}
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	var file struct {
+		Interactions []Interaction `json:"interactions"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse cassette %s: %s", path, err)
+	}
+	// bodies are kept decoded in memory
+	for index := range file.Interactions {
+		interaction := &file.Interactions[index]
+		if err = decodeCassetteBody(&interaction.Request.Body, &interaction.Request.BodyEncoding); err != nil {
+			return nil, fmt.Errorf("unable to parse cassette %s: interaction %d: %s", path, index, err)
+		}
+		if err = decodeCassetteBody(&interaction.Response.Body, &interaction.Response.BodyEncoding); err != nil {
+			return nil, fmt.Errorf("unable to parse cassette %s: interaction %d: %s", path, index, err)
+		}
+	}
+	cassette.interactions = file.Interactions
+	cassette.played = make([]bool, len(file.Interactions))
+	return cassette, nil
+}
+
+// Save writes what has been recorded to the cassette's Path.
+func (cassette *Cassette) Save() error {
+	cassette.mutex.Lock()
+	file := struct {
+		Interactions []Interaction `json:"interactions"`
+	}{make([]Interaction, len(cassette.interactions))}
+	for index, interaction := range cassette.interactions {
+		encodeCassetteBody(&interaction.Request.Body, &interaction.Request.BodyEncoding)
+		encodeCassetteBody(&interaction.Response.Body, &interaction.Response.BodyEncoding)
+		file.Interactions[index] = interaction
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	cassette.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cassette.Path, append(data, '\n'), 0644)
+}
+
+// json would replace the bytes of a binary body that aren't valid UTF-8, so
+// those bodies are written base64 encoded
+func encodeCassetteBody(body, encoding *string) {
+	if !utf8.ValidString(*body) {
+		*body, *encoding = base64.StdEncoding.EncodeToString([]byte(*body)), "base64"
+	}
+}
+
+func decodeCassetteBody(body, encoding *string) error {
+	switch *encoding {
+	case "":
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(*body)
+		if err != nil {
+			return err
+		}
+		*body, *encoding = string(decoded), ""
+	default:
+		return fmt.Errorf("unknown body encoding %q", *encoding)
+	}
+	return nil
+}
+
+func (cassette *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	body = normalizeBoundaries(req.Header.Get("Content-Type"), body)
+	if cassette.Mode == CassetteRecord {
+		return cassette.record(req, body)
+	}
+	return cassette.replay(req, body)
+}
+
+var boundaryParam = regexp.MustCompile(`(?i)boundary="?([^";\r\n]+)"?`)
+
+// normalizeBoundaries numbers the multipart boundaries of a request body,
+// its Content-Type's and any nested ones e.g. OData changesets, so the same
+// request matches however it was encoded
+func normalizeBoundaries(contentType string, body []byte) []byte {
+	var boundaries []string
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["boundary"] != "" {
+		boundaries = append(boundaries, params["boundary"])
+	}
+	for _, match := range boundaryParam.FindAllSubmatch(body, -1) {
+		boundaries = append(boundaries, string(match[1]))
+	}
+	for index, boundary := range boundaries {
+		body = bytes.ReplaceAll(body, []byte(boundary), []byte(fmt.Sprintf("boundary-%d", index+1)))
+	}
+	return body
+}
+
+func (cassette *Cassette) record(req *http.Request, body []byte) (*http.Response, error) {
+	transport := cassette.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// bodies are recorded decompressed, so they can be read and replayed to
+	// clients that didn't ask for the encoding
+	var reader io.Reader = resp.Body
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		decoded, err := decompress(encoding, resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		defer decoded.Close()
+		reader = decoded
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	}
+	// no more is kept than MakeRequest would read
+	if limit, ok := req.Context().Value(responseLimitKey{}).(int64); ok {
+		reader = io.LimitReader(reader, limit+1)
+	}
+	data, err := ioutil.ReadAll(reader)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	var interaction Interaction
+	interaction.Request.Method = req.Method
+	interaction.Request.URL = req.URL.String()
+	interaction.Request.Body = string(body)
+	interaction.Response.Code = resp.StatusCode
+	interaction.Response.Header = resp.Header.Clone()
+	interaction.Response.Body = string(data)
+
+	cassette.mutex.Lock()
+	cassette.interactions = append(cassette.interactions, interaction)
+	cassette.played = append(cassette.played, true)
+	cassette.mutex.Unlock()
+	return resp, nil
+}
+
+// replay answers with the first matching interaction not yet played. once
+// they all have been, the last match is played again.
+func (cassette *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	cassette.mutex.Lock()
+	found := -1
+	for index, interaction := range cassette.interactions {
+		if !strings.EqualFold(interaction.Request.Method, req.Method) ||
+			interaction.Request.URL != req.URL.String() ||
+			interaction.Request.Body != string(body) {
+			continue
+		}
+		found = index
+		if !cassette.played[index] {
+			break
+		}
+	}
+	if found < 0 {
+		cassette.mutex.Unlock()
+		return nil, fmt.Errorf("%w for %s %s", ErrNoInteraction, req.Method, req.URL)
+	}
+	cassette.played[found] = true
+	interaction := cassette.interactions[found]
+	cassette.mutex.Unlock()
+
+	header := interaction.Response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Response.Code, http.StatusText(interaction.Response.Code)),
+		StatusCode:    interaction.Response.Code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(interaction.Response.Body)),
+		ContentLength: int64(len(interaction.Response.Body)),
+		Request:       req,
+	}, nil
+}
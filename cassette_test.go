@@ -0,0 +1,151 @@
+package ensemble
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassetteRecordReplay(t *testing.T) {
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		calls++
+		writer.Header().Set("X-Call", "yes")
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write([]byte("made"))
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recording, err := NewCassette(path, CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := Request{Id: "1", URL: backend.URL + "/things", Method: "POST", Data: `{"a":1}`}
+	var res Response
+	if err = (&Magic{Transport: recording}).makeRequest(context.Background(), &req, &res); err != nil || res.Data != "made" {
+		t.Fatalf("recording failed: %+v %v", res, err)
+	}
+	if err = recording.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.Close()
+	replaying, err := NewCassette(path, CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	magic := &Magic{Transport: replaying}
+	res = Response{}
+	req = Request{Id: "1", URL: backend.URL + "/things", Method: "POST", Data: `{"a":1}`}
+	if err = magic.makeRequest(context.Background(), &req, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusCreated || res.Data != "made" || res.Header.Get("X-Call") != "yes" || calls != 1 {
+		t.Errorf("unexpected replay %+v after %d calls", res, calls)
+	}
+
+	// a different body isn't the same call
+	req = Request{Id: "1", URL: backend.URL + "/things", Method: "POST", Data: `{"a":2}`}
+	if err = magic.makeRequest(context.Background(), &req, &Response{}); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("expected ErrNoInteraction, got %v", err)
+	}
+
+	// gRPC calls can't be replayed
+	req = Request{Id: "1", URL: "grpc://localhost:1/pkg.Service/Method", Method: "POST"}
+	if err = magic.callGRPC(context.Background(), &req, &Response{}); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("expected ErrNoInteraction for a gRPC call, got %v", err)
+	}
+}
+
+func TestCassetteBinaryBody(t *testing.T) {
+	binary := []byte{0xff, 0x00, 0x80, 'a'}
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write(binary)
+	}))
+	defer backend.Close()
+
+	call := func(cassette *Cassette) []byte {
+		t.Helper()
+		res, err := (&http.Client{Transport: cassette}).Post(backend.URL, "application/octet-stream", bytes.NewReader(binary))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return body
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recording, _ := NewCassette(path, CassetteRecord)
+	call(recording)
+	if err := recording.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Contains(data, []byte(`"bodyEncoding": "base64"`)) {
+		t.Errorf("expected the binary bodies to be base64 encoded, got %s", data)
+	}
+
+	backend.Close()
+	replaying, err := NewCassette(path, CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := call(replaying); !bytes.Equal(body, binary) {
+		t.Errorf("expected %v, got %v", binary, body)
+	}
+}
+
+func TestCassetteMultipart(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		req.ParseMultipartForm(1 << 20)
+		writer.Write([]byte("got " + req.FormValue("name") + " " + strings.Repeat("x", 100)))
+	}))
+	defer backend.Close()
+
+	req := func() *Request {
+		return &Request{Id: "1", URL: backend.URL + "/upload", Method: "POST", Multipart: []Part{{Name: "name", Value: "ann"}}}
+	}
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recording, _ := NewCassette(path, CassetteRecord)
+	var res Response
+	if err := (&Magic{Transport: recording}).makeRequest(context.Background(), req(), &res); err != nil || !strings.HasPrefix(res.Data, "got ann") {
+		t.Fatalf("recording failed: %+v %v", res, err)
+	}
+	// the recording keeps no more than MaxResponseBytes allows
+	limited := &Magic{Transport: recording, Limits: Limits{MaxResponseBytes: 10}}
+	limited.makeRequest(context.Background(), &Request{Id: "2", URL: backend.URL + "/limited", Method: "GET"}, &Response{})
+	if err := recording.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if body := recording.interactions[1].Response.Body; len(body) != 11 {
+		t.Errorf("expected 11 bytes to be recorded, got %q", body)
+	}
+
+	backend.Close()
+	replaying, err := NewCassette(path, CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = Response{}
+	if err = (&Magic{Transport: replaying}).makeRequest(context.Background(), req(), &res); err != nil || !strings.HasPrefix(res.Data, "got ann") {
+		t.Errorf("expected the multipart call to replay, got %+v %v", res, err)
+	}
+}
+
+func TestNormalizeBoundaries(t *testing.T) {
+	batch := func(outer, inner string) []byte {
+		return []byte("--" + outer + "\r\nContent-Type: multipart/mixed; boundary=" + inner + "\r\n\r\n--" + inner + "\r\n\r\nPOST x HTTP/1.1\r\n\r\n--" + inner + "--\r\n--" + outer + "--\r\n")
+	}
+	first := normalizeBoundaries("multipart/mixed; boundary=batch_a1", batch("batch_a1", "changeset_b2"))
+	second := normalizeBoundaries("multipart/mixed; boundary=batch_c3", batch("batch_c3", "changeset_d4"))
+	if !bytes.Equal(first, second) {
+		t.Errorf("expected the same body, got\n%s\n%s", first, second)
+	}
+}
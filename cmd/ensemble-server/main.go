@@ -0,0 +1,34 @@
+// Command ensemble-server runs the ensemble service from a config file.
+//
+//	ensemble-server -config ensemble.yaml
+//
+// It serves workloads on /magic, recipes on /recipes/{name}, async jobs on
+// /jobs/{id}, GraphQL on /graphql when a schema is configured, liveness on
+// /healthz and readiness on /readyz, and the gRPC service on grpc_listen if
+// set. On SIGINT or SIGTERM it stops being ready, stops accepting
+// connections and waits for in-flight workloads, up to timeouts.shutdown,
+// then cancels the rest. See example.yaml for every setting.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/russellsimpkins/ensemble/ensembleserver"
+)
+
+func main() {
+	path := flag.String("config", "ensemble.yaml", "config file, JSON or YAML")
+	flag.Parse()
+
+	config, err := ensembleserver.LoadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ensemble-server:", err)
+		os.Exit(1)
+	}
+	if err = ensembleserver.Run(config, ensembleserver.ShutdownSignal()); err != nil {
+		fmt.Fprintln(os.Stderr, "ensemble-server:", err)
+		os.Exit(1)
+	}
+}
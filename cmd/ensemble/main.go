@@ -0,0 +1,292 @@
+// Command ensemble runs, checks and serves ensemble workloads.
+//
+//	ensemble run workload.json       execute a workload and print the Result
+//	ensemble run -replay tape.json w replay the upstream calls saved by -record
+//	ensemble run -config c.yaml w    use the services, limits and credentials of a server config
+//	ensemble validate workload.yaml  report problems without calling anything
+//	ensemble graph workload.json     print the order requests will be made in
+//	ensemble serve -config c.yaml    start the http service, as ensemble-server does
+//
+// Workload files can be JSON, YAML or HCL, picked by extension. Use - to read
+// JSON from stdin.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/russellsimpkins/ensemble"
+	"github.com/russellsimpkins/ensemble/ensembleserver"
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `usage: ensemble <command> [flags] [workload]
+
+commands:
+  run       execute a workload and print the Result as JSON
+  validate  check a workload without making any calls
+  graph     print the dependency plan of a workload
+  serve     start the ensemble http service
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "run":
+		err = run(args, os.Stdout)
+	case "validate":
+		err = validate(args, os.Stdout)
+	case "graph":
+		err = graph(args, os.Stdout)
+	case "serve":
+		err = serve(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", command, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ensemble:", err)
+		os.Exit(1)
+	}
+}
+
+// flags every workload command shares
+type options struct {
+	flags   *flag.FlagSet
+	config  string
+	recipes string
+	params  string
+	verbose bool
+}
+
+func newOptions(name string) *options {
+	opts := &options{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	opts.flags.StringVar(&opts.config, "config", "", "ensemble-server config file, for its services, limits and other settings")
+	opts.flags.StringVar(&opts.recipes, "recipes", "", "directory of recipes, the workload argument is then a recipe name")
+	opts.flags.StringVar(&opts.params, "params", "{}", "recipe params as a JSON object")
+	opts.flags.BoolVar(&opts.verbose, "v", false, "log debug output")
+	return opts
+}
+
+// load parses the flags and reads the workload they point at
+func (opts *options) load(args []string) (work ensemble.Workload, err error) {
+	opts.flags.Parse(args)
+	if opts.verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	if opts.flags.NArg() != 1 {
+		return work, fmt.Errorf("expected one workload, got %d", opts.flags.NArg())
+	}
+	name := opts.flags.Arg(0)
+
+	if opts.recipes != "" {
+		var (
+			recipes map[string]*ensemble.Recipe
+			params  map[string]interface{}
+		)
+		if recipes, err = ensemble.LoadRecipes(opts.recipes); err != nil {
+			return
+		}
+		recipe, ok := recipes[name]
+		if !ok {
+			return work, fmt.Errorf("no recipe named %s in %s", name, opts.recipes)
+		}
+		if err = json.Unmarshal([]byte(opts.params), &params); err != nil {
+			return work, fmt.Errorf("unable to parse -params: %s", err)
+		}
+		return recipe.Expand(params)
+	}
+
+	var data []byte
+	if name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return
+	}
+	contentType := "application/json"
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		contentType = "application/yaml"
+	case ".hcl":
+		contentType = "application/hcl"
+	}
+	return ensemble.DecodeWorkload(contentType, data)
+}
+
+// magic is the Magic the server described by -config would run, or a bare
+// one without it
+func (opts *options) magic() (*ensemble.Magic, error) {
+	if opts.config == "" {
+		return &ensemble.Magic{}, nil
+	}
+	config, err := ensembleserver.LoadConfig(opts.config)
+	if err != nil {
+		return nil, err
+	}
+	return config.Magic()
+}
+
+func run(args []string, out io.Writer) error {
+	opts := newOptions("run")
+	record := opts.flags.String("record", "", "record the upstream calls to this cassette")
+	replay := opts.flags.String("replay", "", "answer upstream calls from this cassette instead of calling out")
+	work, err := opts.load(args)
+	if err != nil {
+		return err
+	}
+	magic, err := opts.magic()
+	if err != nil {
+		return err
+	}
+	var cassette *ensemble.Cassette
+	switch {
+	case *record != "" && *replay != "":
+		return fmt.Errorf("-record and -replay can't be used together")
+	case *record != "":
+		cassette, err = ensemble.NewCassette(*record, ensemble.CassetteRecord)
+	case *replay != "":
+		cassette, err = ensemble.NewCassette(*replay, ensemble.CassetteReplay)
+	}
+	if err != nil {
+		return err
+	}
+	if cassette != nil {
+		magic.Transport = cassette
+	}
+	if err = magic.Validate(&work); err != nil {
+		return err
+	}
+	result, err := magic.DoMagic(work)
+	if err != nil {
+		return err
+	}
+	if *record != "" {
+		if err = cassette.Save(); err != nil {
+			return err
+		}
+	}
+	body, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(body))
+	return nil
+}
+
+func validate(args []string, out io.Writer) error {
+	opts := newOptions("validate")
+	work, err := opts.load(args)
+	if err != nil {
+		return err
+	}
+	magic, err := opts.magic()
+	if err != nil {
+		return err
+	}
+	if err = magic.Validate(&work); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "ok")
+	return nil
+}
+
+func graph(args []string, out io.Writer) error {
+	opts := newOptions("graph")
+	work, err := opts.load(args)
+	if err != nil {
+		return err
+	}
+	if work.StrictOrder {
+		fmt.Fprintln(out, "in order:")
+	} else {
+		fmt.Fprintln(out, "in parallel:")
+	}
+	for index, req := range work.Requests {
+		step := "-"
+		if work.StrictOrder {
+			step = fmt.Sprintf("%d.", index+1)
+		}
+		printRequest(out, &req, step, "  ")
+	}
+	return nil
+}
+
+// dependencies are made one after the other before their request
+func printRequest(out io.Writer, req *ensemble.Request, step, indent string) {
+	target := req.URL
+	if req.Service != "" {
+		target = req.Service + ":" + req.URL
+	}
+	var notes []string
+	if req.UseData {
+		notes = append(notes, "uses dependency data")
+	}
+	if req.UseDepHeader {
+		notes = append(notes, "uses dependency headers")
+	}
+	line := fmt.Sprintf("%s%s %s %s %s", indent, step, req.Id, strings.ToUpper(req.Method), target)
+	if len(notes) > 0 {
+		line += " (" + strings.Join(notes, ", ") + ")"
+	}
+	fmt.Fprintln(out, line)
+	if len(req.Dependents) > 0 {
+		fmt.Fprintf(out, "%s   after:\n", indent)
+		for index := range req.Dependents {
+			printRequest(out, &req.Dependents[index].Request, fmt.Sprintf("%d.", index+1), indent+"     ")
+		}
+	}
+}
+
+func serve(args []string) error {
+	config, err := serveConfig(args)
+	if err != nil {
+		return err
+	}
+	return ensembleserver.Run(config, ensembleserver.ShutdownSignal())
+}
+
+// serveConfig is the config file, if there is one, with the flags on top
+func serveConfig(args []string) (*ensembleserver.Config, error) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	path := flags.String("config", "", "ensemble-server config file, JSON or YAML")
+	addr := flags.String("addr", "", "address to listen on, overrides the config's. defaults to :8080")
+	recipes := flags.String("recipes", "", "directory of recipes to serve under /recipes/, overrides the config's")
+	verbose := flags.Bool("v", false, "log debug output")
+	flags.Parse(args)
+
+	config := &ensembleserver.Config{Listen: ":8080"}
+	if *path != "" {
+		var err error
+		if config, err = ensembleserver.LoadConfig(*path); err != nil {
+			return nil, err
+		}
+	}
+	if *addr != "" {
+		config.Listen = *addr
+	}
+	if *recipes != "" {
+		config.Recipes = *recipes
+	}
+	if *verbose {
+		config.LogLevel = "debug"
+	}
+	return config, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const workload = `
+requests:
+  - id: "1"
+    url: BACKEND/one
+    method: GET
+  - id: "2"
+    url: BACKEND/two
+    method: POST
+    data: '{"data":%s}'
+    useData: true
+    doJoin: true
+    dependency:
+      - request: {id: "21", url: "BACKEND/dep", method: GET}
+strictorder: true
+`
+
+func writeWorkload(t *testing.T, url string) string {
+	path := filepath.Join(t.TempDir(), "workload.yaml")
+	os.WriteFile(path, []byte(strings.ReplaceAll(workload, "BACKEND", url)), 0600)
+	return path
+}
+
+func TestRun(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(`"` + req.URL.Path + `"`))
+	}))
+	defer backend.Close()
+
+	var out bytes.Buffer
+	if err := run([]string{writeWorkload(t, backend.URL)}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"data": "\"/two\""`) {
+		t.Errorf("unexpected output %s", out.String())
+	}
+}
+
+func TestRunRecordReplay(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(`"` + req.URL.Path + `"`))
+	}))
+	path := writeWorkload(t, backend.URL)
+	tape := filepath.Join(t.TempDir(), "tape.json")
+
+	var recorded bytes.Buffer
+	if err := run([]string{"-record", tape, path}, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	backend.Close()
+
+	var replayed bytes.Buffer
+	if err := run([]string{"-replay", tape, path}, &replayed); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.String() != recorded.String() {
+		t.Errorf("replay differs from the recording:\n%s\n%s", replayed.String(), recorded.String())
+	}
+}
+
+func TestGraph(t *testing.T) {
+	var out bytes.Buffer
+	if err := graph([]string{writeWorkload(t, "http://backend")}, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `in order:
+  1. 1 GET http://backend/one
+  2. 2 POST http://backend/two (uses dependency data)
+     after:
+       1. 21 GET http://backend/dep
+`
+	if out.String() != expected {
+		t.Errorf("unexpected graph\n%s", out.String())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.json")
+	os.WriteFile(path, []byte(`{"requests":[{"id":"1","method":"FETCH"},{"id":"1","url":"http://x","method":"GET"}]}`), 0600)
+	err := validate([]string{path}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected the workload to be invalid")
+	}
+	for _, problem := range []string{"invalid method", "no url", "more than once"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q in %s", problem, err)
+		}
+	}
+}
+
+func TestConfigServices(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(`"` + req.URL.Path + `"`))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "ensemble.yaml")
+	os.WriteFile(config, []byte("services:\n  users:\n    base_url: "+backend.URL+"/v1\n"), 0600)
+	path := filepath.Join(dir, "workload.json")
+	os.WriteFile(path, []byte(`{"requests":[{"id":"1","service":"users","url":"/users/42","method":"GET"}]}`), 0600)
+
+	if err := validate([]string{path}, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "unknown service") {
+		t.Errorf("expected the service to be unknown without -config, got %v", err)
+	}
+	var out bytes.Buffer
+	if err := validate([]string{"-config", config, path}, &out); err != nil || out.String() != "ok\n" {
+		t.Errorf("expected the workload to be valid with -config, got %v %q", err, out.String())
+	}
+	out.Reset()
+	if err := run([]string{"-config", config, path}, &out); err != nil || !strings.Contains(out.String(), `/v1/users/42`) {
+		t.Errorf("expected the call to go to the configured service, got %v %s", err, out.String())
+	}
+}
+
+func TestServeConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ensemble.yaml")
+	os.WriteFile(path, []byte("listen: \":9000\"\nrecipes: /etc/recipes\nconcurrency: 8\n"), 0600)
+
+	config, err := serveConfig([]string{"-config", path, "-addr", ":7000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":7000" || config.Recipes != "/etc/recipes" || config.Concurrency != 8 {
+		t.Errorf("expected the file with -addr on top, got %+v", config)
+	}
+	if config, err = serveConfig(nil); err != nil || config.Listen != ":8080" {
+		t.Errorf("expected the default address without a config, got %+v %v", config, err)
+	}
+}
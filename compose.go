@@ -0,0 +1,491 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+ * A workload's compose template assembles one JSON document from its
+ * responses, so clients don't have to stitch Responses back together. The
+ * template is JSON whose values may also be references to a response by id
+ * and the len function:
+ *
+ *   {"user": $1.body, "orders": $2.body.items, "first": $2.body.items[0].id,
+ *    "count": len($2.body.items), "type": $1.headers.Content-Type}
+ *
+ * A reference picks the response's body (its JSON, or the raw data if it
+ * isn't JSON), data, code or headers and then walks the value with .key and
+ * [index]. Anything that isn't there is null.
+ */
+
+// a parsed compose template
+type composeNode interface {
+	eval(env *composeEnv) interface{}
+}
+
+type composeEnv struct {
+	responses map[string]*Response
+	bodies    map[string]interface{}
+}
+
+type composeLiteral struct{ value interface{} }
+
+type composeObject struct {
+	keys   []string
+	values []composeNode
+}
+
+type composeArray struct{ items []composeNode }
+
+type composeRef struct {
+	id   string
+	path []interface{} // string keys and int indexes
+}
+
+type composeCall struct {
+	name string
+	arg  composeNode
+}
+
+// Compose evaluates the workload's compose template against the result's
+// responses.
+func Compose(template string, responses []Response) (interface{}, error) {
+	node, err := parseCompose(template)
+	if err != nil {
+		return nil, err
+	}
+	env := &composeEnv{responses: make(map[string]*Response), bodies: make(map[string]interface{})}
+	for index := range responses {
+		env.responses[responses[index].Id] = &responses[index]
+	}
+	return node.eval(env), nil
+}
+
+// checkCompose parses the template and checks it only refers to requests
+// the workload has
+func checkCompose(workload *Workload) error {
+	node, err := parseCompose(workload.Compose)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	for _, req := range workload.Requests {
+		ids[req.Id] = true
+	}
+	var unknown []string
+	walkCompose(node, func(ref *composeRef) {
+		if !ids[ref.id] {
+			unknown = append(unknown, "$"+ref.id)
+		}
+	})
+	if len(unknown) > 0 {
+		return fmt.Errorf("compose refers to unknown requests %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func walkCompose(node composeNode, visit func(*composeRef)) {
+	switch node := node.(type) {
+	case *composeRef:
+		visit(node)
+	case *composeObject:
+		for _, value := range node.values {
+			walkCompose(value, visit)
+		}
+	case *composeArray:
+		for _, item := range node.items {
+			walkCompose(item, visit)
+		}
+	case *composeCall:
+		walkCompose(node.arg, visit)
+	}
+}
+
+func (node *composeLiteral) eval(env *composeEnv) interface{} {
+	return node.value
+}
+
+func (node *composeObject) eval(env *composeEnv) interface{} {
+	object := make(map[string]interface{}, len(node.keys))
+	for index, key := range node.keys {
+		object[key] = node.values[index].eval(env)
+	}
+	return object
+}
+
+func (node *composeArray) eval(env *composeEnv) interface{} {
+	array := make([]interface{}, len(node.items))
+	for index, item := range node.items {
+		array[index] = item.eval(env)
+	}
+	return array
+}
+
+func (node *composeRef) eval(env *composeEnv) interface{} {
+	response, ok := env.responses[node.id]
+	if !ok {
+		return nil
+	}
+	field, path := "body", node.path
+	if len(path) > 0 {
+		if name, ok := path[0].(string); ok {
+			field, path = name, path[1:]
+		}
+	}
+
+	var value interface{}
+	switch field {
+	case "body":
+		value = env.body(response)
+	case "data":
+		value = response.Data
+	case "code":
+		value = response.Code
+	case "headers":
+		if len(path) == 0 {
+			return response.Header
+		}
+		name, ok := path[0].(string)
+		if !ok || response.Header == nil {
+			return nil
+		}
+		if values := response.Header.Values(http.CanonicalHeaderKey(name)); len(values) > 0 {
+			return values[0]
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	for _, step := range path {
+		switch step := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = object[step]
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || step < 0 || step >= len(array) {
+				return nil
+			}
+			value = array[step]
+		}
+	}
+	return value
+}
+
+// the response's body as JSON, decoded once per response
+func (env *composeEnv) body(response *Response) interface{} {
+	if body, ok := env.bodies[response.Id]; ok {
+		return body
+	}
+	var (
+		body interface{}
+		err  error
+	)
+	if response.Object != nil {
+		var data []byte
+		if data, err = json.Marshal(response.Object); err == nil {
+			body, err = decodeJSON(data)
+		}
+		if err != nil {
+			body = response.Object
+		}
+	} else if body, err = decodeJSON([]byte(response.Data)); err != nil {
+		body = response.Data
+	}
+	env.bodies[response.Id] = body
+	return body
+}
+
+// decodeJSON is json.Unmarshal into an interface{}, but whole numbers are
+// int64, or uint64 if they're too big for one, rather than float64, which
+// would change ids above 2^53
+func decodeJSON(data []byte) (value interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return jsonNumbers(value), nil
+}
+
+func jsonNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for index, item := range value {
+			value[index] = jsonNumbers(item)
+		}
+	case json.Number:
+		if whole, err := value.Int64(); err == nil {
+			return whole
+		}
+		if whole, err := strconv.ParseUint(value.String(), 10, 64); err == nil {
+			return whole
+		}
+		float, _ := value.Float64()
+		return float
+	}
+	return value
+}
+
+func (node *composeCall) eval(env *composeEnv) interface{} {
+	switch value := node.arg.eval(env).(type) {
+	case []interface{}:
+		return len(value)
+	case map[string]interface{}:
+		return len(value)
+	case string:
+		return len(value)
+	}
+	return 0
+}
+
+// the compose template parser, JSON plus references and calls
+type composeParser struct {
+	text []rune
+	pos  int
+}
+
+func parseCompose(template string) (node composeNode, err error) {
+	parser := &composeParser{text: []rune(template)}
+	if node, err = parser.value(); err != nil {
+		return nil, err
+	}
+	parser.space()
+	if parser.pos < len(parser.text) {
+		return nil, parser.errorf("unexpected %q after the template", parser.text[parser.pos])
+	}
+	return node, nil
+}
+
+func (parser *composeParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("compose: "+format+" at offset %d", append(args, parser.pos)...)
+}
+
+func (parser *composeParser) space() {
+	for parser.pos < len(parser.text) && unicode.IsSpace(parser.text[parser.pos]) {
+		parser.pos++
+	}
+}
+
+func (parser *composeParser) peek() rune {
+	parser.space()
+	if parser.pos >= len(parser.text) {
+		return 0
+	}
+	return parser.text[parser.pos]
+}
+
+func (parser *composeParser) expect(r rune) error {
+	if parser.peek() != r {
+		return parser.errorf("expected %q", r)
+	}
+	parser.pos++
+	return nil
+}
+
+func isComposeName(r rune) bool {
+	return r == '_' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (parser *composeParser) name() string {
+	start := parser.pos
+	for parser.pos < len(parser.text) && isComposeName(parser.text[parser.pos]) {
+		parser.pos++
+	}
+	return string(parser.text[start:parser.pos])
+}
+
+func (parser *composeParser) value() (composeNode, error) {
+	switch r := parser.peek(); {
+	case r == 0:
+		return nil, parser.errorf("unexpected end of template")
+	case r == '{':
+		return parser.object()
+	case r == '[':
+		return parser.array()
+	case r == '"':
+		text, err := parser.string()
+		return &composeLiteral{text}, err
+	case r == '$':
+		return parser.ref()
+	case r == '-' || unicode.IsDigit(r):
+		return parser.number()
+	case unicode.IsLetter(r):
+		word := parser.name()
+		switch word {
+		case "true":
+			return &composeLiteral{true}, nil
+		case "false":
+			return &composeLiteral{false}, nil
+		case "null":
+			return &composeLiteral{nil}, nil
+		case "len":
+			if err := parser.expect('('); err != nil {
+				return nil, err
+			}
+			arg, err := parser.value()
+			if err != nil {
+				return nil, err
+			}
+			return &composeCall{word, arg}, parser.expect(')')
+		}
+		return nil, parser.errorf("unknown word %q", word)
+	default:
+		return nil, parser.errorf("unexpected %q", r)
+	}
+}
+
+func (parser *composeParser) object() (composeNode, error) {
+	parser.pos++ // {
+	node := &composeObject{}
+	if parser.peek() == '}' {
+		parser.pos++
+		return node, nil
+	}
+	for {
+		var (
+			key string
+			err error
+		)
+		if parser.peek() == '"' {
+			key, err = parser.string()
+		} else if key = parser.name(); key == "" {
+			err = parser.errorf("expected a key")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = parser.expect(':'); err != nil {
+			return nil, err
+		}
+		value, err := parser.value()
+		if err != nil {
+			return nil, err
+		}
+		node.keys = append(node.keys, key)
+		node.values = append(node.values, value)
+		if parser.peek() == ',' {
+			parser.pos++
+			continue
+		}
+		return node, parser.expect('}')
+	}
+}
+
+func (parser *composeParser) array() (composeNode, error) {
+	parser.pos++ // [
+	node := &composeArray{}
+	if parser.peek() == ']' {
+		parser.pos++
+		return node, nil
+	}
+	for {
+		item, err := parser.value()
+		if err != nil {
+			return nil, err
+		}
+		node.items = append(node.items, item)
+		if parser.peek() == ',' {
+			parser.pos++
+			continue
+		}
+		return node, parser.expect(']')
+	}
+}
+
+func (parser *composeParser) string() (text string, err error) {
+	start := parser.pos
+	parser.pos++ // "
+	for parser.pos < len(parser.text) {
+		switch parser.text[parser.pos] {
+		case '\\':
+			parser.pos += 2
+			continue
+		case '"':
+			parser.pos++
+			if err = json.Unmarshal([]byte(string(parser.text[start:parser.pos])), &text); err != nil {
+				return "", parser.errorf("bad string: %s", err)
+			}
+			return text, nil
+		}
+		parser.pos++
+	}
+	return "", parser.errorf("unterminated string")
+}
+
+func (parser *composeParser) number() (composeNode, error) {
+	start := parser.pos
+	parser.pos++
+	for parser.pos < len(parser.text) && strings.ContainsRune("0123456789.eE+-", parser.text[parser.pos]) {
+		parser.pos++
+	}
+	number, err := strconv.ParseFloat(string(parser.text[start:parser.pos]), 64)
+	if err != nil {
+		return nil, parser.errorf("bad number %q", string(parser.text[start:parser.pos]))
+	}
+	return &composeLiteral{number}, nil
+}
+
+func (parser *composeParser) ref() (composeNode, error) {
+	parser.pos++ // $
+	node := &composeRef{id: parser.name()}
+	if node.id == "" {
+		return nil, parser.errorf("expected a request id after $")
+	}
+	for parser.pos < len(parser.text) {
+		switch parser.text[parser.pos] {
+		case '.':
+			parser.pos++
+			key := parser.name()
+			if key == "" {
+				return nil, parser.errorf("expected a key after .")
+			}
+			node.path = append(node.path, key)
+		case '[':
+			parser.pos++
+			if parser.peek() == '"' {
+				key, err := parser.string()
+				if err != nil {
+					return nil, err
+				}
+				node.path = append(node.path, key)
+			} else {
+				parser.space()
+				start := parser.pos
+				for parser.pos < len(parser.text) && unicode.IsDigit(parser.text[parser.pos]) {
+					parser.pos++
+				}
+				index, err := strconv.Atoi(string(parser.text[start:parser.pos]))
+				if err != nil {
+					return nil, parser.errorf("expected an index")
+				}
+				node.path = append(node.path, index)
+			}
+			if err := parser.expect(']'); err != nil {
+				return nil, err
+			}
+		default:
+			return node, nil
+		}
+	}
+	return node, nil
+}
@@ -0,0 +1,107 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	responses := []Response{
+		{Id: "1", Code: 200, Data: `{"name":"ann","age":25}`, Header: http.Header{"Content-Type": {"application/json"}}},
+		{Id: "orders", Code: 200, Data: `{"items":[{"id":"a1"},{"id":"b2"}]}`},
+		{Id: "3", Code: 502, Data: "bad gateway"},
+	}
+	template := `{
+		"user": $1.body,
+		"age": $1.body.age,
+		"orders": $orders.body.items,
+		"first": $orders.body.items[0].id,
+		"count": len($orders.body.items),
+		type: $1.headers.content-type,
+		"status": [$1.code, $3.code],
+		"error": $3,
+		"missing": $1.body.nope[2],
+		"literal": {"n": -1.5, "ok": true, "nothing": null, "s": "a \"quoted\" }"}
+	}`
+	composed, err := Compose(template, responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(composed)
+	expected := `{"age":25,"count":2,"error":"bad gateway","first":"a1","literal":{"n":-1.5,"nothing":null,"ok":true,"s":"a \"quoted\" }"},"missing":null,"orders":[{"id":"a1"},{"id":"b2"}],"status":[200,502],"type":"application/json","user":{"age":25,"name":"ann"}}`
+	if string(got) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestComposeLargeIds(t *testing.T) {
+	responses := []Response{{Id: "1", Code: 200, Data: `{"id":9007199254740993,"big":18446744073709551615,"ratio":0.5}`}}
+	composed, err := Compose(`{"id": $1.body.id, "body": $1.body}`, responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(composed)
+	expected := `{"body":{"big":18446744073709551615,"id":9007199254740993,"ratio":0.5},"id":9007199254740993}`
+	if string(got) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestComposeErrors(t *testing.T) {
+	for _, template := range []string{
+		`{"a": $}`,
+		`{"a": $1.}`,
+		`{"a": $1[x]}`,
+		`{"a": size($1)}`,
+		`{"a": 1`,
+		`{"a": 1} extra`,
+		`{"a": "open}`,
+	} {
+		if _, err := Compose(template, nil); err == nil {
+			t.Errorf("expected %s to fail", template)
+		}
+	}
+
+	workload := &Workload{Compose: `{"a": $1, "b": $2}`, Requests: []Request{{Id: "1", URL: "http://x", Method: "GET"}}}
+	if err := (&Magic{}).Validate(workload); err == nil || !strings.Contains(err.Error(), "$2") {
+		t.Errorf("expected the unknown $2 to be reported, got %v", err)
+	}
+}
+
+func TestComposeWorkload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/user":
+			writer.Write([]byte(`{"name":"ann"}`))
+		case "/orders":
+			writer.Write([]byte(`{"items":[1,2,3]}`))
+		}
+	}))
+	defer backend.Close()
+
+	body := `{"compose": "{\"user\": $u.body.name, \"count\": len($o.body.items)}", "compose_only": true, "requests": [
+		{"id": "u", "url": "` + backend.URL + `/user", "method": "GET"},
+		{"id": "o", "url": "` + backend.URL + `/orders", "method": "GET"}]}`
+	recorder := httptest.NewRecorder()
+	(&Magic{}).Handle(recorder, httptest.NewRequest("POST", "/magic", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", recorder.Code, recorder.Body)
+	}
+	var result struct {
+		Responses []Response             `json:"responses"`
+		Composed  map[string]interface{} `json:"composed"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	if result.Responses != nil || result.Composed["user"] != "ann" || result.Composed["count"] != float64(3) {
+		t.Errorf("unexpected result %s", recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	(&Magic{}).Handle(recorder, httptest.NewRequest("POST", "/magic", strings.NewReader(`{"compose": "{\"a\": $nope}", "requests": []}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad template to be refused, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,238 @@
+package ensemble
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Replies are compressed with zstd, brotli or gzip when the Magic has a
+ * Compression and the client's Accept-Encoding allows it. Small replies
+ * aren't worth it and go out as they are.
+ *
+ * Upstream calls always ask for compressed bodies themselves and decompress
+ * them explicitly. Go's transport only undoes gzip when it set
+ * Accept-Encoding, so a client's Accept-Encoding forwarded with UseHeaders
+ * used to hand us bodies we couldn't read. The client's header is replaced
+ * and MaxResponseBytes limits the decompressed body.
+ */
+
+// DefaultCompressMinSize is the smallest reply that's compressed when
+// Compression.MinSize isn't set.
+const DefaultCompressMinSize = 1024
+
+// the encodings we can decompress, offered on every upstream call
+const upstreamAcceptEncoding = "zstd, br, gzip, deflate"
+
+// Compression is how a Magic compresses its replies.
+type Compression struct {
+	MinSize   int      `json:"min_size"`  // replies smaller than this many bytes are sent as is, DefaultCompressMinSize if 0
+	Encodings []string `json:"encodings"` // the encodings to use by preference, zstd, br and gzip if empty
+}
+
+func (compression *Compression) encodings() []string {
+	if len(compression.Encodings) > 0 {
+		return compression.Encodings
+	}
+	return []string{"zstd", "br", "gzip"}
+}
+
+// pickEncoding chooses the encoding for a reply from Accept-Encoding: the
+// one the client rates highest, ties going to the first in offered
+func pickEncoding(acceptEncoding string, offered []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	ratings := make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		q := 1.0
+		if _, value, ok := strings.Cut(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+				continue
+			}
+		}
+		ratings[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := ratings[encoding]
+		if !ok {
+			q = ratings["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compress wraps the writer to compress the reply if the Magic has a
+// Compression and the client wants it. call done once the reply is written.
+func (magic *Magic) compress(writer http.ResponseWriter, req *http.Request) (_ http.ResponseWriter, done func()) {
+	if magic.Compression == nil {
+		return writer, func() {}
+	}
+	writer.Header().Add("Vary", "Accept-Encoding")
+	encoding := pickEncoding(req.Header.Get("Accept-Encoding"), magic.Compression.encodings())
+	if encoding == "" {
+		return writer, func() {}
+	}
+	minSize := magic.Compression.MinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressMinSize
+	}
+	compressor := &compressWriter{ResponseWriter: writer, encoding: encoding, minSize: minSize, status: http.StatusOK}
+	return compressor, compressor.close
+}
+
+// compressWriter holds the reply back until it's big enough to be worth
+// compressing, or complete
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buffer   []byte
+	started  bool           // the header has been written
+	encoder  io.WriteCloser // nil if the reply goes out as is
+}
+
+func (writer *compressWriter) WriteHeader(status int) {
+	if !writer.started {
+		writer.status = status
+	}
+}
+
+func (writer *compressWriter) Write(data []byte) (int, error) {
+	if writer.started {
+		if writer.encoder != nil {
+			return writer.encoder.Write(data)
+		}
+		return writer.ResponseWriter.Write(data)
+	}
+	writer.buffer = append(writer.buffer, data...)
+	if len(writer.buffer) >= writer.minSize {
+		if err := writer.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// start writes the header and what's buffered, compressed if it should be
+func (writer *compressWriter) start(compress bool) (err error) {
+	writer.started = true
+	header := writer.Header()
+	if compress && header.Get("Content-Encoding") == "" && writer.status != http.StatusNoContent && writer.status != http.StatusNotModified {
+		if writer.encoder, err = newEncoder(writer.encoding, writer.ResponseWriter); err != nil {
+			log.WithFields(log.Fields{"encoding": writer.encoding, "err": err}).Warn("[compress] Sending the reply uncompressed")
+		} else {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", writer.encoding)
+		}
+	}
+	writer.ResponseWriter.WriteHeader(writer.status)
+	buffer := writer.buffer
+	writer.buffer = nil
+	if writer.encoder != nil {
+		_, err = writer.encoder.Write(buffer)
+	} else {
+		_, err = writer.ResponseWriter.Write(buffer)
+	}
+	return err
+}
+
+func (writer *compressWriter) close() {
+	if !writer.started {
+		writer.start(false)
+	}
+	if writer.encoder != nil {
+		writer.encoder.Close()
+	}
+}
+
+func newEncoder(encoding string, writer io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(writer), nil
+	case "br":
+		return brotli.NewWriter(writer), nil
+	case "zstd":
+		return zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// decompress undoes the Content-Encoding of an upstream body. identity, no
+// encoding at all and an empty body are returned as they are.
+func decompress(contentEncoding string, body io.Reader) (io.ReadCloser, error) {
+	// a 204, a 304 or a reply to HEAD can name an encoding with no body to
+	// undo, which gzip would call an unexpected EOF
+	buffered := bufio.NewReader(body)
+	if _, err := buffered.Peek(1); err == io.EOF {
+		return io.NopCloser(buffered), nil
+	}
+	encodings := strings.Split(contentEncoding, ",")
+	reader := io.NopCloser(buffered)
+	var closers []io.Closer
+	// encodings are listed in the order they were applied
+	for index := len(encodings) - 1; index >= 0; index-- {
+		var (
+			decoded io.ReadCloser
+			err     error
+		)
+		switch encoding := strings.ToLower(strings.TrimSpace(encodings[index])); encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			decoded, err = gzip.NewReader(reader)
+		case "br":
+			decoded = io.NopCloser(brotli.NewReader(reader))
+		case "zstd":
+			var decoder *zstd.Decoder
+			if decoder, err = zstd.NewReader(reader, zstd.WithDecoderConcurrency(1)); err == nil {
+				decoded = decoder.IOReadCloser()
+			}
+		case "deflate":
+			decoded, err = zlib.NewReader(reader)
+		default:
+			err = fmt.Errorf("unsupported Content-Encoding %q", encoding)
+		}
+		if err != nil {
+			closeAll(closers)
+			return nil, err
+		}
+		closers = append(closers, decoded)
+		reader = decoded
+	}
+	return &decodedBody{Reader: reader, closers: closers}, nil
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (body *decodedBody) Close() error {
+	closeAll(body.closers)
+	return nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package ensemble
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestPickEncoding(t *testing.T) {
+	offered := []string{"zstd", "br", "gzip"}
+	for _, test := range []struct{ accept, want string }{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, gzip;q=0.1", "gzip"},
+		{"*", "zstd"},
+		{"*;q=0.2, br;q=0", "zstd"},
+		{"identity", ""},
+		{"GZIP", "gzip"},
+	} {
+		if got := pickEncoding(test.accept, offered); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.accept, test.want, got)
+		}
+	}
+}
+
+func decodeAll(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	reader, err := decompress(encoding, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestCompressReplies(t *testing.T) {
+	big := strings.Repeat("ensemble ", 500)
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/big" {
+			writer.Write([]byte(big))
+			return
+		}
+		writer.Write([]byte("small"))
+	}))
+	defer backend.Close()
+
+	magic := &Magic{Compression: &Compression{}}
+	call := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		body := `{"requests":[{"id":"1","url":"` + backend.URL + path + `","method":"GET"}]}`
+		req := httptest.NewRequest("POST", "/magic", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		recorder := httptest.NewRecorder()
+		magic.Handle(recorder, req)
+		return recorder
+	}
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		recorder := call("/big", encoding)
+		if got := recorder.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("expected %s, got %q", encoding, got)
+		}
+		if recorder.Body.Len() > len(big)/2 {
+			t.Errorf("%s: reply of %d bytes isn't compressed", encoding, recorder.Body.Len())
+		}
+		var result Result
+		if err := json.Unmarshal(decodeAll(t, encoding, recorder.Body.Bytes()), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Responses[0].Data != big {
+			t.Errorf("%s: unexpected response %+v", encoding, result.Responses[0])
+		}
+	}
+
+	recorder := call("/small", "gzip")
+	if recorder.Header().Get("Content-Encoding") != "" || !strings.Contains(recorder.Body.String(), `"small"`) {
+		t.Errorf("expected a small reply as is, got %q %s", recorder.Header().Get("Content-Encoding"), recorder.Body)
+	}
+	if recorder.Header().Get("Vary") == "" {
+		t.Error("expected Vary: Accept-Encoding")
+	}
+	if recorder = call("/big", ""); recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected no compression without Accept-Encoding, got %q", recorder.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestDecompressUpstream(t *testing.T) {
+	payload := `{"hello":"` + strings.Repeat("world", 100) + `"}`
+	encode := func(encoding string) []byte {
+		var buffer bytes.Buffer
+		var writer io.WriteCloser
+		switch encoding {
+		case "gzip":
+			writer = gzip.NewWriter(&buffer)
+		case "br":
+			writer = brotli.NewWriter(&buffer)
+		case "zstd":
+			writer, _ = zstd.NewWriter(&buffer)
+		}
+		writer.Write([]byte(payload))
+		writer.Close()
+		return buffer.Bytes()
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		encoding := strings.TrimPrefix(req.URL.Path, "/")
+		if !strings.Contains(req.Header.Get("Accept-Encoding"), encoding) {
+			http.Error(writer, "not accepted "+req.Header.Get("Accept-Encoding"), http.StatusNotAcceptable)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Content-Encoding", encoding)
+		writer.Write(encode(encoding))
+	}))
+	defer backend.Close()
+
+	// the client's Accept-Encoding is forwarded, which stops Go's transport
+	// from undoing gzip
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	workload := Workload{Requests: []Request{
+		{Id: "gzip", URL: backend.URL + "/gzip", Method: "GET", Header: header},
+		{Id: "br", URL: backend.URL + "/br", Method: "GET", Header: header},
+		{Id: "zstd", URL: backend.URL + "/zstd", Method: "GET"},
+	}}
+	result := runWorkload(t, &Magic{}, workload)
+	for _, response := range result.Responses {
+		if response.Code != 200 || response.Data != payload || response.Encoding != "" {
+			t.Errorf("%s: unexpected response %d %q", response.Id, response.Code, response.Data)
+		}
+		if response.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: expected Content-Encoding to be dropped", response.Id)
+		}
+	}
+
+	// an encoding with no body is nothing to undo
+	empty := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/"))
+		writer.Header().Set("Content-Encoding", "gzip")
+		writer.WriteHeader(code)
+	}))
+	defer empty.Close()
+	result = runWorkload(t, &Magic{}, Workload{Requests: []Request{
+		{Id: "204", URL: empty.URL + "/204", Method: "GET", Header: header},
+		{Id: "304", URL: empty.URL + "/304", Method: "GET", Header: header},
+		{Id: "200", URL: empty.URL + "/200", Method: "GET", Header: header},
+	}})
+	for _, response := range result.Responses {
+		if strconv.Itoa(response.Code) != response.Id || response.Data != "" {
+			t.Errorf("%s: unexpected response %d %q", response.Id, response.Code, response.Data)
+		}
+	}
+
+	// the limit applies to the decompressed body
+	result = runWorkload(t, &Magic{Limits: Limits{MaxResponseBytes: 100}}, Workload{Requests: []Request{
+		{Id: "gzip", URL: backend.URL + "/gzip", Method: "GET"},
+	}})
+	if response := result.Responses[0]; response.Code != http.StatusBadGateway || !strings.Contains(response.Data, "exceeds 100 bytes") {
+		t.Errorf("unexpected response %d %q", response.Code, response.Data)
+	}
+}
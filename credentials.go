@@ -0,0 +1,215 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Credentials for upstream calls live on the server, attached to a named
+ * Service. MakeRequest applies them after the client's headers, so a mobile
+ * client never needs to know, or can override, a backend secret.
+ */
+
+// CredentialProvider authenticates an outbound request to a service.
+type CredentialProvider interface {
+	Apply(req *http.Request) error
+}
+
+// BearerCredential sends a static bearer token.
+type BearerCredential struct {
+	Token string
+}
+
+func (cred *BearerCredential) Apply(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+cred.Token)
+	return nil
+}
+
+// BasicCredential sends http basic auth.
+type BasicCredential struct {
+	Username string
+	Password string
+}
+
+func (cred *BasicCredential) Apply(req *http.Request) error {
+	req.SetBasicAuth(cred.Username, cred.Password)
+	return nil
+}
+
+// APIKeyCredential sends a key in a header, X-API-Key unless Header is set.
+type APIKeyCredential struct {
+	Header string
+	Key    string
+}
+
+func (cred *APIKeyCredential) Apply(req *http.Request) error {
+	header := cred.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+	req.Header.Set(header, cred.Key)
+	return nil
+}
+
+// APIKeyFromFile reads a key from a file, e.g. a mounted secret. surrounding
+// whitespace is trimmed.
+func APIKeyFromFile(header, path string) (*APIKeyCredential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &APIKeyCredential{Header: header, Key: strings.TrimSpace(string(data))}, nil
+}
+
+// APIKeyFromEnv reads a key from an environment variable.
+func APIKeyFromEnv(header, name string) (*APIKeyCredential, error) {
+	key := os.Getenv(name)
+	if key == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return &APIKeyCredential{Header: header, Key: key}, nil
+}
+
+// ClientCredentials fetches bearer tokens with the OAuth2 client credentials
+// grant and caches them until shortly before they expire. One fetch runs at a
+// time, and calls keep using the cached token while its successor is fetched.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Client       *http.Client // defaults to a client with DefaultTimeout
+
+	mutex    sync.Mutex
+	token    string
+	refresh  time.Time   // when to start fetching the next token
+	expires  time.Time   // when the token can't be used any more
+	fetching *tokenFetch // the fetch in flight, nil if none
+}
+
+// how long a token lasts when the endpoint doesn't send expires_in
+const defaultTokenLifetime = 5 * time.Minute
+
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func (cred *ClientCredentials) Apply(req *http.Request) error {
+	token, err := cred.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Token returns the cached access token, fetching a new one if needed.
+func (cred *ClientCredentials) Token() (string, error) {
+	cred.mutex.Lock()
+	now := time.Now()
+	if cred.token != "" && now.Before(cred.refresh) {
+		defer cred.mutex.Unlock()
+		return cred.token, nil
+	}
+	fetch := cred.fetching
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		cred.fetching = fetch
+		go cred.fetch(fetch)
+	}
+	// the token is still good while the next one is fetched
+	if cred.token != "" && now.Before(cred.expires) {
+		defer cred.mutex.Unlock()
+		return cred.token, nil
+	}
+	cred.mutex.Unlock()
+
+	<-fetch.done
+	return fetch.token, fetch.err
+}
+
+// fetch asks the token endpoint for a token, without holding the mutex so
+// calls with a good token don't wait on it
+func (cred *ClientCredentials) fetch(fetch *tokenFetch) {
+	token, lifetime, err := cred.request()
+
+	cred.mutex.Lock()
+	if err == nil {
+		now := time.Now()
+		cred.token = token
+		cred.expires = now.Add(lifetime)
+		// refresh a little early so a token doesn't expire mid flight
+		cred.refresh = cred.expires.Add(-lifetime / 10)
+		if lifetime > time.Minute {
+			cred.refresh = cred.expires.Add(-30 * time.Second)
+		}
+		log.WithFields(log.Fields{"client": cred.ClientID, "expires": cred.expires}).Debug("[ClientCredentials] fetched a new token")
+	}
+	cred.fetching = nil
+	cred.mutex.Unlock()
+
+	fetch.token, fetch.err = token, err
+	close(fetch.done)
+}
+
+func (cred *ClientCredentials) request() (token string, lifetime time.Duration, err error) {
+	var (
+		request *http.Request
+		resp    *http.Response
+		body    []byte
+		reply   struct {
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}
+	)
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(cred.Scopes) > 0 {
+		form.Set("scope", strings.Join(cred.Scopes, " "))
+	}
+	if request, err = http.NewRequest("POST", cred.TokenURL, strings.NewReader(form.Encode())); err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(cred.ClientID), url.QueryEscape(cred.ClientSecret))
+
+	client := cred.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if resp, err = client.Do(request); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+	if err = json.Unmarshal(body, &reply); err != nil {
+		return "", 0, fmt.Errorf("unable to parse token response: %s", err)
+	}
+	if reply.AccessToken == "" {
+		return "", 0, fmt.Errorf("token endpoint returned no access_token")
+	}
+
+	lifetime = time.Duration(reply.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	return reply.AccessToken, lifetime, nil
+}
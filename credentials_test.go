@@ -0,0 +1,132 @@
+package ensemble
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoes the Authorization header the backend saw
+func echoAuthorization(writer http.ResponseWriter, req *http.Request) {
+	writer.Write([]byte(req.Header.Get("Authorization")))
+}
+
+func TestClientCredentialsCaching(t *testing.T) {
+	var issued int32
+	tokens := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		req.ParseForm()
+		if id != "ensemble" || secret != "hush" || req.Form.Get("grant_type") != "client_credentials" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&issued, 1)
+		writer.Write([]byte(`{"access_token":"tok","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer tokens.Close()
+	backend := httptest.NewServer(http.HandlerFunc(echoAuthorization))
+	defer backend.Close()
+
+	magic := &Magic{Services: map[string]Service{"orders": {
+		Name:        "orders",
+		BaseURL:     backend.URL,
+		Credentials: &ClientCredentials{TokenURL: tokens.URL, ClientID: "ensemble", ClientSecret: "hush"},
+	}}}
+
+	for i := 0; i < 3; i++ {
+		result, err := magic.DoMagic(Workload{
+			StrictOrder: true,
+			Requests: []Request{{
+				Id:      "1",
+				Service: "orders",
+				URL:     "/orders",
+				Method:  "GET",
+				// a client can't smuggle in its own credentials
+				Header: http.Header{"Authorization": {"Bearer client"}},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.Responses[0].Data; got != "Bearer tok" {
+			t.Errorf("expected the server side token, got %q", got)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("expected the token to be cached, it was issued %d times", issued)
+	}
+}
+
+func TestAPIKeyFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("abc123\n"), 0600)
+	cred, err := APIKeyFromFile("X-Backend-Key", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	cred.Apply(req)
+	if got := req.Header.Get("X-Backend-Key"); got != "abc123" {
+		t.Errorf("expected abc123, got %q", got)
+	}
+
+	if _, err = APIKeyFromEnv("X-Backend-Key", "ENSEMBLE_TEST_UNSET_KEY"); err == nil {
+		t.Error("expected an error for a missing environment variable")
+	}
+}
+
+func TestClientCredentialsFetching(t *testing.T) {
+	var issued int32
+	release := make(chan struct{})
+	tokens := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		atomic.AddInt32(&issued, 1)
+		// no expires_in
+		writer.Write([]byte(`{"access_token":"new","token_type":"bearer"}`))
+	}))
+	defer tokens.Close()
+
+	// a token due for refresh is still handed out while the next is fetched
+	cred := &ClientCredentials{TokenURL: tokens.URL}
+	cred.token, cred.refresh, cred.expires = "old", time.Now().Add(-time.Second), time.Now().Add(time.Minute)
+	if token, err := cred.Token(); err != nil || token != "old" {
+		t.Fatalf("expected the old token while fetching, got %q %v", token, err)
+	}
+
+	// callers without a good token share the one fetch
+	cred.mutex.Lock()
+	cred.expires = time.Now()
+	cred.mutex.Unlock()
+	var wait sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if token, err := cred.Token(); err != nil || token != "new" {
+				t.Errorf("expected the new token, got %q %v", token, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wait.Wait()
+	if fetched := atomic.LoadInt32(&issued); fetched != 1 {
+		t.Errorf("expected one fetch, got %d", fetched)
+	}
+
+	// without expires_in the token is kept for a while
+	if token, _ := cred.Token(); token != "new" || atomic.LoadInt32(&issued) != 1 {
+		t.Errorf("expected the token to be cached, got %q", token)
+	}
+	cred.mutex.Lock()
+	lifetime := cred.expires.Sub(time.Now())
+	cred.mutex.Unlock()
+	if lifetime < defaultTokenLifetime-time.Minute {
+		t.Errorf("expected the default lifetime, got %s", lifetime)
+	}
+}
@@ -3,9 +3,11 @@ package ensemble
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	klog "github.com/go-kit/kit/log"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 /*
@@ -30,41 +32,63 @@ type PassThruData struct {
 
 type Workload struct {
 	Requests    []Request `json:"requests"`
-	StrictOrder bool      `json:"strictorder"` // sync or async
-	Timeout     int64     `json:"timeout"`     // TODO add a real timeout for the sync process
-	UseHeaders  bool      `json:"use_headers"` // set this to true if the requests should use the headers of the work request
+	StrictOrder bool      `json:"strictorder"`  // sync or async
+	Timeout     int64     `json:"timeout"`      // TODO add a real timeout for the sync process
+	UseHeaders  bool      `json:"use_headers"`  // set this to true if the requests should use the headers of the work request, see HeaderPolicy
+	Async       bool      `json:"async"`        // answer with a job id straight away and run in the background, see Submit
+	Callback    string    `json:"callback"`     // for async workloads, where to post the finished Job
+	Compose     string    `json:"compose"`      // a template assembling one document from the responses, see Compose
+	ComposeOnly bool      `json:"compose_only"` // return only the composed document, not the Responses
 	header      http.Header
 }
 
 // our definition of a request
 // i'm not sure if i should have ContentType or assume it's in the headers
 type Request struct {
-	Id           string       `json:"id"`           // some way to identify this request in the response
-	URL          string       `json:"url"`          // the restful api to call
-	Method       string       `json:"method"`       // request method: get/put/post/delete
-	Data         string       `json:"data"`         // data to pass to api. if it's a get, we add ? to URL
-	Header       http.Header  `json:"headers"`      // request specific headers to add
-	Dependents   []Dependency `json:"dependency"`   // id of the request this request depends on
-	UseData      bool         `json:"useData"`      // if so, Payload is sprintf-able
-	UseDepHeader bool         `json:"useDepHeader"` // if you want to use the headers from dependent calls
-	DepHeader    []string     `json:"DepHeaders"`   // name the headers to use.
-	DoJoin       bool         `json:"doJoin"`       // you plan on passing multiple dependencies and need to join the results
-	JoinChar     string       `json:"joinChar"`     // e.g. , or |
-	PassByName   string       `json:"passName"`     // if it's not json, it parameterized and needs a name
+	Id               string       `json:"id"`               // some way to identify this request in the response
+	URL              string       `json:"url"`              // the restful api to call, or a gRPC method as grpc://host/package.Service/Method
+	Service          string       `json:"service"`          // optional named service, URL is then relative to it
+	Method           string       `json:"method"`           // request method: get/put/post/patch/delete
+	Data             string       `json:"data"`             // data to pass to api. if it's a get, we add ? to URL
+	Header           http.Header  `json:"headers"`          // request specific headers to add
+	Dependents       []Dependency `json:"dependency"`       // id of the request this request depends on
+	UseData          bool         `json:"useData"`          // if so, Payload is sprintf-able
+	UseDepHeader     bool         `json:"useDepHeader"`     // if you want to use the headers from dependent calls
+	DepHeader        []string     `json:"DepHeaders"`       // name the headers to use, all the HeaderPolicy allows if empty
+	DoJoin           bool         `json:"doJoin"`           // you plan on passing multiple dependencies and need to join the results
+	JoinChar         string       `json:"joinChar"`         // e.g. , or |
+	PassByName       string       `json:"passName"`         // if it's not json, it parameterized and needs a name
+	Hedge            *Hedge       `json:"hedge"`            // fire a second attempt if the first is slow, idempotent methods only
+	Fields           string       `json:"fields"`           // the parts of the JSON body to return, e.g. user{id,name}
+	DataEncoding     string       `json:"dataEncoding"`     // base64 if Data is base64 encoded, e.g. an image upload
+	Multipart        []Part       `json:"multipart"`        // sent as multipart/form-data instead of Data
+	ResponseEncoding string       `json:"responseEncoding"` // base64 or text, picked by the response's Content-Type if empty
+	Query            Params       `json:"query"`            // added to the url's query string
+	Form             Params       `json:"form"`             // sent as an application/x-www-form-urlencoded body
+	JSON             interface{}  `json:"json"`             // sent as an application/json body
+
+	resolved  bool              // URL has already been resolved against Service
+	service   *Service          // the resolved service, for its credentials and header policy
+	maxBody   int64             // the most of the response body MakeRequest will read, 0 for no limit
+	transport http.RoundTripper // the Magic's Transport, nil for the default
+	atomic    int               // the batch changeset it's in, 0 for none. see ErrNotRun
 }
 
 type Response struct {
-	Id     string      `json:"id"`   // some way to identify this request in the response
-	Data   string      `json:"data"` // put the data here
-	Object interface{} `json:"object"`
-	Code   int         `json:"code"` // http response code
-	Header http.Header `json:"headers"`
+	Id       string      `json:"id"`   // some way to identify this request in the response
+	Data     string      `json:"data"` // put the data here
+	Object   interface{} `json:"object"`
+	Code     int         `json:"code"` // http response code
+	Header   http.Header `json:"headers"`
+	Err      string      `json:"err,omitempty"`      // why ensemble didn't make the call, e.g. circuit-open
+	Encoding string      `json:"encoding,omitempty"` // base64 if Data is the base64 encoded body
 }
 
 type Result struct {
-	Responses []Response `json:"responses"`
-	Err       string     `json:"err,omitempty"`
-	Code      int        `json:"code"`
+	Responses []Response  `json:"responses"`
+	Composed  interface{} `json:"composed,omitempty"` // the workload's compose template, filled in
+	Err       string      `json:"err,omitempty"`
+	Code      int         `json:"code"`
 }
 
 type Call struct {
@@ -77,8 +101,42 @@ type MagicService interface {
 	DoMagic(Workload) (Result, error)
 }
 
+// a named upstream service. requests that name a service have their URL
+// resolved against the BaseURL, which keeps hosts out of the client's hands.
+type Service struct {
+	Name         string             `json:"name"`
+	BaseURL      string             `json:"base_url"`
+	Credentials  CredentialProvider `json:"-"`             // attached to every call to this service
+	HeaderPolicy *HeaderPolicy      `json:"header_policy"` // overrides Magic.HeaderPolicy for this service
+}
+
 type Magic struct {
-	logger *klog.Logger
+	Services      map[string]Service   // named upstream services, keyed by name
+	Authenticator Authenticator        // when set, every workload must come from a known principal
+	Policies      map[string]Policy    // per-principal authorization rules, keyed by principal name
+	AllowedHosts  []string             // if set, the only hosts any workload may call, e.g. *.internal
+	HeaderPolicy  *HeaderPolicy        // which headers may be forwarded, DefaultHeaderPolicy if nil
+	Limits        Limits               // workload quotas and rate limits, zero values are unlimited
+	Breakers      *BreakerConfig       // per host circuit breakers, off if nil
+	Recipes       map[string]*Recipe   // stored workloads run by HandleRecipe, see LoadRecipes
+	Jobs          JobStore             // where async jobs are kept, in memory if nil
+	JobTimeout    time.Duration        // how long an async job may run unless its workload has a Timeout, an hour if unset
+	Transport     http.RoundTripper    // makes the upstream calls, e.g. a Cassette. http.DefaultTransport if nil
+	Descriptors   *protoregistry.Files // describe upstream gRPC methods, see LoadDescriptorSet. reflection is used otherwise
+	Compression   *Compression         // compress replies by Accept-Encoding, off if nil
+
+	Concurrency         int // size of the worker pool for async requests, 0 for a go routine per request
+	WorkloadConcurrency int // most requests of one workload running at once, 0 for no limit
+
+	logger     *klog.Logger
+	clients    rateLimiter    // per client token buckets
+	hosts      rateLimiter    // per upstream host token buckets
+	workers    pool           // shared by every workload once Concurrency is set
+	breakers   breakers       // per upstream host circuit breakers
+	latencies  latencies      // recent upstream latencies, for hedging
+	life       lifecycle      // workloads in flight, for Shutdown
+	memoryJobs MemoryJobStore // the JobStore when Jobs is nil
+	upstreams  grpcUpstreams  // connections to gRPC backends
 }
 
 // go-kit specifics
@@ -0,0 +1,262 @@
+package ensembleserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/russellsimpkins/ensemble"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server's configuration file, JSON or YAML. ${VAR} anywhere in
+// the file is replaced with the environment variable, so secrets can stay out
+// of it.
+type Config struct {
+	Listen      string    `json:"listen"`       // defaults to :8080
+	AdminListen string    `json:"admin_listen"` // serves /admin and /metrics, off unless set. keep it private
+	GRPCListen  string    `json:"grpc_listen"`  // serves the gRPC service, off unless set
+	TLS         TLSConfig `json:"tls"`
+	Timeouts    Timeouts  `json:"timeouts"`
+	LogLevel    string    `json:"log_level"` // debug, info, warn or error
+
+	AllowedHosts        []string                   `json:"allowed_hosts"`
+	Services            map[string]ServiceConfig   `json:"services"`
+	HeaderPolicy        *ensemble.HeaderPolicy     `json:"header_policy"`
+	Auth                AuthConfig                 `json:"auth"`
+	Policies            map[string]ensemble.Policy `json:"policies"`
+	Limits              ensemble.Limits            `json:"limits"`
+	Breakers            *BreakerConfig             `json:"breakers"`
+	Concurrency         int                        `json:"concurrency"`
+	WorkloadConcurrency int                        `json:"workload_concurrency"`
+	Recipes             string                     `json:"recipes"`          // directory of recipes
+	JobTTL              Duration                   `json:"job_ttl"`          // how long finished async jobs are kept, defaults to 1h
+	GraphQL             string                     `json:"graphql"`          // a GraphQL schema file, served on /graphql
+	GRPCDescriptors     []string                   `json:"grpc_descriptors"` // descriptor sets for gRPC backends without reflection
+	Compression         *ensemble.Compression      `json:"compression"`      // compress replies by Accept-Encoding, off if absent
+}
+
+type TLSConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type Timeouts struct {
+	Read     Duration `json:"read"`     // defaults to 15s
+	Write    Duration `json:"write"`    // defaults to 30s
+	Idle     Duration `json:"idle"`     // defaults to 60s
+	Shutdown Duration `json:"shutdown"` // how long to drain in-flight workloads, defaults to 30s
+}
+
+type ServiceConfig struct {
+	BaseURL      string                 `json:"base_url"`
+	Credentials  *CredentialConfig      `json:"credentials"`
+	HeaderPolicy *ensemble.HeaderPolicy `json:"header_policy"`
+}
+
+// CredentialConfig picks a credential provider with Type: bearer, basic,
+// api_key or oauth2.
+type CredentialConfig struct {
+	Type         string   `json:"type"`
+	Token        string   `json:"token"`    // bearer
+	Username     string   `json:"username"` // basic
+	Password     string   `json:"password"`
+	Header       string   `json:"header"` // api_key
+	Key          string   `json:"key"`
+	KeyFile      string   `json:"key_file"`
+	TokenURL     string   `json:"token_url"` // oauth2 client credentials
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+type AuthConfig struct {
+	APIKeys      map[string]string `json:"api_keys"` // api key -> principal
+	APIKeyHeader string            `json:"api_key_header"`
+	HMAC         map[string]string `json:"hmac"` // key id -> secret
+	JWT          *JWTConfig        `json:"jwt"`
+}
+
+type JWTConfig struct {
+	JWKS     string `json:"jwks"` // path to the JWKS file
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	Claim    string `json:"claim"`
+}
+
+type BreakerConfig struct {
+	FailureRate float64  `json:"failure_rate"`
+	MinRequests int      `json:"min_requests"`
+	Window      Duration `json:"window"`
+	Cooldown    Duration `json:"cooldown"`
+	Probes      int      `json:"probes"`
+}
+
+// Duration reads "1m30s" style strings
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("durations are strings like \"30s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) or(fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return time.Duration(d)
+}
+
+// LoadConfig reads the config file at path
+func LoadConfig(path string) (config *Config, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	data = []byte(os.ExpandEnv(string(data)))
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		var value interface{}
+		if err = yaml.Unmarshal(data, &value); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %s", path, err)
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %s", path, err)
+		}
+	}
+	config = &Config{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", path, err)
+	}
+	if config.Listen == "" {
+		config.Listen = ":8080"
+	}
+	return
+}
+
+// Magic builds the ensemble.Magic the config describes
+func (config *Config) Magic() (magic *ensemble.Magic, err error) {
+	magic = &ensemble.Magic{
+		AllowedHosts:        config.AllowedHosts,
+		HeaderPolicy:        config.HeaderPolicy,
+		Policies:            config.Policies,
+		Limits:              config.Limits,
+		Concurrency:         config.Concurrency,
+		WorkloadConcurrency: config.WorkloadConcurrency,
+		Services:            make(map[string]ensemble.Service, len(config.Services)),
+		Jobs:                &ensemble.MemoryJobStore{TTL: time.Duration(config.JobTTL)},
+	}
+
+	for name, service := range config.Services {
+		var credentials ensemble.CredentialProvider
+		if service.Credentials != nil {
+			if credentials, err = service.Credentials.provider(); err != nil {
+				return nil, fmt.Errorf("service %s: %s", name, err)
+			}
+		}
+		magic.Services[name] = ensemble.Service{
+			Name:         name,
+			BaseURL:      service.BaseURL,
+			Credentials:  credentials,
+			HeaderPolicy: service.HeaderPolicy,
+		}
+	}
+
+	if magic.Authenticator, err = config.Auth.authenticator(); err != nil {
+		return nil, err
+	}
+
+	if config.Breakers != nil {
+		magic.Breakers = &ensemble.BreakerConfig{
+			FailureRate: config.Breakers.FailureRate,
+			MinRequests: config.Breakers.MinRequests,
+			Window:      time.Duration(config.Breakers.Window),
+			Cooldown:    time.Duration(config.Breakers.Cooldown),
+			Probes:      config.Breakers.Probes,
+			Gauge:       kitprometheus.NewGauge(breakerState),
+		}
+	}
+
+	magic.Compression = config.Compression
+
+	if len(config.GRPCDescriptors) > 0 {
+		if magic.Descriptors, err = ensemble.LoadDescriptorSet(config.GRPCDescriptors...); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Recipes != "" {
+		if magic.Recipes, err = ensemble.LoadRecipes(config.Recipes); err != nil {
+			return nil, err
+		}
+	}
+	return magic, nil
+}
+
+func (cred *CredentialConfig) provider() (ensemble.CredentialProvider, error) {
+	switch cred.Type {
+	case "bearer":
+		return &ensemble.BearerCredential{Token: cred.Token}, nil
+	case "basic":
+		return &ensemble.BasicCredential{Username: cred.Username, Password: cred.Password}, nil
+	case "api_key":
+		if cred.KeyFile != "" {
+			return ensemble.APIKeyFromFile(cred.Header, cred.KeyFile)
+		}
+		return &ensemble.APIKeyCredential{Header: cred.Header, Key: cred.Key}, nil
+	case "oauth2":
+		return &ensemble.ClientCredentials{
+			TokenURL:     cred.TokenURL,
+			ClientID:     cred.ClientID,
+			ClientSecret: cred.ClientSecret,
+			Scopes:       cred.Scopes,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown credentials type %q", cred.Type)
+}
+
+// the authenticators configured, nil if none are
+func (auth *AuthConfig) authenticator() (ensemble.Authenticator, error) {
+	var auths ensemble.Authenticators
+	if len(auth.APIKeys) > 0 {
+		auths = append(auths, &ensemble.APIKeyAuthenticator{Header: auth.APIKeyHeader, Keys: auth.APIKeys})
+	}
+	if len(auth.HMAC) > 0 {
+		secrets := make(map[string][]byte, len(auth.HMAC))
+		for id, secret := range auth.HMAC {
+			secrets[id] = []byte(secret)
+		}
+		auths = append(auths, &ensemble.HMACAuthenticator{Secrets: secrets})
+	}
+	if auth.JWT != nil {
+		jwt, err := ensemble.NewJWTAuthenticator(auth.JWT.JWKS, auth.JWT.Issuer, auth.JWT.Audience)
+		if err != nil {
+			return nil, err
+		}
+		jwt.Claim = auth.JWT.Claim
+		auths = append(auths, jwt)
+	}
+	if len(auths) == 0 {
+		return nil, nil
+	}
+	return auths, nil
+}
+
+func (config *Config) logLevel() (log.Level, error) {
+	if config.LogLevel == "" {
+		return log.InfoLevel, nil
+	}
+	return log.ParseLevel(config.LogLevel)
+}
@@ -0,0 +1,235 @@
+// Package ensembleserver runs ensemble as a service from a config file. It
+// serves workloads on /magic, recipes on /recipes/{name}, async jobs on
+// /jobs/{id}, GraphQL on /graphql when a schema is configured, liveness on
+// /healthz and readiness on /readyz, and the gRPC service on grpc_listen if
+// set. When stopped it stops being ready, stops accepting connections and
+// waits for in-flight workloads, up to timeouts.shutdown, then cancels the
+// rest. Both ensemble-server and ensemble serve use it.
+package ensembleserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/russellsimpkins/ensemble"
+	"github.com/russellsimpkins/ensemble/pb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// the state of each upstream host's circuit breaker, on the admin /metrics
+var breakerState = stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+	Namespace: "ensemble",
+	Name:      "breaker_state",
+	Help:      "Circuit breaker state per upstream host: 0 closed, 1 half open, 2 open.",
+}, []string{"host"})
+
+func init() {
+	stdprometheus.MustRegister(breakerState)
+}
+
+// ShutdownSignal is closed on the first SIGINT or SIGTERM
+func ShutdownSignal() <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.WithFields(log.Fields{"signal": sig}).Info("[ensemble-server] shutting down")
+		close(stop)
+	}()
+	return stop
+}
+
+// Server is the http side of ensemble-server
+type Server struct {
+	config  *Config
+	magic   *ensemble.Magic
+	graphql http.Handler // nil unless the config has a graphql schema
+	ready   int32
+}
+
+func NewServer(config *Config) (server *Server, err error) {
+	level, err := config.logLevel()
+	if err != nil {
+		return nil, err
+	}
+	log.SetLevel(level)
+
+	server = &Server{config: config}
+	if server.magic, err = config.Magic(); err != nil {
+		return nil, err
+	}
+	if config.GraphQL != "" {
+		schema, err := ensemble.LoadGraphQLSchema(config.GraphQL)
+		if err != nil {
+			return nil, err
+		}
+		if server.graphql, err = ensemble.NewGraphQLHandler(server.magic, schema); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// Handler routes the public endpoints
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/magic", ensemble.MakeHTTPHandler(server.magic))
+	mux.HandleFunc("/recipes/", server.magic.HandleRecipe)
+	mux.HandleFunc("/jobs/", server.magic.HandleJob)
+	if server.graphql != nil {
+		mux.Handle("/graphql", server.graphql)
+	}
+	mux.HandleFunc("/healthz", func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&server.ready) == 0 {
+			http.Error(writer, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		writer.Write([]byte("ready"))
+	})
+	return mux
+}
+
+// GRPCServer serves the ensemble gRPC service, with the config's TLS
+func (server *Server) GRPCServer() (*grpc.Server, error) {
+	var options []grpc.ServerOption
+	if tls := server.config.TLS; tls.Cert != "" {
+		creds, err := credentials.NewServerTLSFromFile(tls.Cert, tls.Key)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	grpcServer := grpc.NewServer(options...)
+	pb.RegisterEnsembleServer(grpcServer, ensemble.MakeGRPCServer(server.magic))
+	return grpcServer, nil
+}
+
+// Run serves until stop is closed, then drains in-flight workloads
+func Run(config *Config, stop <-chan struct{}) error {
+	server, err := NewServer(config)
+	if err != nil {
+		return err
+	}
+
+	timeouts := config.Timeouts
+	srv := &http.Server{
+		Handler:        server.Handler(),
+		Addr:           config.Listen,
+		ReadTimeout:    timeouts.Read.or(15 * time.Second),
+		WriteTimeout:   timeouts.Write.or(30 * time.Second),
+		IdleTimeout:    timeouts.Idle.or(60 * time.Second),
+		MaxHeaderBytes: 32768,
+	}
+
+	var admin *http.Server
+	if config.AdminListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/admin", server.magic.Admin)
+		mux.Handle("/metrics", promhttp.Handler())
+		admin = &http.Server{Handler: mux, Addr: config.AdminListen}
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				log.WithFields(log.Fields{"err": err}).Error("[ensemble-server] admin listener failed")
+			}
+		}()
+	}
+
+	failed := make(chan error, 2)
+
+	var (
+		grpcServer   *grpc.Server
+		grpcListener net.Listener
+	)
+	if config.GRPCListen != "" {
+		if grpcServer, err = server.GRPCServer(); err != nil {
+			return err
+		}
+		if grpcListener, err = net.Listen("tcp", config.GRPCListen); err != nil {
+			return err
+		}
+		go func() {
+			log.WithFields(log.Fields{"addr": config.GRPCListen}).Info("[ensemble-server] grpc listening")
+			failed <- grpcServer.Serve(grpcListener)
+		}()
+	}
+
+	go func() {
+		log.WithFields(log.Fields{"addr": config.Listen, "tls": config.TLS.Cert != ""}).Info("[ensemble-server] listening")
+		if config.TLS.Cert != "" {
+			failed <- srv.ListenAndServeTLS(config.TLS.Cert, config.TLS.Key)
+		} else {
+			failed <- srv.ListenAndServe()
+		}
+	}()
+	atomic.StoreInt32(&server.ready, 1)
+
+	select {
+	case err = <-failed:
+		// whichever listener failed, don't leave the others serving
+		srv.Close()
+		if grpcServer != nil {
+			// Serve may not have taken the listener yet
+			grpcServer.Stop()
+			grpcListener.Close()
+		}
+		if admin != nil {
+			admin.Close()
+		}
+		return err
+	case <-stop:
+	}
+
+	// stop being ready first so load balancers move traffic away, then wait for
+	// the in-flight workloads
+	atomic.StoreInt32(&server.ready, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), timeouts.Shutdown.or(30*time.Second))
+	defer cancel()
+	if admin != nil {
+		admin.Shutdown(ctx)
+	}
+	// magic cancels whatever is still running at the deadline, so the http
+	// server's handlers return in time
+	abandoned := make(chan []ensemble.Abandoned, 1)
+	go func() {
+		workloads, _ := server.magic.Shutdown(ctx)
+		abandoned <- workloads
+	}()
+	grpcStopped := make(chan struct{})
+	go func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+	err = srv.Shutdown(ctx)
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}
+	for _, workload := range <-abandoned {
+		log.WithFields(log.Fields{"started": workload.Started, "requests": workload.Requests}).Warn("[ensemble-server] abandoned a workload at the shutdown deadline")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("[ensemble-server] workloads were still running at the shutdown deadline")
+		return err
+	}
+	log.Info("[ensemble-server] stopped")
+	return nil
+}
@@ -0,0 +1,129 @@
+package ensembleserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/russellsimpkins/ensemble"
+)
+
+func TestLoadExampleConfig(t *testing.T) {
+	os.Setenv("MOBILE_API_KEY", "mobile-key")
+	config, err := LoadConfig("../cmd/ensemble-server/example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Auth.APIKeys["mobile-key"] != "mobile" {
+		t.Errorf("expected the api key from the environment, got %v", config.Auth.APIKeys)
+	}
+	if time.Duration(config.Breakers.Window) != time.Minute || config.Limits.PerClient.Burst != 20 {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.Services["orders"].Credentials.Type != "oauth2" {
+		t.Errorf("unexpected services %+v", config.Services)
+	}
+}
+
+func TestServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(req.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+		"listen": "127.0.0.1:0",
+		"services": {"api": {"base_url": "`+backend.URL+`", "credentials": {"type": "bearer", "token": "backend-token"}}},
+		"auth": {"api_keys": {"k1": "mobile"}},
+		"policies": {"mobile": {"services": ["api"]}}
+	}`), 0600)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(server.Handler())
+	defer front.Close()
+
+	req, _ := http.NewRequest("POST", front.URL+"/magic", strings.NewReader(`{"requests":[{"id":"1","service":"api","url":"/x","method":"GET"}],"strictorder":true}`))
+	req.Header.Set("X-API-Key", "k1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result ensemble.Result
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if len(result.Responses) != 1 || result.Responses[0].Data != "Bearer backend-token" {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	req, _ = http.NewRequest("POST", front.URL+"/magic", strings.NewReader(`{"requests":[{"id":"1","url":"`+backend.URL+`","method":"GET"}]}`))
+	req.Header.Set("X-API-Key", "k1")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the policy to forbid a raw url, got %d", resp.StatusCode)
+	}
+
+	if resp, err = http.Get(front.URL + "/readyz"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready outside of Run, got %d", resp.StatusCode)
+	}
+}
+
+func TestRunShutsDown(t *testing.T) {
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- Run(&Config{Listen: "127.0.0.1:0", GRPCListen: "127.0.0.1:0"}, stop) }()
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Run did not return after stop")
+	}
+}
+
+func TestRunStopsGRPCWhenHTTPFails(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	// find a free port for grpc
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcAddr := free.Addr().String()
+	free.Close()
+
+	if err = Run(&Config{Listen: taken.Addr().String(), GRPCListen: grpcAddr}, make(chan struct{})); err == nil {
+		t.Fatal("expected the http listener to fail")
+	}
+	// the grpc listener has been closed
+	listener, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		t.Fatalf("expected the grpc server to be stopped, got %v", err)
+	}
+	listener.Close()
+}
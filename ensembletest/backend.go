@@ -0,0 +1,167 @@
+// Package ensembletest helps test workloads and recipes. Backend is a fake
+// upstream served by httptest with canned routes, latency and injected
+// failures, and Run and the Assert helpers run a workload against it and
+// check its Result.
+//
+//	backend := ensembletest.NewBackend(map[string]ensembletest.Route{
+//		"GET /users/42": {Body: `{"name":"ann"}`},
+//		"/orders":       {Status: 503, Latency: time.Second},
+//	})
+//	defer backend.Close()
+//	result := ensembletest.Run(t, nil, backend.Workload(t, `{"requests":[{"id":"user","url":"{{backend}}/users/42","method":"GET"}]}`))
+//	ensembletest.AssertJSON(t, result, "user", `{"name":"ann"}`)
+package ensembletest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Route is how the backend answers one route.
+type Route struct {
+	Status   int           // defaults to 200
+	Body     string        // the response body
+	Header   http.Header   // response headers
+	Latency  time.Duration // wait this long before answering
+	Echo     bool          // answer with the request body instead of Body
+	Failures int           // fail this many calls before answering normally
+	FailWith int           // the status of a failed call, defaults to 500
+	Drop     bool          // close the connection without answering
+	Handler  http.HandlerFunc
+}
+
+// Call is a request the backend received.
+type Call struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// Backend is a fake upstream. Routes are keyed "METHOD /path" or just "/path"
+// for any method, the query string is ignored. Unknown routes get a 404.
+type Backend struct {
+	URL string // e.g. http://127.0.0.1:51234
+
+	server *httptest.Server
+	mutex  sync.Mutex
+	routes map[string]Route
+	hits   map[string]int
+	calls  []Call
+}
+
+// NewBackend starts a backend serving routes. Close it when done.
+func NewBackend(routes map[string]Route) *Backend {
+	backend := &Backend{routes: make(map[string]Route), hits: make(map[string]int)}
+	for pattern, route := range routes {
+		backend.routes[pattern] = route
+	}
+	backend.server = httptest.NewServer(backend)
+	backend.URL = backend.server.URL
+	return backend
+}
+
+// Route adds or replaces a route.
+func (backend *Backend) Route(pattern string, route Route) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.routes[pattern] = route
+	delete(backend.hits, pattern)
+}
+
+// Calls returns every request received so far, in order.
+func (backend *Backend) Calls() []Call {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return append([]Call(nil), backend.calls...)
+}
+
+// Hits is how many calls a route pattern has answered.
+func (backend *Backend) Hits(pattern string) int {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return backend.hits[pattern]
+}
+
+func (backend *Backend) Close() {
+	backend.server.Close()
+}
+
+func (backend *Backend) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	backend.mutex.Lock()
+	backend.calls = append(backend.calls, Call{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+		Header: req.Header.Clone(),
+		Body:   string(body),
+	})
+	pattern := req.Method + " " + req.URL.Path
+	route, ok := backend.routes[pattern]
+	if !ok {
+		pattern = req.URL.Path
+		route, ok = backend.routes[pattern]
+	}
+	if ok {
+		backend.hits[pattern]++
+	}
+	hits := backend.hits[pattern]
+	backend.mutex.Unlock()
+
+	if !ok {
+		http.NotFound(writer, req)
+		return
+	}
+
+	if route.Latency > 0 {
+		select {
+		case <-time.After(route.Latency):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if route.Drop {
+		if hijacker, ok := writer.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	if hits <= route.Failures {
+		status := route.FailWith
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		http.Error(writer, "injected failure", status)
+		return
+	}
+
+	if route.Handler != nil {
+		route.Handler(writer, req)
+		return
+	}
+
+	for name, values := range route.Header {
+		writer.Header()[name] = values
+	}
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	writer.WriteHeader(status)
+	if route.Echo {
+		writer.Write(body)
+	} else {
+		writer.Write([]byte(route.Body))
+	}
+}
@@ -0,0 +1,66 @@
+package ensembletest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/russellsimpkins/ensemble"
+)
+
+func TestBackend(t *testing.T) {
+	backend := NewBackend(map[string]Route{
+		"GET /provide1": {Body: `{"is this":"magic?"}`},
+		"/provide2":     {Body: `{"yup":"magic happens"}`, Header: http.Header{"X-Yup": {"yes"}}},
+		"POST /test2":   {Echo: true},
+	})
+	defer backend.Close()
+
+	result := Run(t, nil, backend.Workload(t, `
+requests:
+  - id: "2"
+    url: "{{backend}}/test2"
+    method: POST
+    data: '{"data":[%s]}'
+    useData: true
+    doJoin: true
+    joinChar: ","
+    dependency:
+      - request: {id: "21", url: "{{backend}}/provide1", method: GET}
+      - request: {id: "22", url: "{{backend}}/provide2", method: GET}
+  - id: "3"
+    url: "{{backend}}/missing"
+    method: GET
+strictorder: true
+`))
+
+	AssertCode(t, result, "2", http.StatusOK)
+	AssertJSON(t, result, "2", `{"data":[{"is this":"magic?"},{"yup":"magic happens"}]}`)
+	AssertCode(t, result, "3", http.StatusNotFound)
+
+	if backend.Hits("GET /provide1") != 1 || backend.Hits("/provide2") != 1 {
+		t.Errorf("unexpected hits %d %d", backend.Hits("GET /provide1"), backend.Hits("/provide2"))
+	}
+	if calls := backend.Calls(); len(calls) != 4 || calls[2].Body != `{"data":[{"is this":"magic?"},{"yup":"magic happens"}]}` {
+		t.Errorf("unexpected calls %+v", calls)
+	}
+}
+
+func TestBackendFailures(t *testing.T) {
+	backend := NewBackend(map[string]Route{
+		"/flaky": {Body: "ok", Failures: 1, FailWith: http.StatusServiceUnavailable},
+		"/slow":  {Body: "late", Latency: 2 * time.Second},
+		"/gone":  {Drop: true},
+	})
+	defer backend.Close()
+
+	magic := &ensemble.Magic{}
+	workload := backend.Workload(t, `{"requests":[{"id":"flaky","url":"{{backend}}/flaky","method":"GET"}]}`)
+	AssertCode(t, Run(t, magic, workload), "flaky", http.StatusServiceUnavailable)
+	AssertData(t, Run(t, magic, workload), "flaky", "ok")
+
+	// MakeRequest gives up after a second
+	result := Run(t, magic, backend.Workload(t, `{"requests":[{"id":"slow","url":"{{backend}}/slow","method":"GET"},{"id":"gone","url":"{{backend}}/gone","method":"GET"}]}`))
+	AssertCode(t, result, "slow", 0)
+	AssertCode(t, result, "gone", 0)
+}
@@ -0,0 +1,104 @@
+package ensembletest
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/russellsimpkins/ensemble"
+)
+
+// Workload decodes a JSON or YAML workload after replacing {{backend}} with
+// the backend's URL.
+func (backend *Backend) Workload(t testing.TB, text string) ensemble.Workload {
+	t.Helper()
+	text = strings.ReplaceAll(text, "{{backend}}", backend.URL)
+	contentType := "application/yaml"
+	if strings.HasPrefix(strings.TrimSpace(text), "{") {
+		contentType = "application/json"
+	}
+	work, err := ensemble.DecodeWorkload(contentType, []byte(text))
+	if err != nil {
+		t.Fatalf("unable to decode workload: %s", err)
+	}
+	return work
+}
+
+// Run validates and runs the workload, failing the test on any error. A nil
+// magic runs it with a zero Magic.
+func Run(t testing.TB, magic *ensemble.Magic, workload ensemble.Workload) ensemble.Result {
+	t.Helper()
+	if magic == nil {
+		magic = &ensemble.Magic{}
+	}
+	if err := magic.Validate(&workload); err != nil {
+		t.Fatalf("invalid workload: %s", err)
+	}
+	result, err := magic.DoMagic(workload)
+	if err != nil {
+		t.Fatalf("workload failed: %s", err)
+	}
+	return result
+}
+
+// RunRecipe expands one of magic's recipes with params and runs it.
+func RunRecipe(t testing.TB, magic *ensemble.Magic, name string, params map[string]interface{}) ensemble.Result {
+	t.Helper()
+	recipe, ok := magic.Recipes[name]
+	if !ok {
+		t.Fatalf("no recipe named %s", name)
+	}
+	workload, err := recipe.Expand(params)
+	if err != nil {
+		t.Fatalf("unable to expand recipe %s: %s", name, err)
+	}
+	return Run(t, magic, workload)
+}
+
+// Response returns the response with the given id, failing the test if there
+// is none.
+func Response(t testing.TB, result ensemble.Result, id string) ensemble.Response {
+	t.Helper()
+	for _, response := range result.Responses {
+		if response.Id == id {
+			return response
+		}
+	}
+	t.Fatalf("no response with id %s", id)
+	return ensemble.Response{}
+}
+
+// AssertCode checks the status code of a response.
+func AssertCode(t testing.TB, result ensemble.Result, id string, code int) {
+	t.Helper()
+	if response := Response(t, result, id); response.Code != code {
+		t.Errorf("response %s: expected code %d, got %d", id, code, response.Code)
+	}
+}
+
+// AssertData checks the body of a response exactly.
+func AssertData(t testing.TB, result ensemble.Result, id string, data string) {
+	t.Helper()
+	if response := Response(t, result, id); response.Data != data {
+		t.Errorf("response %s: expected %q, got %q", id, data, response.Data)
+	}
+}
+
+// AssertJSON checks the body of a response is the same JSON as expected,
+// ignoring key order and whitespace.
+func AssertJSON(t testing.TB, result ensemble.Result, id string, expected string) {
+	t.Helper()
+	response := Response(t, result, id)
+	var want, got interface{}
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		t.Fatalf("expected JSON is invalid: %s", err)
+	}
+	if err := json.Unmarshal([]byte(response.Data), &got); err != nil {
+		t.Errorf("response %s is not JSON: %q", id, response.Data)
+		return
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("response %s: expected %s, got %s", id, expected, response.Data)
+	}
+}
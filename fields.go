@@ -0,0 +1,170 @@
+package ensemble
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * A request's fields select the parts of its JSON body the client wants, in
+ * the style of partial responses: "user{id,name},orders{id,total}". Braces
+ * select within an object, and within every element of an array, a/b is
+ * short for a{b} and * is every key. The pruned body is returned as the
+ * response's object and its data is left empty. A dependency's fields prune
+ * the data passed on to the request that depends on it.
+ */
+
+// a parsed selection, nil for everything under a key
+type fieldSelection map[string]fieldSelection
+
+func parseFields(fields string) (selection fieldSelection, err error) {
+	parser := &fieldParser{text: fields}
+	if selection, err = parser.list(); err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.text) {
+		return nil, fmt.Errorf("fields: unexpected %q at offset %d", parser.text[parser.pos], parser.pos)
+	}
+	return selection, nil
+}
+
+type fieldParser struct {
+	text string
+	pos  int
+}
+
+// list := item (',' item)*
+func (parser *fieldParser) list() (fieldSelection, error) {
+	selection := make(fieldSelection)
+	for {
+		if err := parser.item(selection); err != nil {
+			return nil, err
+		}
+		parser.space()
+		if parser.pos < len(parser.text) && parser.text[parser.pos] == ',' {
+			parser.pos++
+			continue
+		}
+		return selection, nil
+	}
+}
+
+// item := name ('/' item | '{' list '}')?
+func (parser *fieldParser) item(selection fieldSelection) error {
+	parser.space()
+	start := parser.pos
+	for parser.pos < len(parser.text) && !strings.ContainsRune(",/{} \t\n", rune(parser.text[parser.pos])) {
+		parser.pos++
+	}
+	name := parser.text[start:parser.pos]
+	if name == "" {
+		return fmt.Errorf("fields: expected a name at offset %d", parser.pos)
+	}
+	parser.space()
+
+	var (
+		sub fieldSelection
+		err error
+	)
+	switch {
+	case parser.pos < len(parser.text) && parser.text[parser.pos] == '/':
+		parser.pos++
+		sub = make(fieldSelection)
+		err = parser.item(sub)
+	case parser.pos < len(parser.text) && parser.text[parser.pos] == '{':
+		parser.pos++
+		if sub, err = parser.list(); err == nil {
+			parser.space()
+			if parser.pos >= len(parser.text) || parser.text[parser.pos] != '}' {
+				return fmt.Errorf("fields: expected } at offset %d", parser.pos)
+			}
+			parser.pos++
+		}
+	}
+	if err != nil {
+		return err
+	}
+	selection.add(name, sub)
+	return nil
+}
+
+// add merges a selection, so "a/b,a/c" selects both b and c
+func (selection fieldSelection) add(name string, sub fieldSelection) {
+	existing, ok := selection[name]
+	if !ok {
+		selection[name] = sub
+		return
+	}
+	if existing == nil || sub == nil {
+		selection[name] = nil
+		return
+	}
+	for key, value := range sub {
+		existing.add(key, value)
+	}
+}
+
+func (parser *fieldParser) space() {
+	for parser.pos < len(parser.text) && strings.ContainsRune(" \t\n", rune(parser.text[parser.pos])) {
+		parser.pos++
+	}
+}
+
+// prune keeps the selected parts of a decoded JSON value
+func (selection fieldSelection) prune(value interface{}) interface{} {
+	if selection == nil {
+		return value
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		pruned := make(map[string]interface{})
+		for key, item := range value {
+			if sub, ok := selection[key]; ok {
+				pruned[key] = sub.prune(item)
+			} else if sub, ok := selection["*"]; ok {
+				pruned[key] = sub.prune(item)
+			}
+		}
+		return pruned
+	case []interface{}:
+		pruned := make([]interface{}, len(value))
+		for index, item := range value {
+			pruned[index] = selection.prune(item)
+		}
+		return pruned
+	}
+	return value
+}
+
+// selectFields prunes the response body to the request's fields. it returns
+// false when the body isn't JSON, which is left alone.
+func selectFields(req *Request, response *Response) (pruned interface{}, ok bool) {
+	selection, err := parseFields(req.Fields)
+	if err != nil {
+		return nil, false
+	}
+	// decodeJSON keeps large ids exact, json.Unmarshal would round them
+	body, err := decodeJSON([]byte(response.Data))
+	if err != nil {
+		return nil, false
+	}
+	return selection.prune(body), true
+}
+
+// checkFields parses the fields of every request, dependencies included
+func checkFields(requests []Request) error {
+	for index := range requests {
+		req := &requests[index]
+		if req.Fields != "" {
+			if _, err := parseFields(req.Fields); err != nil {
+				return fmt.Errorf("request %s: %s", req.Id, err)
+			}
+		}
+		for _, dep := range req.Dependents {
+			if err := checkFields([]Request{dep.Request}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
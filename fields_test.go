@@ -0,0 +1,81 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFieldSelection(t *testing.T) {
+	body := `{"user":{"id":1,"name":"ann","email":"ann@example.com"},"orders":[{"id":"a","total":3,"lines":[]},{"id":"b","total":4}],"meta":{"page":1,"next":"x"},"extra":true}`
+	tests := map[string]string{
+		"user{id,name},orders{id,total}": `{"orders":[{"id":"a","total":3},{"id":"b","total":4}],"user":{"id":1,"name":"ann"}}`,
+		"user/name,meta":                 `{"meta":{"next":"x","page":1},"user":{"name":"ann"}}`,
+		"user/id, user/email":            `{"user":{"email":"ann@example.com","id":1}}`,
+		"orders{*}":                      `{"orders":[{"id":"a","lines":[],"total":3},{"id":"b","total":4}]}`,
+		"missing":                        `{}`,
+	}
+	// ids above 2^53 come through exactly
+	if pruned, ok := selectFields(&Request{Fields: "id"}, &Response{Data: `{"id":9007199254740993,"name":"ann"}`}); ok {
+		if got, _ := json.Marshal(pruned); string(got) != `{"id":9007199254740993}` {
+			t.Errorf("expected the id to be exact, got %s", got)
+		}
+	} else {
+		t.Error("expected the body to be pruned")
+	}
+	for fields, expected := range tests {
+		pruned, ok := selectFields(&Request{Fields: fields}, &Response{Data: body})
+		got, _ := json.Marshal(pruned)
+		if !ok || string(got) != expected {
+			t.Errorf("%s: expected %s, got %s", fields, expected, got)
+		}
+	}
+
+	for _, fields := range []string{"", "a{b", "a,,b", "a}", "a/"} {
+		if _, err := parseFields(fields); err == nil {
+			t.Errorf("expected %q to be refused", fields)
+		}
+	}
+
+	if _, ok := selectFields(&Request{Fields: "a"}, &Response{Data: "not json"}); ok {
+		t.Error("expected a body that isn't JSON to be left alone")
+	}
+}
+
+func TestFieldSelectionWorkload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/user":
+			writer.Write([]byte(`{"id":1,"name":"ann","avatar":"big"}`))
+		case "/echo":
+			body, _ := json.Marshal(map[string]string{"got": req.FormValue("x")})
+			writer.Write(body)
+		}
+	}))
+	defer backend.Close()
+
+	magic := &Magic{}
+	result, err := magic.DoMagic(Workload{StrictOrder: true, Requests: []Request{
+		{Id: "user", URL: backend.URL + "/user", Method: "GET", Fields: "id,name"},
+		{Id: "echo", URL: backend.URL + "/echo", Method: "POST", Data: "x=%s", UseData: true, DoJoin: true,
+			Dependents: []Dependency{{Request: Request{Id: "dep", URL: backend.URL + "/user", Method: "GET", Fields: "name"}}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := json.Marshal(result.Responses[0].Object)
+	if string(user) != `{"id":1,"name":"ann"}` || result.Responses[0].Data != "" {
+		t.Errorf("unexpected user response %+v", result.Responses[0])
+	}
+	if result.Responses[1].Data != `{"got":"{\"name\":\"ann\"}"}` {
+		t.Errorf("expected the dependency's pruned data, got %s", result.Responses[1].Data)
+	}
+
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, httptest.NewRequest("POST", "/magic", strings.NewReader(`{"requests":[{"id":"1","url":"http://x","method":"GET","fields":"a{"}]}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected bad fields to be refused, got %d", recorder.Code)
+	}
+}
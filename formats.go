@@ -0,0 +1,384 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Workloads, recipe params and recipe files can be written as JSON or YAML.
+ * YAML is converted to JSON and decoded with the usual json tags, so both map
+ * onto exactly the same structs. YAML is much nicer for recipes: comments,
+ * and multi-line data without escaping quotes.
+ *
+ * HCL works too, for workloads and recipe files. HCL doesn't say if a block
+ * is an object or one element of a list, so it's converted guided by the
+ * struct it's decoded into: repeated requests blocks make a list because
+ * Workload.Requests is a slice, a hedge block makes an object because Hedge
+ * isn't. Heredocs give multi-line data.
+ *
+ * Workloads and params can also be sent as MessagePack or CBOR, which are
+ * converted the same way, and the Accept header picks JSON, MessagePack or
+ * CBOR for the result, for clients that want a compact binary envelope.
+ */
+
+const (
+	mediaJSON    = "application/json"
+	mediaMsgpack = "application/msgpack"
+	mediaCBOR    = "application/cbor"
+)
+
+// binaryFormat says which binary format a Content-Type is, if any
+func binaryFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+		return mediaMsgpack
+	case "application/cbor":
+		return mediaCBOR
+	}
+	return ""
+}
+
+// isYAML says if a Content-Type is one of the YAML media types
+func isYAML(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+	return false
+}
+
+// isHCL says if a Content-Type is HCL
+func isHCL(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/hcl", "application/x-hcl", "text/hcl":
+		return true
+	}
+	return false
+}
+
+// unmarshal decodes body according to its Content-Type, JSON unless it's
+// YAML, HCL, MessagePack or CBOR
+func unmarshal(contentType string, body []byte, v interface{}) (err error) {
+	if isYAML(contentType) {
+		if body, err = yamlToJSON(body); err != nil {
+			return
+		}
+	} else if isHCL(contentType) {
+		if body, err = hclToJSON(body, reflect.TypeOf(v)); err != nil {
+			return
+		}
+	} else if format := binaryFormat(contentType); format != "" {
+		if body, err = binaryToJSON(format, body); err != nil {
+			return
+		}
+	}
+	return json.Unmarshal(body, v)
+}
+
+// binaryToJSON converts a MessagePack or CBOR document to JSON
+func binaryToJSON(format string, data []byte) ([]byte, error) {
+	var (
+		value interface{}
+		err   error
+	)
+	if format == mediaMsgpack {
+		err = msgpack.Unmarshal(data, &value)
+	} else {
+		err = cbor.Unmarshal(data, &value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value, err = jsonCompatible(value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// negotiate picks the media type of the reply from an Accept header: the
+// client's favourite of JSON, MessagePack and CBOR, JSON if it has none
+func negotiate(accept string) string {
+	best, bestQ := mediaJSON, 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		format := binaryFormat(mediaType)
+		if format == "" {
+			switch mediaType {
+			case mediaJSON, "application/*", "*/*":
+				format = mediaJSON
+			default:
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// marshalReply encodes a reply as JSON, MessagePack or CBOR, with the json
+// tags either way
+func marshalReply(mediaType string, v interface{}) ([]byte, error) {
+	switch mediaType {
+	case mediaMsgpack:
+		var buffer bytes.Buffer
+		encoder := msgpack.NewEncoder(&buffer)
+		encoder.SetCustomStructTag("json")
+		err := encoder.Encode(v)
+		return buffer.Bytes(), err
+	case mediaCBOR:
+		return cbor.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// writeReply writes v in the format the Accept header asks for
+func writeReply(writer http.ResponseWriter, accept string, v interface{}) error {
+	mediaType := negotiate(accept)
+	body, err := marshalReply(mediaType, v)
+	if err != nil {
+		return err
+	}
+	writer.Header().Set("Content-Type", mediaType)
+	writer.Header().Add("Vary", "Accept")
+	_, err = writer.Write(body)
+	return err
+}
+
+// yamlToJSON converts a YAML document to JSON
+func yamlToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	value, err := jsonCompatible(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// hclToJSON converts an HCL document to JSON for a value of type target
+func hclToJSON(data []byte, target reflect.Type) ([]byte, error) {
+	file, err := hcl.ParseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, errors.New("HCL document isn't an object")
+	}
+	value, err := hclObject(root, hclType(target))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func hclObject(list *ast.ObjectList, t reflect.Type) (map[string]interface{}, error) {
+	object := make(map[string]interface{})
+	for _, item := range list.Items {
+		if err := hclItem(object, item.Keys, item.Val, t); err != nil {
+			return nil, err
+		}
+	}
+	return object, nil
+}
+
+// hclItem adds an item to object, which is of type t. a "b" { } is short for
+// a { b { } }. an object for a slice field is one more element of it
+func hclItem(object map[string]interface{}, keys []*ast.ObjectKey, node ast.Node, t reflect.Type) (err error) {
+	name, ok := keys[0].Token.Value().(string)
+	if !ok {
+		return fmt.Errorf("line %d: bad key %s", keys[0].Pos().Line, keys[0].Token.Text)
+	}
+	field := hclField(t, name)
+	isList := field != nil && field.Kind() == reflect.Slice
+	objectType := field
+	if isList {
+		objectType = hclType(field.Elem())
+	}
+
+	var value interface{}
+	if len(keys) > 1 {
+		inner := make(map[string]interface{})
+		if err = hclItem(inner, keys[1:], node, objectType); err != nil {
+			return
+		}
+		value = inner
+	} else if _, isObject := node.(*ast.ObjectType); isObject && isList {
+		value, err = hclValue(node, objectType)
+	} else {
+		value, err = hclValue(node, field)
+		isList = false
+	}
+	if err != nil {
+		return
+	}
+
+	existing, exists := object[name]
+	switch {
+	case isList:
+		list, _ := existing.([]interface{})
+		object[name] = append(list, value)
+	case !exists:
+		object[name] = value
+	default:
+		// a "b" { } and a "c" { } fill in the same a
+		into, ok := existing.(map[string]interface{})
+		from, isMap := value.(map[string]interface{})
+		if !ok || !isMap {
+			return fmt.Errorf("line %d: %s is set twice", keys[0].Pos().Line, name)
+		}
+		for key, item := range from {
+			if _, clash := into[key]; clash {
+				return fmt.Errorf("line %d: %s.%s is set twice", keys[0].Pos().Line, name, key)
+			}
+			into[key] = item
+		}
+	}
+	return nil
+}
+
+func hclValue(node ast.Node, t reflect.Type) (interface{}, error) {
+	switch node := node.(type) {
+	case *ast.ObjectType:
+		return hclObject(node.List, t)
+	case *ast.ListType:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = hclType(t.Elem())
+		}
+		list := make([]interface{}, 0, len(node.List))
+		for _, item := range node.List {
+			value, err := hclValue(item, elem)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case *ast.LiteralType:
+		return node.Token.Value(), nil
+	}
+	return nil, fmt.Errorf("line %d: unsupported HCL value", node.Pos().Line)
+}
+
+// hclField is the type of the struct field or map value called name, nil if
+// it isn't known
+func hclField(t reflect.Type, name string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Map {
+		return hclType(t.Elem())
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	for index := 0; index < t.NumField(); index++ {
+		field := t.Field(index)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" || field.PkgPath != "" {
+			continue
+		}
+		if tag == "" && field.Anonymous {
+			if found := hclField(hclType(field.Type), name); found != nil {
+				return found
+			}
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		if strings.EqualFold(tag, name) {
+			return hclType(field.Type)
+		}
+	}
+	return nil
+}
+
+// hclType drops pointers, and forgets types that don't say how to convert,
+// e.g. interface{} and json.RawMessage
+func hclType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() == reflect.Interface || (t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8) {
+		return nil
+	}
+	return t
+}
+
+// yaml allows mapping keys that aren't strings, JSON doesn't
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = converted
+		}
+		return value, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			switch key.(type) {
+			case string, int, int64, uint64, float64, bool:
+			default:
+				return nil, fmt.Errorf("unsupported YAML key %v", key)
+			}
+			item, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			converted[fmt.Sprint(key)] = item
+		}
+		return converted, nil
+	case []interface{}:
+		for index, item := range value {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			value[index] = converted
+		}
+		return value, nil
+	}
+	return value, nil
+}
+
+// DecodeWorkload decodes a workload sent with the given Content-Type.
+func DecodeWorkload(contentType string, body []byte) (work Workload, err error) {
+	err = unmarshal(contentType, body, &work)
+	return
+}
@@ -0,0 +1,247 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const yamlWorkload = `
+# the body goes to /test2 as is, no escaping needed
+requests:
+  - id: "2"
+    url: %s/test2
+    method: POST
+    data: |
+      {"data": "multi
+      line"}
+strictorder: true
+`
+
+func TestHandleYAMLWorkload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(ATest2))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/magic", strings.NewReader(strings.Replace(yamlWorkload, "%s", backend.URL, 1)))
+	req.Header.Set("Content-Type", "application/yaml; charset=utf-8")
+	recorder := httptest.NewRecorder()
+	(&Magic{}).Handle(recorder, req)
+
+	var result Result
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unable to parse %s: %s", recorder.Body, err)
+	}
+	if got := result.Responses[0].Data; got != "{\"data\": \"multi\nline\"}\n" {
+		t.Errorf("unexpected response %q", got)
+	}
+}
+
+func TestLoadYAMLRecipe(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "profile.yaml"), []byte(`
+params:
+  user: {required: true}
+workload:
+  requests:
+    - id: "1"
+      url: http://localhost/users/${user}
+      method: GET
+`), 0600)
+	recipes, err := LoadRecipes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := recipes["profile"].Expand(map[string]interface{}{"user": "a b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.Requests[0].URL != "http://localhost/users/a%20b" {
+		t.Errorf("unexpected url %s", work.Requests[0].URL)
+	}
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	data, err := yamlToJSON([]byte("1: one\nlist: [a, {2: b}]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"1":"one","list":["a",{"2":"b"}]}` {
+		t.Errorf("unexpected JSON %s", data)
+	}
+}
+
+const hclWorkload = `
+# a block per request, data as a heredoc
+strictorder = true
+
+requests {
+  id     = "2"
+  url    = "%s/test2"
+  method = "POST"
+  data   = <<EOF
+{"data": "multi
+line"}
+EOF
+}
+
+requests {
+  id      = "3"
+  url     = "%s/test2"
+  method  = "GET"
+  headers = { Accept = ["application/json"] }
+  hedge { delay = 50 }
+
+  dependency {
+    request = { id = "31", url = "%s/test2", method = "GET" }
+  }
+}
+`
+
+func TestHCLWorkload(t *testing.T) {
+	work, err := DecodeWorkload("application/hcl", []byte(strings.ReplaceAll(hclWorkload, "%s", "http://localhost")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !work.StrictOrder || len(work.Requests) != 2 {
+		t.Fatalf("unexpected workload %+v", work)
+	}
+	if first := work.Requests[0]; first.Id != "2" || first.Data != "{\"data\": \"multi\nline\"}\n" {
+		t.Errorf("unexpected first request %+v", first)
+	}
+	second := work.Requests[1]
+	if second.Hedge == nil || second.Hedge.Delay != 50 || second.Header.Get("Accept") != "application/json" {
+		t.Errorf("unexpected second request %+v", second)
+	}
+	if len(second.Dependents) != 1 || second.Dependents[0].Request.Id != "31" {
+		t.Errorf("unexpected dependencies %+v", second.Dependents)
+	}
+
+	for _, bad := range []string{
+		`strictorder = true
+strictorder = false`,
+		`requests {`,
+	} {
+		if _, err = DecodeWorkload("application/hcl", []byte(bad)); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestLoadHCLRecipe(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "profile.hcl"), []byte(`
+params "user" {
+  required = true
+  pattern  = "^[a-z ]+$"
+}
+params "greeting" {
+  default = "hi"
+}
+
+workload {
+  requests {
+    id     = "1"
+    url    = "http://localhost/users/${user}?greeting=${greeting}"
+    method = "GET"
+  }
+}
+`), 0600)
+	recipes, err := LoadRecipes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := recipes["profile"].Expand(map[string]interface{}{"user": "a b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.Requests[0].URL != "http://localhost/users/a%20b?greeting=hi" {
+		t.Errorf("unexpected url %s", work.Requests[0].URL)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                 "application/json",
+		"*/*":                              "application/json",
+		"text/html":                        "application/json",
+		"application/msgpack":              "application/msgpack",
+		"application/x-msgpack, */*;q=0.1": "application/msgpack",
+		"application/json;q=0.5, application/cbor": "application/cbor",
+		"application/cbor;q=0.2, application/json": "application/json",
+		"application/cbor;q=0":                     "application/json",
+	} {
+		if got := negotiate(accept); got != want {
+			t.Errorf("%q: expected %s, got %s", accept, want, got)
+		}
+	}
+}
+
+func TestBinaryEnvelopes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`{"path":"` + req.URL.Path + `"}`))
+	}))
+	defer backend.Close()
+
+	workload := map[string]interface{}{
+		"requests": []interface{}{
+			map[string]interface{}{"id": "1", "url": backend.URL + "/one", "method": "GET", "query": map[string]interface{}{"n": 1}},
+		},
+		"strictorder": true,
+	}
+	packed, _ := msgpack.Marshal(workload)
+	encoded, _ := cbor.Marshal(workload)
+
+	magic := &Magic{}
+	for _, test := range []struct {
+		name        string
+		handler     http.Handler
+		contentType string
+		body        []byte
+		accept      string
+	}{
+		{"msgpack to cbor", MakeHTTPHandler(magic), "application/msgpack", packed, "application/cbor"},
+		{"cbor to msgpack", http.HandlerFunc(magic.Handle), "application/cbor", encoded, "application/msgpack"},
+		{"msgpack to json", http.HandlerFunc(magic.Handle), "application/x-msgpack", packed, ""},
+	} {
+		req := httptest.NewRequest("POST", "/magic", bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		recorder := httptest.NewRecorder()
+		test.handler.ServeHTTP(recorder, req)
+
+		var result Result
+		var err error
+		switch contentType := recorder.Header().Get("Content-Type"); contentType {
+		case "application/cbor":
+			err = cbor.Unmarshal(recorder.Body.Bytes(), &result)
+		case "application/msgpack":
+			decoder := msgpack.NewDecoder(recorder.Body)
+			decoder.SetCustomStructTag("json")
+			err = decoder.Decode(&result)
+		case "application/json":
+			err = json.Unmarshal(recorder.Body.Bytes(), &result)
+		default:
+			t.Fatalf("%s: unexpected Content-Type %q: %d %s", test.name, contentType, recorder.Code, recorder.Body)
+		}
+		if want := test.accept; want != "" && recorder.Header().Get("Content-Type") != want {
+			t.Errorf("%s: expected %s, got %s", test.name, want, recorder.Header().Get("Content-Type"))
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(result.Responses) != 1 || result.Responses[0].Code != 200 || result.Responses[0].Data != `{"path":"/one"}` {
+			t.Errorf("%s: unexpected result %+v", test.name, result)
+		}
+	}
+}
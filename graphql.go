@@ -0,0 +1,422 @@
+package ensemble
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * The GraphQL front end answers queries against a schema kept on the server
+ * whose fields map onto upstream REST calls. A field's call is a Request
+ * with ${arg} placeholders for the field's arguments and ${parent.key} for
+ * the object it hangs off. Fields without a call are read from their parent.
+ *
+ * Calls are not made one resolver at a time. Every call a level of the query
+ * needs is collected, identical calls are made once, and the level runs as
+ * one workload through process, so it gets the same limits, authorization,
+ * breakers and pool as any other workload.
+ */
+
+// GraphQLSchema maps a GraphQL schema onto upstream calls.
+type GraphQLSchema struct {
+	Query map[string]GraphQLField `json:"query"` // the fields of the Query type
+	Types map[string]GraphQLType  `json:"types"` // object types, by name
+}
+
+// GraphQLType is an object type.
+type GraphQLType struct {
+	Fields map[string]GraphQLField `json:"fields"`
+}
+
+// GraphQLField is a field of the query or an object type.
+type GraphQLField struct {
+	Type string            `json:"type"` // String, Int, Float, Boolean, ID or a type name, as [T] and T! too
+	Args map[string]string `json:"args"` // argument name -> scalar type, e.g. ID!
+	Call *Request          `json:"call"` // the upstream call that resolves the field
+	Path string            `json:"path"` // dotted path into the call's body, or into the parent without a call. defaults to the field name without a call
+}
+
+// LoadGraphQLSchema reads a GraphQLSchema from a JSON or YAML file.
+func LoadGraphQLSchema(path string) (schema *GraphQLSchema, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %s", path, err)
+		}
+	}
+	schema = &GraphQLSchema{}
+	if err = json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", path, err)
+	}
+	return schema, nil
+}
+
+// NewGraphQLHandler serves queries against schema. It takes the query as
+// {"query", "variables", "operationName"} JSON in a POST or as ?query= in a
+// GET.
+func NewGraphQLHandler(magic *Magic, schema *GraphQLSchema) (http.Handler, error) {
+	built, err := schema.build()
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer, done := magic.compress(writer, req)
+		defer done()
+		principal, ok := magic.authenticate(writer, req)
+		if !ok {
+			return
+		}
+		if err := magic.allowClient(principal, req.RemoteAddr); err != nil {
+			limit := err.(*LimitError)
+			writer.Header().Set("Retry-After", retryAfterSeconds(limit.RetryAfter))
+			http.Error(writer, fmt.Sprintf("[ERROR] %s", err), limit.Code)
+			return
+		}
+
+		var query struct {
+			Query         string                 `json:"query"`
+			Variables     map[string]interface{} `json:"variables"`
+			OperationName string                 `json:"operationName"`
+		}
+		if req.Method == "GET" {
+			query.Query = req.URL.Query().Get("query")
+			query.OperationName = req.URL.Query().Get("operationName")
+			if variables := req.URL.Query().Get("variables"); variables != "" {
+				if err := json.Unmarshal([]byte(variables), &query.Variables); err != nil {
+					http.Error(writer, fmt.Sprintf("[ERROR] Unable to parse variables: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+		} else {
+			body, ok := magic.readBody(writer, req)
+			if !ok {
+				return
+			}
+			if err := json.Unmarshal(body, &query); err != nil {
+				http.Error(writer, fmt.Sprintf("[ERROR] Unable to parse query: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		batch := &graphqlBatch{magic: magic, principal: principal, header: req.Header, calls: make(map[string]*graphqlCall)}
+		result := graphql.Do(graphql.Params{
+			Schema:         built,
+			RequestString:  query.Query,
+			VariableValues: query.Variables,
+			OperationName:  query.OperationName,
+			Context:        context.WithValue(req.Context(), graphqlBatchKey{}, batch),
+		})
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(result)
+	}), nil
+}
+
+// build turns the schema into a graphql-go schema
+func (schema *GraphQLSchema) build() (graphql.Schema, error) {
+	if len(schema.Query) == 0 {
+		return graphql.Schema{}, fmt.Errorf("graphql: the schema has no query fields")
+	}
+	if err := schema.check(); err != nil {
+		return graphql.Schema{}, err
+	}
+	objects := make(map[string]*graphql.Object, len(schema.Types))
+	for name, typ := range schema.Types {
+		name, typ := name, typ
+		objects[name] = graphql.NewObject(graphql.ObjectConfig{
+			Name:   name,
+			Fields: graphql.FieldsThunk(func() graphql.Fields { return buildFields(typ.Fields, objects) }),
+		})
+	}
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: buildFields(schema.Query, objects)}),
+	})
+}
+
+// check makes sure every type named exists, so building can't fail halfway
+func (schema *GraphQLSchema) check() error {
+	check := func(owner string, fields map[string]GraphQLField) error {
+		for name, field := range fields {
+			if _, err := graphqlType(field.Type, nil, true); err != nil {
+				if _, ok := schema.Types[baseType(field.Type)]; !ok {
+					return fmt.Errorf("graphql: %s.%s: unknown type %q", owner, name, field.Type)
+				}
+			}
+			for arg, typ := range field.Args {
+				if _, err := graphqlType(typ, nil, false); err != nil {
+					return fmt.Errorf("graphql: %s.%s(%s): %s", owner, name, arg, err)
+				}
+			}
+			if field.Call != nil && field.Call.URL == "" && field.Call.Service == "" {
+				return fmt.Errorf("graphql: %s.%s: the call has no url", owner, name)
+			}
+		}
+		return nil
+	}
+	if err := check("Query", schema.Query); err != nil {
+		return err
+	}
+	for name, typ := range schema.Types {
+		if err := check(name, typ.Fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func baseType(typ string) string {
+	return strings.Trim(typ, "[]! ")
+}
+
+// graphqlType parses String, [T], T! and, when objects isn't nil, type names
+func graphqlType(typ string, objects map[string]*graphql.Object, output bool) (graphql.Type, error) {
+	typ = strings.TrimSpace(typ)
+	if strings.HasSuffix(typ, "!") {
+		inner, err := graphqlType(typ[:len(typ)-1], objects, output)
+		if err != nil {
+			return nil, err
+		}
+		return graphql.NewNonNull(inner), nil
+	}
+	if strings.HasPrefix(typ, "[") && strings.HasSuffix(typ, "]") {
+		inner, err := graphqlType(typ[1:len(typ)-1], objects, output)
+		if err != nil {
+			return nil, err
+		}
+		return graphql.NewList(inner), nil
+	}
+	switch typ {
+	case "String":
+		return graphql.String, nil
+	case "Int":
+		return graphql.Int, nil
+	case "Float":
+		return graphql.Float, nil
+	case "Boolean":
+		return graphql.Boolean, nil
+	case "ID":
+		return graphql.ID, nil
+	}
+	if object, ok := objects[typ]; ok && output {
+		return object, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", typ)
+}
+
+func buildFields(fields map[string]GraphQLField, objects map[string]*graphql.Object) graphql.Fields {
+	built := make(graphql.Fields, len(fields))
+	for name, field := range fields {
+		name, field := name, field
+		typ, _ := graphqlType(field.Type, objects, true) // checked by check
+		args := make(graphql.FieldConfigArgument, len(field.Args))
+		for arg, argType := range field.Args {
+			input, _ := graphqlType(argType, nil, false)
+			args[arg] = &graphql.ArgumentConfig{Type: input}
+		}
+		built[name] = &graphql.Field{
+			Type:    typ.(graphql.Output),
+			Args:    args,
+			Resolve: field.resolver(name),
+		}
+	}
+	return built
+}
+
+func (field GraphQLField) resolver(name string) graphql.FieldResolveFn {
+	if field.Call == nil {
+		path := field.Path
+		if path == "" {
+			path = name
+		}
+		return func(params graphql.ResolveParams) (interface{}, error) {
+			return walkPath(params.Source, path), nil
+		}
+	}
+	return func(params graphql.ResolveParams) (interface{}, error) {
+		batch, ok := params.Context.Value(graphqlBatchKey{}).(*graphqlBatch)
+		if !ok {
+			return nil, fmt.Errorf("graphql: no batch in the context")
+		}
+		values := make(map[string]string)
+		for arg, value := range params.Args {
+			values[arg] = paramString(value)
+		}
+		if parent, ok := params.Source.(map[string]interface{}); ok {
+			for key, value := range parent {
+				switch value.(type) {
+				case map[string]interface{}, []interface{}, nil:
+				default:
+					// json numbers are float64, which %v would print with an exponent
+					values["parent."+key] = paramString(value)
+				}
+			}
+		}
+
+		// expanding writes to the request, so work on a deep copy of the template
+		var req Request
+		template, _ := json.Marshal(field.Call)
+		json.Unmarshal(template, &req)
+		if err := expandRequest(&req, values); err != nil {
+			return nil, err
+		}
+
+		call := batch.add(req)
+		return func() (interface{}, error) {
+			body, err := batch.wait(call)
+			if err != nil {
+				return nil, err
+			}
+			return walkPath(body, field.Path), nil
+		}, nil
+	}
+}
+
+// walkPath follows a dotted path of keys and indexes into a decoded JSON value
+func walkPath(value interface{}, path string) interface{} {
+	if path == "" {
+		return value
+	}
+	for _, step := range strings.Split(path, ".") {
+		switch current := value.(type) {
+		case map[string]interface{}:
+			value = current[step]
+		case []interface{}:
+			index, err := strconv.Atoi(step)
+			if err != nil || index < 0 || index >= len(current) {
+				return nil
+			}
+			value = current[index]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+type graphqlBatchKey struct{}
+
+// graphqlBatch collects the calls of one query, runs the pending ones
+// together and remembers every call so it is made once per query
+type graphqlBatch struct {
+	magic     *Magic
+	principal *Principal
+	header    http.Header
+
+	mutex   sync.Mutex
+	calls   map[string]*graphqlCall
+	pending []*graphqlCall
+}
+
+type graphqlCall struct {
+	req  Request
+	done bool
+	body interface{}
+	err  error
+}
+
+func (batch *graphqlBatch) add(req Request) *graphqlCall {
+	key := graphqlCallKey(&req)
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	if call, ok := batch.calls[key]; ok {
+		return call
+	}
+	call := &graphqlCall{req: req}
+	batch.calls[key] = call
+	batch.pending = append(batch.pending, call)
+	return call
+}
+
+// graphqlCallKey is the same for two requests that make the same call. query,
+// form and header keys are sorted, as json sorts map keys, so it's stable.
+func graphqlCallKey(req *Request) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "%s %s %s\n", strings.ToUpper(req.Method), req.Service, req.URL)
+	fmt.Fprintf(&key, "query %s\nform %s\n", url.Values(req.Query).Encode(), url.Values(req.Form).Encode())
+	if req.JSON != nil {
+		encoded, _ := json.Marshal(req.JSON)
+		fmt.Fprintf(&key, "json %s\n", encoded)
+	}
+	req.Header.Write(&key)
+	key.WriteString("\n" + req.Data)
+	return key.String()
+}
+
+// wait runs the pending calls, if call is one of them, and returns its body
+func (batch *graphqlBatch) wait(call *graphqlCall) (interface{}, error) {
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	if !call.done {
+		batch.flush()
+	}
+	return call.body, call.err
+}
+
+// flush runs the pending calls as one workload. the caller holds the mutex.
+func (batch *graphqlBatch) flush() {
+	pending := batch.pending
+	batch.pending = nil
+
+	workload := Workload{Requests: make([]Request, len(pending))}
+	for index, call := range pending {
+		workload.Requests[index] = call.req
+		workload.Requests[index].Id = strconv.Itoa(index)
+	}
+	workload.SetHeader(batch.header)
+
+	fail := func(err error) {
+		for _, call := range pending {
+			call.done, call.err = true, err
+		}
+	}
+	magic := batch.magic
+	if err := magic.resolve(&workload); err != nil {
+		fail(err)
+		return
+	}
+	if err := magic.Limits.check(&workload); err != nil {
+		fail(err)
+		return
+	}
+	if err := magic.Authorize(batch.principal, &workload); err != nil {
+		fail(fmt.Errorf("Forbidden: %s", err))
+		return
+	}
+
+	var result Result
+	if err := magic.process(workload, &result); err != nil {
+		fail(err)
+		return
+	}
+	log.WithFields(log.Fields{"calls": len(pending)}).Debug("[graphql] ran a batch")
+
+	for index, call := range pending {
+		response := result.Responses[index]
+		call.done = true
+		if response.Code < 200 || response.Code >= 300 {
+			call.err = fmt.Errorf("%s %s answered %d", call.req.Method, call.req.URL, response.Code)
+			if response.Err != "" {
+				call.err = fmt.Errorf("%s %s: %s", call.req.Method, call.req.URL, response.Err)
+			}
+			continue
+		}
+		if response.Object != nil {
+			call.body = response.Object
+		} else if err := json.Unmarshal([]byte(response.Data), &call.body); err != nil {
+			call.body = response.Data
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGraphQL(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		hits  = make(map[string]int)
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		hits[req.URL.Path]++
+		mutex.Unlock()
+		switch req.URL.Path {
+		case "/users/42":
+			writer.Write([]byte(`{"id":"42","name":"ann","team":7}`))
+		case "/users/42/orders":
+			writer.Write([]byte(`{"items":[{"id":"a","total":3.5},{"id":"b","total":4}]}`))
+		case "/teams/7":
+			writer.Write([]byte(`{"name":"mobile"}`))
+		default:
+			http.NotFound(writer, req)
+		}
+	}))
+	defer backend.Close()
+
+	schema := &GraphQLSchema{
+		Query: map[string]GraphQLField{
+			"user": {Type: "User", Args: map[string]string{"id": "ID!"}, Call: &Request{Service: "users", URL: "/users/${id}", Method: "GET"}},
+		},
+		Types: map[string]GraphQLType{
+			"User": {Fields: map[string]GraphQLField{
+				"id":     {Type: "ID!"},
+				"name":   {Type: "String"},
+				"orders": {Type: "[Order]", Call: &Request{Service: "users", URL: "/users/${parent.id}/orders", Method: "GET"}, Path: "items"},
+				"team":   {Type: "String", Call: &Request{Service: "users", URL: "/teams/${parent.team}", Method: "GET"}, Path: "name"},
+			}},
+			"Order": {Fields: map[string]GraphQLField{
+				"id":    {Type: "ID"},
+				"total": {Type: "Float"},
+			}},
+		},
+	}
+	magic := &Magic{Services: map[string]Service{"users": {Name: "users", BaseURL: backend.URL}}}
+	handler, err := NewGraphQLHandler(magic, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := `{"query": "query($id: ID!) { user(id: $id) { name orders { id total } team } again: user(id: \"42\") { id } missing: user(id: \"1\") { id } }", "variables": {"id": "42"}}`
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/graphql", strings.NewReader(query)))
+
+	var result struct {
+		Data   map[string]interface{}   `json:"data"`
+		Errors []map[string]interface{} `json:"errors"`
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(result.Data)
+	expected := `{"again":{"id":"42"},"missing":null,"user":{"name":"ann","orders":[{"id":"a","total":3.5},{"id":"b","total":4}],"team":"mobile"}}`
+	if string(data) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, data)
+	}
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0]["message"].(string), "404") {
+		t.Errorf("expected one error for the missing user, got %v", result.Errors)
+	}
+	// the same user is fetched once however often it's asked for
+	if hits["/users/42"] != 1 || hits["/users/42/orders"] != 1 || hits["/teams/7"] != 1 {
+		t.Errorf("unexpected upstream calls %v", hits)
+	}
+}
+
+func TestGraphQLNumericIds(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/users/1234567":
+			writer.Write([]byte(`{"id":1234567,"team":7654321}`))
+		case "/teams/7654321":
+			writer.Write([]byte(`{"name":"mobile"}`))
+		default:
+			http.NotFound(writer, req)
+		}
+	}))
+	defer backend.Close()
+
+	schema := &GraphQLSchema{
+		Query: map[string]GraphQLField{
+			"user": {Type: "User", Args: map[string]string{"id": "Float!"}, Call: &Request{Service: "users", URL: "/users/${id}", Method: "GET"}},
+		},
+		Types: map[string]GraphQLType{
+			"User": {Fields: map[string]GraphQLField{
+				"team": {Type: "String", Call: &Request{Service: "users", URL: "/teams/${parent.team}", Method: "GET"}, Path: "name"},
+			}},
+		},
+	}
+	handler, err := NewGraphQLHandler(&Magic{Services: map[string]Service{"users": {Name: "users", BaseURL: backend.URL}}}, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ user(id: 1234567) { team } }"}`)))
+	if !strings.Contains(recorder.Body.String(), `{"data":{"user":{"team":"mobile"}}}`) {
+		t.Errorf("unexpected result %s", recorder.Body)
+	}
+}
+
+func TestGraphQLAuthorization(t *testing.T) {
+	schema := &GraphQLSchema{Query: map[string]GraphQLField{
+		"secret": {Type: "String", Call: &Request{URL: "http://secret.example.com/", Method: "GET"}},
+	}}
+	handler, err := NewGraphQLHandler(&Magic{AllowedHosts: []string{"*.internal"}}, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/graphql?query={secret}", nil))
+	if !strings.Contains(recorder.Body.String(), "Forbidden") {
+		t.Errorf("expected the call to be forbidden, got %s", recorder.Body)
+	}
+}
+
+func TestGraphQLSchemaErrors(t *testing.T) {
+	for _, schema := range []*GraphQLSchema{
+		{},
+		{Query: map[string]GraphQLField{"a": {Type: "Nope"}}},
+		{Query: map[string]GraphQLField{"a": {Type: "String", Args: map[string]string{"x": "Nope"}}}},
+		{Query: map[string]GraphQLField{"a": {Type: "String", Call: &Request{Method: "GET"}}}},
+	} {
+		if _, err := NewGraphQLHandler(&Magic{}, schema); err == nil {
+			t.Errorf("expected %+v to be refused", schema)
+		}
+	}
+}
+
+func TestGraphQLCallKey(t *testing.T) {
+	base := Request{Method: "get", URL: "http://api/users",
+		Query:  Params{"a": {"1"}, "b": {"2"}},
+		Header: http.Header{"X-One": {"1"}, "X-Two": {"2"}},
+		JSON:   map[string]interface{}{"x": 1, "y": 2}}
+	same := Request{Method: "GET", URL: "http://api/users",
+		Query:  Params{"b": {"2"}, "a": {"1"}},
+		Header: http.Header{"X-Two": {"2"}, "X-One": {"1"}},
+		JSON:   map[string]interface{}{"y": 2, "x": 1}}
+	if graphqlCallKey(&base) != graphqlCallKey(&same) {
+		t.Error("expected the same call to have the same key")
+	}
+	for name, change := range map[string]func(*Request){
+		"query":  func(req *Request) { req.Query = Params{"a": {"2"}} },
+		"form":   func(req *Request) { req.Form = Params{"a": {"1"}} },
+		"json":   func(req *Request) { req.JSON = map[string]interface{}{"x": 2} },
+		"header": func(req *Request) { req.Header = http.Header{"X-One": {"2"}} },
+	} {
+		other := base
+		change(&other)
+		if graphqlCallKey(&base) == graphqlCallKey(&other) {
+			t.Errorf("expected a different %s to be a different call", name)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package ensemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"github.com/russellsimpkins/ensemble/pb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * The gRPC transport serves MakeMagicEndpoint to callers that want a typed,
+ * binary protocol. The messages in pb/ensemble.proto mirror Workload, Request
+ * and Result. Callers authenticate with metadata that is handed to the
+ * Authenticator as headers, e.g. x-api-key or authorization: Bearer, and is
+ * what use_headers forwards.
+ * Signed requests need the http body and path, so HMAC only works over http.
+ */
+
+type grpcServer struct {
+	pb.UnimplementedEnsembleServer
+	magic   *Magic
+	doMagic grpctransport.Handler
+}
+
+// MakeGRPCServer serves MakeMagicEndpoint over gRPC with go-kit. Register it
+// with pb.RegisterEnsembleServer.
+func MakeGRPCServer(magic *Magic, options ...grpctransport.ServerOption) pb.EnsembleServer {
+	return &grpcServer{
+		magic: magic,
+		doMagic: grpctransport.NewServer(
+			MakeMagicEndpoint(magic),
+			decodeGRPCWorkload,
+			encodeGRPCResult,
+			options...,
+		),
+	}
+}
+
+func (server *grpcServer) DoMagic(ctx context.Context, workload *pb.Workload) (*pb.Result, error) {
+	principal, err := server.authenticate(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("[DoMagic] authentication failed")
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	remote := ""
+	if caller, ok := peer.FromContext(ctx); ok {
+		remote = caller.Addr.String()
+	}
+	ctx = context.WithValue(NewContext(ctx, principal), remoteKey{}, remote)
+
+	_, response, err := server.doMagic.ServeGRPC(ctx, workload)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return response.(*pb.Result), nil
+}
+
+// authenticate hands the incoming metadata to the Authenticator as headers
+func (server *grpcServer) authenticate(ctx context.Context) (*Principal, error) {
+	if server.magic.Authenticator == nil {
+		return nil, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", pb.Ensemble_DoMagic_FullMethodName, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = incomingHeader(ctx)
+	return server.magic.Authenticator.Authenticate(req)
+}
+
+// incomingHeader turns the call's metadata into http headers, leaving out
+// the pseudo headers and gRPC's own
+func incomingHeader(ctx context.Context) http.Header {
+	header := make(http.Header)
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	for name, values := range incoming {
+		if strings.HasPrefix(name, ":") || strings.HasPrefix(name, "grpc-") {
+			continue
+		}
+		header[http.CanonicalHeaderKey(name)] = values
+	}
+	return header
+}
+
+// grpcError maps a StatusError's http status onto a gRPC code
+func grpcError(err error) error {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Unknown
+	switch statusErr.Code {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, statusErr.Error())
+}
+
+// the metadata stands in for the request headers, for use_headers
+func decodeGRPCWorkload(ctx context.Context, request interface{}) (interface{}, error) {
+	message := request.(*pb.Workload)
+	work := Workload{
+		StrictOrder: message.StrictOrder,
+		Timeout:     message.Timeout,
+		UseHeaders:  message.UseHeaders,
+		Compose:     message.Compose,
+		ComposeOnly: message.ComposeOnly,
+		Requests:    make([]Request, len(message.Requests)),
+	}
+	for index, req := range message.Requests {
+		var err error
+		if work.Requests[index], err = requestFromPB(req); err != nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: err}
+		}
+	}
+	work.SetHeader(incomingHeader(ctx))
+	return work, nil
+}
+
+func requestFromPB(message *pb.Request) (Request, error) {
+	req := Request{
+		Id:           message.Id,
+		URL:          message.Url,
+		Service:      message.Service,
+		Method:       message.Method,
+		Data:         message.Data,
+		Header:       headersFromPB(message.Headers),
+		UseData:      message.UseData,
+		UseDepHeader: message.UseDepHeader,
+		DepHeader:    message.DepHeaders,
+		DoJoin:       message.DoJoin,
+		JoinChar:     message.JoinChar,
+		PassByName:   message.PassName,
+		Fields:       message.Fields,
+
+		DataEncoding:     message.DataEncoding,
+		ResponseEncoding: message.ResponseEncoding,
+		Query:            paramsFromPB(message.Query),
+		Form:             paramsFromPB(message.Form),
+	}
+	if len(message.Json) > 0 {
+		if err := json.Unmarshal(message.Json, &req.JSON); err != nil {
+			return req, fmt.Errorf("request %s: json: %s", message.Id, err)
+		}
+	}
+	for _, part := range message.Multipart {
+		req.Multipart = append(req.Multipart, Part{
+			Name:        part.Name,
+			Value:       part.Value,
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			Encoding:    part.Encoding,
+		})
+	}
+	if message.Hedge != nil {
+		req.Hedge = &Hedge{Delay: message.Hedge.Delay, Percentile: message.Hedge.Percentile}
+	}
+	for _, dep := range message.Dependencies {
+		if dep.Request != nil {
+			dependency, err := requestFromPB(dep.Request)
+			if err != nil {
+				return req, err
+			}
+			req.Dependents = append(req.Dependents, Dependency{Request: dependency})
+		}
+	}
+	return req, nil
+}
+
+func encodeGRPCResult(_ context.Context, response interface{}) (interface{}, error) {
+	result := response.(Result)
+	message := &pb.Result{Err: result.Err, Code: int32(result.Code)}
+	if result.Composed != nil {
+		message.Composed, _ = json.Marshal(result.Composed)
+	}
+	for _, res := range result.Responses {
+		out := &pb.Response{
+			Id:       res.Id,
+			Data:     res.Data,
+			Code:     int32(res.Code),
+			Headers:  headersToPB(res.Header),
+			Err:      res.Err,
+			Encoding: res.Encoding,
+		}
+		if res.Object != nil {
+			out.Object, _ = json.Marshal(res.Object)
+		}
+		message.Responses = append(message.Responses, out)
+	}
+	return message, nil
+}
+
+func headersFromPB(headers map[string]*pb.HeaderValues) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	header := make(http.Header, len(headers))
+	for name, values := range headers {
+		header[http.CanonicalHeaderKey(name)] = values.GetValues()
+	}
+	return header
+}
+
+// paramsFromPB is headersFromPB without canonical keys
+func paramsFromPB(values map[string]*pb.HeaderValues) Params {
+	if len(values) == 0 {
+		return nil
+	}
+	params := make(Params, len(values))
+	for name, items := range values {
+		params[name] = items.GetValues()
+	}
+	return params
+}
+
+func headersToPB(header http.Header) map[string]*pb.HeaderValues {
+	if len(header) == 0 {
+		return nil
+	}
+	headers := make(map[string]*pb.HeaderValues, len(header))
+	for name, values := range header {
+		headers[name] = &pb.HeaderValues{Values: values}
+	}
+	return headers
+}
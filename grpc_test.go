@@ -0,0 +1,107 @@
+package ensemble
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/russellsimpkins/ensemble/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func grpcClient(t *testing.T, magic *Magic) pb.EnsembleClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterEnsembleServer(server, MakeGRPCServer(magic))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewEnsembleClient(conn)
+}
+
+func TestGRPCDoMagic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set("X-Path", req.URL.Path)
+		writer.Write([]byte(`{"path":"` + req.URL.Path + `","extra":1}`))
+	}))
+	defer backend.Close()
+
+	client := grpcClient(t, &Magic{})
+	result, err := client.DoMagic(context.Background(), &pb.Workload{
+		StrictOrder: true,
+		Compose:     `{"first": $1.body.path}`,
+		Requests: []*pb.Request{
+			{Id: "1", Url: backend.URL + "/one", Method: "GET"},
+			{Id: "2", Url: backend.URL + "/two", Method: "POST", Data: `{"dep":%s}`, UseData: true, DoJoin: true, Fields: "path",
+				Dependencies: []*pb.Dependency{{Request: &pb.Request{Id: "21", Url: backend.URL + "/dep", Method: "GET", Fields: "path"}}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Responses) != 2 || result.Responses[0].Code != 200 || result.Responses[0].Headers["X-Path"].GetValues()[0] != "/one" {
+		t.Fatalf("unexpected result %v", result)
+	}
+	if string(result.Responses[1].Object) != `{"path":"/two"}` || result.Responses[1].Data != "" {
+		t.Errorf("unexpected second response %v", result.Responses[1])
+	}
+	if string(result.Composed) != `{"first":"/one"}` {
+		t.Errorf("unexpected composed %s", result.Composed)
+	}
+}
+
+func TestGRPCUseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(req.Header.Get("X-Trace-Id")))
+	}))
+	defer backend.Close()
+
+	client := grpcClient(t, &Magic{})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-trace-id", "abc")
+	result, err := client.DoMagic(ctx, &pb.Workload{UseHeaders: true, Requests: []*pb.Request{{Id: "1", Url: backend.URL, Method: "GET"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Responses[0].Data != "abc" {
+		t.Errorf("expected the metadata to be forwarded, got %v", result.Responses[0])
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	magic := &Magic{
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]string{"k1": "mobile"}},
+		AllowedHosts:  []string{"*.internal"},
+	}
+	client := grpcClient(t, magic)
+	workload := &pb.Workload{Requests: []*pb.Request{{Id: "1", Url: "http://example.com/", Method: "GET"}}}
+
+	_, err := client.DoMagic(context.Background(), workload)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "k1")
+	_, err = client.DoMagic(ctx, workload)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	workload.Requests[0].Json = []byte(`{"broken":`)
+	if _, err = client.DoMagic(ctx, workload); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for bad json, got %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+package ensemble
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+/*
+ * A request can call a gRPC method instead of an http endpoint, so workloads
+ * can mix REST and gRPC backends. The url names the method:
+ *
+ *   grpc://users:9000/users.v1.Users/GetUser
+ *
+ * grpcs:// uses TLS. The request's data, or json, is the JSON form of the
+ * request message, it is transcoded to protobuf with the method's descriptor and the
+ * reply is transcoded back to JSON. Descriptors come from the Magic's
+ * Descriptors, see LoadDescriptorSet, or else from the server's reflection
+ * service. grpc+json:// and grpcs+json:// skip the descriptors and send the
+ * data as is to servers that speak the json codec. Headers and service
+ * credentials go out as metadata and the gRPC status is mapped onto an http
+ * code, so limits, breakers, hedging and fields all apply as usual.
+ */
+
+// grpcUpstreams are the connections and reflected methods of gRPC backends
+type grpcUpstreams struct {
+	mutex   sync.Mutex
+	conns   map[string]*grpc.ClientConn              // by scheme and host
+	methods map[string]protoreflect.MethodDescriptor // by host and full method, from reflection
+}
+
+// isGRPC reports whether the url targets a gRPC method
+func isGRPC(raw string) bool {
+	scheme, _, ok := strings.Cut(raw, "://")
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(scheme) {
+	case "grpc", "grpcs", "grpc+json", "grpcs+json":
+		return true
+	}
+	return false
+}
+
+// LoadDescriptorSet reads FileDescriptorSets, as written by
+// protoc --include_imports -o, describing upstream gRPC services.
+func LoadDescriptorSet(paths ...string) (*protoregistry.Files, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var files descriptorpb.FileDescriptorSet
+		if err = proto.Unmarshal(data, &files); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		for _, file := range files.File {
+			if !seen[file.GetName()] {
+				seen[file.GetName()] = true
+				set.File = append(set.File, file)
+			}
+		}
+	}
+	return protodesc.NewFiles(set)
+}
+
+// callGRPC makes the request's gRPC call, filling in the response like
+// MakeRequestContext does
+func (magic *Magic) callGRPC(ctx context.Context, req *Request, response *Response) (err error) {
+	response.Id = req.Id
+	target, err := url.Parse(req.URL)
+	if err != nil {
+		return err
+	}
+	method := strings.TrimPrefix(target.Path, "/")
+	service, name, ok := strings.Cut(method, "/")
+	if !ok || service == "" || name == "" {
+		response.Code = http.StatusBadRequest
+		response.Data = fmt.Sprintf("%s doesn't name a gRPC method, e.g. grpc://host/package.Service/Method", req.URL)
+		return nil
+	}
+	scheme := strings.ToLower(target.Scheme)
+
+	// gRPC calls don't go through the Transport, so a cassette can't replay them
+	if cassette, ok := magic.Transport.(*Cassette); ok && cassette.Mode == CassetteReplay {
+		return fmt.Errorf("%w for %s, gRPC calls aren't recorded", ErrNoInteraction, req.URL)
+	}
+
+	conn, err := magic.upstreams.conn(scheme, target.Host)
+	if err != nil {
+		return err
+	}
+
+	md, err := grpcMetadata(req)
+	if err != nil {
+		log.WithFields(log.Fields{"url": req.URL, "err": err}).Error("[callGRPC] Unable to apply credentials")
+		response.Code = http.StatusInternalServerError
+		return nil
+	}
+	// the same timeout MakeRequest uses
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, md), callTimeout(ctx))
+	defer cancel()
+
+	data := req.Data
+	if req.JSON != nil {
+		encoded, err := json.Marshal(req.JSON)
+		if err != nil {
+			response.Code = http.StatusBadRequest
+			response.Data = fmt.Sprintf("json: %s", err)
+			return nil
+		}
+		data = string(encoded)
+	}
+	if data == "" {
+		data = "{}"
+	}
+	var header metadata.MD
+	var reply []byte
+	if strings.HasSuffix(scheme, "+json") {
+		out := &jsonFrame{}
+		err = conn.Invoke(ctx, "/"+method, &jsonFrame{[]byte(data)}, out, grpc.ForceCodec(jsonCodec{}), grpc.Header(&header))
+		reply = out.data
+	} else {
+		var desc protoreflect.MethodDescriptor
+		if desc, err = magic.methodDescriptor(ctx, conn, target.Host, service, name); err != nil {
+			response.Code = http.StatusBadGateway
+			response.Data = err.Error()
+			return nil
+		}
+		in := dynamicpb.NewMessage(desc.Input())
+		if err = protojson.Unmarshal([]byte(data), in); err != nil {
+			response.Code = http.StatusBadRequest
+			response.Data = fmt.Sprintf("data isn't a %s: %s", desc.Input().FullName(), err)
+			return nil
+		}
+		out := dynamicpb.NewMessage(desc.Output())
+		if err = conn.Invoke(ctx, "/"+method, in, out, grpc.Header(&header)); err == nil {
+			reply, err = protojson.Marshal(out)
+		}
+	}
+
+	if len(header) > 0 {
+		response.Header = make(http.Header, len(header))
+		for key, values := range header {
+			response.Header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	if err != nil {
+		st := status.Convert(err)
+		response.Code = httpStatus(st.Code())
+		response.Data = st.Message()
+		log.WithFields(log.Fields{"url": req.URL, "code": st.Code()}).Debugf("[callGRPC] call failed")
+		return nil
+	}
+	response.Code = http.StatusOK
+	response.Data = string(reply)
+	if req.maxBody > 0 && int64(len(reply)) > req.maxBody {
+		response.Code = http.StatusBadGateway
+		response.Data = fmt.Sprintf("response body exceeds %d bytes", req.maxBody)
+	}
+	return nil
+}
+
+// grpcMetadata is the request's headers and service credentials as metadata
+func grpcMetadata(req *Request) (metadata.MD, error) {
+	header := req.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if req.service != nil && req.service.Credentials != nil {
+		outgoing, err := http.NewRequest("POST", req.URL, http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		outgoing.Header = header
+		if err = req.service.Credentials.Apply(outgoing); err != nil {
+			return nil, err
+		}
+	}
+	md := make(metadata.MD, len(header))
+	for key, values := range header {
+		switch key = strings.ToLower(key); key {
+		case "content-type", "content-length", "connection", "te", "host", "user-agent":
+			// grpc sets these itself
+		default:
+			md[key] = values
+		}
+	}
+	return md, nil
+}
+
+// httpStatus maps a gRPC code onto an http status, the reverse of grpcError
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// conn is a shared connection to the host, made on first use
+func (upstreams *grpcUpstreams) conn(scheme, host string) (*grpc.ClientConn, error) {
+	secure := strings.HasPrefix(scheme, "grpcs")
+	key := "grpc://" + host
+	if secure {
+		key = "grpcs://" + host
+	}
+	upstreams.mutex.Lock()
+	defer upstreams.mutex.Unlock()
+	if conn, ok := upstreams.conns[key]; ok {
+		return conn, nil
+	}
+	creds := insecure.NewCredentials()
+	if secure {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.NewClient(host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	if upstreams.conns == nil {
+		upstreams.conns = make(map[string]*grpc.ClientConn)
+	}
+	upstreams.conns[key] = conn
+	return conn, nil
+}
+
+// close closes every connection, for Shutdown
+func (upstreams *grpcUpstreams) close() {
+	upstreams.mutex.Lock()
+	defer upstreams.mutex.Unlock()
+	for key, conn := range upstreams.conns {
+		conn.Close()
+		delete(upstreams.conns, key)
+	}
+}
+
+// methodDescriptor finds the method in the Magic's Descriptors or asks the
+// server's reflection service, remembering what it was told
+func (magic *Magic) methodDescriptor(ctx context.Context, conn *grpc.ClientConn, host, service, name string) (protoreflect.MethodDescriptor, error) {
+	if magic.Descriptors != nil {
+		if desc, err := magic.Descriptors.FindDescriptorByName(protoreflect.FullName(service)); err == nil {
+			if svc, ok := desc.(protoreflect.ServiceDescriptor); ok {
+				if method := svc.Methods().ByName(protoreflect.Name(name)); method != nil {
+					return method, nil
+				}
+			}
+		}
+	}
+
+	key := host + "/" + service + "/" + name
+	upstreams := &magic.upstreams
+	upstreams.mutex.Lock()
+	method, ok := upstreams.methods[key]
+	upstreams.mutex.Unlock()
+	if ok {
+		return method, nil
+	}
+
+	svc, err := reflectService(ctx, conn, service)
+	if err != nil {
+		return nil, err
+	}
+	if method = svc.Methods().ByName(protoreflect.Name(name)); method == nil {
+		return nil, fmt.Errorf("%s has no method %s", service, name)
+	}
+	upstreams.mutex.Lock()
+	if upstreams.methods == nil {
+		upstreams.methods = make(map[string]protoreflect.MethodDescriptor)
+	}
+	upstreams.methods[key] = method
+	upstreams.mutex.Unlock()
+	return method, nil
+}
+
+// reflectService fetches the file defining the service, and the files it
+// imports, from the server's reflection service
+func reflectService(ctx context.Context, conn *grpc.ClientConn, service string) (protoreflect.ServiceDescriptor, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reflection: %s", err)
+	}
+	defer stream.CloseSend()
+
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	ask := func(req *rpb.ServerReflectionRequest) error {
+		if err := stream.Send(req); err != nil {
+			return fmt.Errorf("reflection: %s", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("reflection: %s", err)
+		}
+		if failed := resp.GetErrorResponse(); failed != nil {
+			return fmt.Errorf("reflection: %s", failed.GetErrorMessage())
+		}
+		for _, data := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(data, file); err != nil {
+				return fmt.Errorf("reflection: %s", err)
+			}
+			files[file.GetName()] = file
+		}
+		return nil
+	}
+	if err = ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service},
+	}); err != nil {
+		return nil, err
+	}
+
+	// servers may leave out imports they've already sent, ask for them
+	set := &descriptorpb.FileDescriptorSet{}
+	added := make(map[string]bool)
+	var add func(name string) error
+	add = func(name string) error {
+		if added[name] {
+			return nil
+		}
+		added[name] = true
+		file, ok := files[name]
+		if !ok {
+			if known, err := protoregistry.GlobalFiles.FindFileByPath(name); err == nil {
+				file = protodesc.ToFileDescriptorProto(known)
+			} else if err = ask(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+			}); err != nil {
+				return err
+			} else if file, ok = files[name]; !ok {
+				return fmt.Errorf("reflection: no file %s", name)
+			}
+		}
+		for _, dep := range file.GetDependency() {
+			if err := add(dep); err != nil {
+				return err
+			}
+		}
+		set.File = append(set.File, file)
+		return nil
+	}
+	for name, file := range files {
+		if !added[name] && hasService(file, service) {
+			if err = add(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	registry, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("reflection: %s", err)
+	}
+	desc, err := registry.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("reflection: %s", err)
+	}
+	svc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("reflection: %s isn't a service", service)
+	}
+	return svc, nil
+}
+
+func hasService(file *descriptorpb.FileDescriptorProto, service string) bool {
+	for _, svc := range file.GetService() {
+		name := svc.GetName()
+		if file.GetPackage() != "" {
+			name = file.GetPackage() + "." + name
+		}
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFrame carries a JSON message through jsonCodec untouched
+type jsonFrame struct{ data []byte }
+
+// jsonCodec is the json content subtype, for gRPC-JSON servers
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	frame, ok := v.(*jsonFrame)
+	if !ok {
+		return nil, fmt.Errorf("json codec: unexpected %T", v)
+	}
+	return frame.data, nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	frame, ok := v.(*jsonFrame)
+	if !ok {
+		return fmt.Errorf("json codec: unexpected %T", v)
+	}
+	frame.data = append([]byte(nil), data...)
+	return nil
+}
@@ -0,0 +1,162 @@
+package ensemble
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/russellsimpkins/ensemble/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// protoJSONCodec lets the test server speak gRPC-JSON
+type protoJSONCodec struct{}
+
+func (protoJSONCodec) Name() string { return "json" }
+
+func (protoJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return protojson.Marshal(v.(proto.Message))
+}
+
+func (protoJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return protojson.Unmarshal(data, v.(proto.Message))
+}
+
+// grpcUpstream serves the ensemble service itself as the gRPC backend, on a
+// real port since requests name it by host
+func grpcUpstream(t *testing.T, magic *Magic, reflect bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterEnsembleServer(server, MakeGRPCServer(magic))
+	if reflect {
+		reflection.Register(server)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func grpcBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(`{"path":"` + req.URL.Path + `"}`))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestGRPCUpstreamReflection(t *testing.T) {
+	backend := grpcBackend(t)
+	addr := grpcUpstream(t, &Magic{Authenticator: &APIKeyAuthenticator{Keys: map[string]string{"sekret": "tester"}}}, true)
+
+	magic := &Magic{Services: map[string]Service{
+		"inner": {Name: "inner", BaseURL: "grpc://" + addr, Credentials: &APIKeyCredential{Key: "sekret"}},
+	}}
+	defer magic.Shutdown(context.Background())
+	data := `{"requests":[{"id":"1","url":"` + backend.URL + `/hello","method":"GET"}]}`
+	workload := Workload{Requests: []Request{
+		{Id: "svc", Service: "inner", URL: "/ensemble.Ensemble/DoMagic", Data: data, Fields: "responses{id,data,code}"},
+		{Id: "anon", URL: "grpc://" + addr + "/ensemble.Ensemble/DoMagic", Data: data},
+		{Id: "rest", URL: backend.URL + "/rest", Method: "GET"},
+		{Id: "nomethod", URL: "grpc://" + addr + "/ensemble.Ensemble/Missing"},
+	}}
+	if err := magic.Validate(&workload); err != nil {
+		t.Fatal(err)
+	}
+	result := runWorkload(t, magic, workload)
+
+	svc := result.Responses[0]
+	if svc.Code != http.StatusOK {
+		t.Fatalf("unexpected response %+v", svc)
+	}
+	got, _ := json.Marshal(svc.Object)
+	if string(got) != `{"responses":[{"code":200,"data":"{\"path\":\"/hello\"}","id":"1"}]}` {
+		t.Errorf("unexpected object %s", got)
+	}
+	if anon := result.Responses[1]; anon.Code != http.StatusUnauthorized || anon.Data != "unauthorized" {
+		t.Errorf("expected the missing key to be unauthenticated, got %+v", anon)
+	}
+	if rest := result.Responses[2]; rest.Code != http.StatusOK || rest.Data != `{"path":"/rest"}` {
+		t.Errorf("unexpected rest response %+v", rest)
+	}
+	if missing := result.Responses[3]; missing.Code != http.StatusBadGateway || !strings.Contains(missing.Data, "no method Missing") {
+		t.Errorf("unexpected missing method response %+v", missing)
+	}
+}
+
+func TestGRPCUpstreamDescriptorSet(t *testing.T) {
+	backend := grpcBackend(t)
+	addr := grpcUpstream(t, &Magic{}, false)
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(pb.File_pb_ensemble_proto)}}
+	data, _ := proto.Marshal(set)
+	path := filepath.Join(t.TempDir(), "ensemble.pb")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := LoadDescriptorSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	magic := &Magic{Descriptors: files}
+	defer magic.Shutdown(context.Background())
+	result := runWorkload(t, magic, Workload{Requests: []Request{
+		{Id: "1", URL: "grpc://" + addr + "/ensemble.Ensemble/DoMagic", Method: "POST",
+			Data: `{"requests":[{"id":"a","url":"` + backend.URL + `/a","method":"GET"}]}`},
+		{Id: "2", URL: "grpc://" + addr + "/ensemble.Ensemble/DoMagic", Data: `{"nope":true}`},
+	}})
+	if response := result.Responses[0]; response.Code != http.StatusOK || !strings.Contains(response.Data, `{\"path\":\"/a\"}`) {
+		t.Errorf("unexpected response %+v", response)
+	}
+	if response := result.Responses[1]; response.Code != http.StatusBadRequest || !strings.Contains(response.Data, "ensemble.Workload") {
+		t.Errorf("expected bad data to be rejected, got %+v", response)
+	}
+}
+
+func TestGRPCUpstreamJSON(t *testing.T) {
+	encoding.RegisterCodec(protoJSONCodec{})
+	backend := grpcBackend(t)
+	addr := grpcUpstream(t, &Magic{}, false)
+
+	magic := &Magic{}
+	defer magic.Shutdown(context.Background())
+	result := runWorkload(t, magic, Workload{Requests: []Request{
+		{Id: "1", URL: "grpc+json://" + addr + "/ensemble.Ensemble/DoMagic",
+			Data: `{"requests":[{"id":"j","url":"` + backend.URL + `/j","method":"GET"}]}`},
+	}})
+	var reply struct {
+		Responses []struct{ Id, Data string }
+	}
+	response := result.Responses[0]
+	if err := json.Unmarshal([]byte(response.Data), &reply); err != nil || response.Code != http.StatusOK {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if len(reply.Responses) != 1 || reply.Responses[0].Data != `{"path":"/j"}` {
+		t.Errorf("unexpected reply %s", response.Data)
+	}
+}
+
+func runWorkload(t *testing.T, magic *Magic, workload Workload) Result {
+	t.Helper()
+	if _, err := magic.admit(nil, "", &workload); err != nil {
+		t.Fatal(err)
+	}
+	var result Result
+	magic.process(workload, &result)
+	return result
+}
@@ -0,0 +1,114 @@
+package ensemble
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Headers reach sub-requests two ways: Workload.UseHeaders copies the inbound
+ * request's headers and Request.UseDepHeader copies the headers of dependency
+ * responses. Both go through a HeaderPolicy so we never blindly forward
+ * cookies, credentials or hop-by-hop headers to a backend.
+ */
+
+// hop-by-hop headers are about a single connection and never forwarded.
+// Content-Length and Host describe the inbound request, not ours.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+	"Host",
+}
+
+// HeaderPolicy decides which headers may be copied into a sub-request.
+// Names are case insensitive and may end in * to match a prefix.
+type HeaderPolicy struct {
+	Forward []string        `json:"forward"` // if set, only these headers are copied
+	Deny    []string        `json:"deny"`    // never copied, checked after Forward
+	Map     []HeaderMapping `json:"map"`     // copied under a new name, even if denied
+}
+
+// HeaderMapping copies header From as header To. Format is a Sprintf format
+// for the value, e.g. "Bearer %s", and defaults to the value as is.
+type HeaderMapping struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Format string `json:"format"`
+}
+
+// DefaultHeaderPolicy is used when neither the Service nor the Magic set one.
+// It keeps the caller's credentials and cookies, including the ones used to
+// authenticate with ensemble itself, away from the backends.
+var DefaultHeaderPolicy = &HeaderPolicy{
+	Deny: []string{"Authorization", "Cookie", "Set-Cookie", "X-API-Key", "X-Ensemble-*"},
+}
+
+// Filter returns the headers of source this policy allows. If only is not
+// empty, it further limits the headers copied, see Request.DepHeader.
+func (policy *HeaderPolicy) Filter(source http.Header, only []string) http.Header {
+	filtered := make(http.Header)
+
+	// Connection can name further hop-by-hop headers
+	var connection []string
+	for _, value := range source["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			connection = append(connection, strings.TrimSpace(name))
+		}
+	}
+
+	for name, values := range source {
+		switch {
+		case matchHeader(hopByHopHeaders, name), matchHeader(connection, name):
+		case len(policy.Forward) > 0 && !matchHeader(policy.Forward, name):
+		case matchHeader(policy.Deny, name):
+		case len(only) > 0 && !matchHeader(only, name):
+		default:
+			filtered[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+
+	for _, mapping := range policy.Map {
+		value := source.Get(mapping.From)
+		if value == "" {
+			continue
+		}
+		if mapping.Format != "" {
+			value = fmt.Sprintf(mapping.Format, value)
+		}
+		filtered.Set(mapping.To, value)
+	}
+	return filtered
+}
+
+func matchHeader(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if len(name) >= len(pattern)-1 && strings.EqualFold(name[:len(pattern)-1], pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the policy for a request: its service's, then the Magic's, then the default
+func (magic *Magic) headerPolicy(req *Request) *HeaderPolicy {
+	if req.service != nil && req.service.HeaderPolicy != nil {
+		return req.service.HeaderPolicy
+	}
+	if magic.HeaderPolicy != nil {
+		return magic.HeaderPolicy
+	}
+	return DefaultHeaderPolicy
+}
@@ -0,0 +1,96 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderPolicyFilter(t *testing.T) {
+	source := http.Header{
+		"Connection":      {"X-Hop"},
+		"X-Hop":           {"1"},
+		"Content-Length":  {"12"},
+		"Cookie":          {"a=b"},
+		"X-Ensemble-Date": {"123"},
+		"X-Trace":         {"abc"},
+		"X-Session":       {"s1"},
+	}
+
+	filtered := DefaultHeaderPolicy.Filter(source, nil)
+	for _, name := range []string{"Connection", "X-Hop", "Content-Length", "Cookie", "X-Ensemble-Date"} {
+		if filtered.Get(name) != "" {
+			t.Errorf("%s should not be forwarded", name)
+		}
+	}
+	if filtered.Get("X-Trace") != "abc" || filtered.Get("X-Session") != "s1" {
+		t.Errorf("expected X-Trace and X-Session to be forwarded, got %v", filtered)
+	}
+
+	policy := &HeaderPolicy{
+		Forward: []string{"X-T*"},
+		Map:     []HeaderMapping{{From: "X-Session", To: "Authorization", Format: "Bearer %s"}},
+	}
+	filtered = policy.Filter(source, nil)
+	if len(filtered) != 2 || filtered.Get("X-Trace") != "abc" || filtered.Get("Authorization") != "Bearer s1" {
+		t.Errorf("unexpected headers %v", filtered)
+	}
+
+	filtered = DefaultHeaderPolicy.Filter(source, []string{"x-session"})
+	if len(filtered) != 1 || filtered.Get("X-Session") != "s1" {
+		t.Errorf("expected DepHeader to limit the headers, got %v", filtered)
+	}
+}
+
+func TestHandleForwardsHeadersByPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/login" {
+			writer.Header().Set("X-Session", "s1")
+			writer.Header().Set("Set-Cookie", "session=s1")
+			return
+		}
+		body, _ := json.Marshal(req.Header)
+		writer.Write(body)
+	}))
+	defer backend.Close()
+
+	magic := &Magic{Services: map[string]Service{"api": {
+		Name:    "api",
+		BaseURL: backend.URL,
+		HeaderPolicy: &HeaderPolicy{
+			Deny: []string{"Cookie", "Set-Cookie"},
+			Map:  []HeaderMapping{{From: "X-Session", To: "Authorization", Format: "Bearer %s"}},
+		},
+	}}}
+
+	workload := `{"requests":[{"id":"1","service":"api","url":"/me","method":"GET","useDepHeader":true,
+		"dependency":[{"request":{"id":"0","service":"api","url":"/login","method":"GET"}}]}],
+		"strictorder":true,"use_headers":true}`
+	req := httptest.NewRequest("POST", "/magic", strings.NewReader(workload))
+	req.Header.Set("Cookie", "secret=1")
+	req.Header.Set("X-Trace", "abc")
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, req)
+
+	var (
+		result Result
+		seen   http.Header
+	)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unable to parse %s: %s", recorder.Body, err)
+	}
+	if err := json.Unmarshal([]byte(result.Responses[0].Data), &seen); err != nil {
+		t.Fatalf("unable to parse %s: %s", result.Responses[0].Data, err)
+	}
+	if seen.Get("Cookie") != "" || seen.Get("Set-Cookie") != "" {
+		t.Errorf("cookies should not be forwarded, got %v", seen)
+	}
+	if seen.Get("X-Trace") != "abc" {
+		t.Errorf("expected X-Trace to be forwarded, got %v", seen)
+	}
+	if seen.Get("Authorization") != "Bearer s1" {
+		t.Errorf("expected the dependency session as a bearer token, got %v", seen)
+	}
+}
@@ -0,0 +1,188 @@
+package ensemble
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * A hedged request fires a second attempt if the first hasn't answered
+ * within a delay, takes whichever answers first and cancels the other. The
+ * delay is fixed or a percentile of the host's recent latency, so only the
+ * slow tail gets hedged. Only idempotent methods are hedged, since the
+ * backend may see both attempts.
+ */
+
+// how many latencies we keep per host for percentiles, and how many we need
+// before trusting them
+const (
+	latencySamples    = 128
+	minLatencySamples = 10
+)
+
+// a host not called for this long loses its latencies
+const latencyTTL = 10 * time.Minute
+
+// Hedge is a request's hedging setting.
+type Hedge struct {
+	Delay      int64   `json:"delay"`      // milliseconds to wait before the second attempt
+	Percentile float64 `json:"percentile"` // or wait for this percentile of the host's latency, e.g. 95
+}
+
+// hedgeDelay says if req should be hedged and after how long
+func (magic *Magic) hedgeDelay(req *Request) (time.Duration, bool) {
+	if req.Hedge == nil {
+		return 0, false
+	}
+	switch strings.ToUpper(req.Method) {
+	case "GET", "PUT", "DELETE":
+	default:
+		return 0, false
+	}
+	if req.Hedge.Percentile > 0 {
+		if delay, ok := magic.latencies.percentile(hostOf(req.URL), req.Hedge.Percentile); ok {
+			return delay, true
+		}
+	}
+	if req.Hedge.Delay > 0 {
+		return time.Duration(req.Hedge.Delay) * time.Millisecond, true
+	}
+	return 0, false
+}
+
+// attempt makes one call and records how long it took
+func (magic *Magic) attempt(ctx context.Context, req *Request, response *Response) error {
+	start := time.Now()
+	var err error
+	if isGRPC(req.URL) {
+		err = magic.callGRPC(ctx, req, response)
+	} else {
+		err = MakeRequestContext(ctx, req, response)
+	}
+	if err == nil {
+		magic.latencies.record(hostOf(req.URL), time.Since(start))
+	}
+	return err
+}
+
+// hedge races a second attempt against the first once delay has passed
+func (magic *Magic) hedge(parent context.Context, req *Request, response *Response, delay time.Duration) (err error) {
+	type outcome struct {
+		response Response
+		err      error
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	outcomes := make(chan outcome, 2)
+
+	launch := func() {
+		// each attempt gets its own headers, MakeRequest writes to them
+		attempt := *req
+		attempt.Header = req.Header.Clone()
+		var res Response
+		err := magic.attempt(ctx, &attempt, &res)
+		outcomes <- outcome{res, err}
+	}
+
+	go launch()
+	launched := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var last outcome
+	for received := 0; received < launched; {
+		select {
+		case <-timer.C:
+			if launched == 1 && received == 0 {
+				go launch()
+				launched++
+			}
+		case last = <-outcomes:
+			received++
+			// the first good answer wins, a failure waits for the other attempt
+			if last.err == nil && last.response.Code > 0 && last.response.Code < 500 {
+				*response = last.response
+				return nil
+			}
+			if launched == 1 {
+				*response = last.response
+				return last.err
+			}
+		}
+	}
+	*response = last.response
+	return last.err
+}
+
+// recent latencies per host
+type latencies struct {
+	mutex sync.Mutex
+	hosts map[string]*samples
+	swept time.Time
+}
+
+type samples struct {
+	values []time.Duration
+	next   int
+	last   time.Time // when the last latency was recorded
+}
+
+func (l *latencies) record(host string, took time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]*samples)
+	}
+	now := time.Now()
+	if now.Sub(l.swept) >= sweepEvery {
+		for h, s := range l.hosts {
+			if now.Sub(s.last) > latencyTTL {
+				delete(l.hosts, h)
+			}
+		}
+		l.swept = now
+	}
+	s, ok := l.hosts[host]
+	if !ok {
+		s = &samples{}
+		l.hosts[host] = s
+	}
+	s.last = now
+	if len(s.values) < latencySamples {
+		s.values = append(s.values, took)
+	} else {
+		s.values[s.next] = took
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+func (l *latencies) percentile(host string, p float64) (time.Duration, bool) {
+	l.mutex.Lock()
+	s, ok := l.hosts[host]
+	if !ok || len(s.values) < minLatencySamples {
+		l.mutex.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), s.values...)
+	l.mutex.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(float64(len(sorted)-1) * p / 100)
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index], true
+}
+
+func hostOf(raw string) string {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return target.Host
+}
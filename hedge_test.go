@@ -0,0 +1,83 @@
+package ensemble
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgedRequest(t *testing.T) {
+	var calls, cancelled int32
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		call := atomic.AddInt32(&calls, 1)
+		if call == 1 {
+			// the first attempt hangs until ensemble gives up on it
+			select {
+			case <-req.Context().Done():
+				atomic.AddInt32(&cancelled, 1)
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		fmt.Fprintf(writer, "attempt %d", call)
+	}))
+	defer backend.Close()
+
+	magic := &Magic{}
+	start := time.Now()
+	result, _ := magic.DoMagic(Workload{StrictOrder: true, Requests: []Request{
+		{Id: "1", URL: backend.URL, Method: "GET", Hedge: &Hedge{Delay: 20}},
+	}})
+
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("the hedge should have answered quickly, took %s", took)
+	}
+	if response := result.Responses[0]; response.Data != "attempt 2" || response.Id != "1" {
+		t.Errorf("expected the second attempt to win, got %#v", response)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Error("expected the slow attempt to be cancelled")
+	}
+}
+
+func TestHedgeOnlyIdempotent(t *testing.T) {
+	magic := &Magic{}
+	if _, ok := magic.hedgeDelay(&Request{Method: "POST", Hedge: &Hedge{Delay: 10}}); ok {
+		t.Error("a POST must not be hedged")
+	}
+	if delay, ok := magic.hedgeDelay(&Request{Method: "get", Hedge: &Hedge{Delay: 10}}); !ok || delay != 10*time.Millisecond {
+		t.Errorf("expected a 10ms hedge, got %s %v", delay, ok)
+	}
+}
+
+func TestHedgePercentile(t *testing.T) {
+	magic := &Magic{}
+	req := &Request{URL: "http://backend/x", Method: "GET", Hedge: &Hedge{Percentile: 90, Delay: 7}}
+
+	// not enough samples yet, so the fixed delay is used
+	if delay, _ := magic.hedgeDelay(req); delay != 7*time.Millisecond {
+		t.Errorf("expected the fixed delay, got %s", delay)
+	}
+	for i := 1; i <= 100; i++ {
+		magic.latencies.record("backend", time.Duration(i)*time.Millisecond)
+	}
+	if delay, _ := magic.hedgeDelay(req); delay != 90*time.Millisecond {
+		t.Errorf("expected the 90th percentile, got %s", delay)
+	}
+}
+
+func TestLatenciesSweep(t *testing.T) {
+	var l latencies
+	l.record("stale", time.Millisecond)
+	l.record("fresh", time.Millisecond)
+	l.hosts["stale"].last = time.Now().Add(-latencyTTL - time.Second)
+	l.swept = time.Now().Add(-sweepEvery)
+	l.record("fresh", time.Millisecond)
+	if _, found := l.hosts["stale"]; found || len(l.hosts) != 1 {
+		t.Errorf("expected the stale host to be swept, have %v", l.hosts)
+	}
+}
@@ -0,0 +1,301 @@
+package ensemble
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Some workloads, bulk updates and long exports, take longer than any sane
+ * http timeout. A workload with "async": true is answered straight away with
+ * a 202 and a job id, runs in the background and its Result is kept as a Job
+ * that the client polls at /jobs/{id}, or is posted to the workload's
+ * callback url when done.
+ */
+
+// job states
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// how long finished jobs are kept and may run by default, and how hard we
+// try a callback
+const (
+	defaultJobTTL     = time.Hour
+	defaultJobTimeout = time.Hour
+	callbackAttempts  = 3
+	callbackTimeout   = 30 * time.Second
+	callbackBaseDelay = time.Second
+)
+
+// ErrJobNotFound is returned by a JobStore for unknown or expired jobs.
+var ErrJobNotFound = errors.New("job not found")
+
+// Job is an async workload and, once it has run, its Result.
+type Job struct {
+	Id        string    `json:"id"`
+	Status    string    `json:"status"` // pending, running, done or failed
+	Owner     string    `json:"owner,omitempty"`
+	Callback  string    `json:"callback,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	Finished  time.Time `json:"finished"`
+	Result    *Result   `json:"result,omitempty"`
+	Err       string    `json:"err,omitempty"`
+}
+
+// JobStore keeps jobs so any instance can answer a poll. Save is called
+// each time a job changes state.
+type JobStore interface {
+	Save(job *Job) error
+	Load(id string) (*Job, error) // ErrJobNotFound if there is no such job
+}
+
+// MemoryJobStore is the default JobStore. Finished jobs are forgotten after
+// the TTL, an hour if unset.
+type MemoryJobStore struct {
+	TTL time.Duration
+
+	mutex    sync.Mutex
+	jobs     map[string]*Job
+	finished finishedJobs // finished jobs, the oldest first
+}
+
+func (store *MemoryJobStore) Save(job *Job) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.jobs == nil {
+		store.jobs = make(map[string]*Job)
+	}
+	ttl := store.TTL
+	if ttl <= 0 {
+		ttl = defaultJobTTL
+	}
+	for len(store.finished) > 0 && time.Since(store.finished[0].at) > ttl {
+		expired := heap.Pop(&store.finished).(finishedJob)
+		// a job saved again since has its own entry
+		if old, ok := store.jobs[expired.id]; ok && old.Finished.Equal(expired.at) {
+			delete(store.jobs, expired.id)
+		}
+	}
+	saved := *job
+	if old, ok := store.jobs[job.Id]; !job.Finished.IsZero() && (!ok || !old.Finished.Equal(job.Finished)) {
+		heap.Push(&store.finished, finishedJob{id: job.Id, at: job.Finished})
+	}
+	store.jobs[job.Id] = &saved
+	return nil
+}
+
+// finishedJobs is a heap of finished jobs by when they finished, so expiring
+// them doesn't mean looking at every job
+type finishedJobs []finishedJob
+
+type finishedJob struct {
+	id string
+	at time.Time
+}
+
+func (jobs finishedJobs) Len() int            { return len(jobs) }
+func (jobs finishedJobs) Less(i, j int) bool  { return jobs[i].at.Before(jobs[j].at) }
+func (jobs finishedJobs) Swap(i, j int)       { jobs[i], jobs[j] = jobs[j], jobs[i] }
+func (jobs *finishedJobs) Push(x interface{}) { *jobs = append(*jobs, x.(finishedJob)) }
+func (jobs *finishedJobs) Pop() interface{} {
+	old := *jobs
+	last := old[len(old)-1]
+	*jobs = old[:len(old)-1]
+	return last
+}
+
+func (store *MemoryJobStore) Load(id string) (*Job, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	loaded := *job
+	return &loaded, nil
+}
+
+func (magic *Magic) jobStore() JobStore {
+	if magic.Jobs != nil {
+		return magic.Jobs
+	}
+	return &magic.memoryJobs
+}
+
+// Submit runs the workload in the background and returns its pending Job.
+// The workload should already have been admitted, as Handle does.
+func (magic *Magic) Submit(principal *Principal, workload Workload) (job *Job, err error) {
+	if err = magic.resolve(&workload); err != nil {
+		return
+	}
+	job = &Job{Status: JobPending, Callback: workload.Callback, Submitted: time.Now()}
+	if job.Id, err = newJobId(); err != nil {
+		return nil, err
+	}
+	if principal != nil {
+		job.Owner = principal.Name
+	}
+	// the job, callback included, is tracked so Shutdown waits for it
+	ctx, end, err := magic.begin(&workload)
+	if err != nil {
+		return nil, err
+	}
+	store := magic.jobStore()
+	if err = store.Save(job); err != nil {
+		end()
+		return nil, err
+	}
+
+	running := *job
+	go magic.runJob(ctx, end, store, &running, workload)
+	return job, nil
+}
+
+func (magic *Magic) runJob(ctx context.Context, end func(), store JobStore, job *Job, workload Workload) {
+	defer end()
+	job.Status = JobRunning
+	magic.saveJob(store, job)
+
+	// a job runs past the http timeouts, until its own deadline, and so may
+	// each of its calls
+	timeout := magic.JobTimeout
+	if workload.Timeout > 0 {
+		timeout = time.Duration(workload.Timeout)
+	} else if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+	jobCtx, cancel := context.WithTimeout(context.WithValue(ctx, callTimeoutKey{}, timeout), timeout)
+	defer cancel()
+
+	var result Result
+	if err := magic.run(jobCtx, workload, &result); err != nil {
+		job.Status, job.Err = JobFailed, err.Error()
+	} else {
+		job.Status, job.Result = JobDone, &result
+	}
+	job.Finished = time.Now()
+	magic.saveJob(store, job)
+
+	if job.Callback != "" {
+		deliver(ctx, job)
+	}
+}
+
+type callTimeoutKey struct{}
+
+// callTimeout is how long one upstream call may take, a second unless it's
+// part of a job
+func callTimeout(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(callTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return time.Second
+}
+
+func (magic *Magic) saveJob(store JobStore, job *Job) {
+	if err := store.Save(job); err != nil {
+		log.WithFields(log.Fields{"job": job.Id, "err": err}).Error("[Submit] unable to save job")
+	}
+}
+
+// deliver posts the finished job to its callback, retrying failures with
+// backoff until ctx is done
+func deliver(ctx context.Context, job *Job) {
+	body, _ := json.Marshal(job)
+	client := &http.Client{Timeout: callbackTimeout}
+	delay := callbackBaseDelay
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", job.Callback, bytes.NewReader(body))
+		if err != nil {
+			log.WithFields(log.Fields{"job": job.Id, "err": err}).Error("[Submit] bad callback url")
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Ensemble-Job", job.Id)
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode < 300 {
+				return
+			}
+			err = errors.New(res.Status)
+		}
+		if attempt == callbackAttempts {
+			log.WithFields(log.Fields{"job": job.Id, "callback": job.Callback, "err": err}).Error("[Submit] giving up on the callback")
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"job": job.Id, "callback": job.Callback}).Error("[Submit] shutting down before the callback was delivered")
+			return
+		}
+		delay *= 2
+	}
+}
+
+func newJobId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// HandleJob answers GET /jobs/{id} with the job. A job is only shown to the
+// principal that submitted it.
+func (magic *Magic) HandleJob(writer http.ResponseWriter, req *http.Request) {
+	writer, done := magic.compress(writer, req)
+	defer done()
+	if req.Method != "GET" {
+		http.Error(writer, "[ERROR] jobs are fetched with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	principal, ok := magic.authenticate(writer, req)
+	if !ok {
+		return
+	}
+	job, err := magic.jobStore().Load(path.Base(req.URL.Path))
+	if err == nil && principal != nil && job.Owner != principal.Name {
+		err = ErrJobNotFound
+	}
+	if err == ErrJobNotFound {
+		http.Error(writer, "[ERROR] no such job", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(writer, "[ERROR] "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeReply(writer, req.Header.Get("Accept"), job)
+}
+
+// writeJob answers a submitted workload with 202 and where to poll, in the
+// format the Accept header asks for
+func writeJob(writer http.ResponseWriter, accept string, job *Job) {
+	mediaType := negotiate(accept)
+	body, err := marshalReply(mediaType, job)
+	if err != nil {
+		http.Error(writer, "[ERROR] "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", mediaType)
+	writer.Header().Add("Vary", "Accept")
+	writer.Header().Set("Location", "/jobs/"+job.Id)
+	writer.WriteHeader(http.StatusAccepted)
+	writer.Write(body)
+}
@@ -0,0 +1,238 @@
+package ensemble
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// polls the job until it has finished
+func waitForJob(t *testing.T, handler http.HandlerFunc, location string, header http.Header) (job Job) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		req := httptest.NewRequest("GET", location, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("polling %s got %d %s", location, recorder.Code, recorder.Body)
+		}
+		job = Job{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == JobDone || job.Status == JobFailed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s never finished", location)
+	return
+}
+
+func TestAsyncJob(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(`{"exported":true}`))
+	}))
+	defer backend.Close()
+
+	magic := &Magic{}
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, httptest.NewRequest("POST", "/magic", strings.NewReader(
+		`{"async":true,"requests":[{"id":"export","url":"`+backend.URL+`","method":"GET"}]}`)))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d %s", recorder.Code, recorder.Body)
+	}
+	location := recorder.Header().Get("Location")
+	if !strings.HasPrefix(location, "/jobs/") {
+		t.Fatalf("expected a job location, got %q", location)
+	}
+
+	job := waitForJob(t, magic.HandleJob, location, nil)
+	if job.Status != JobDone || job.Result == nil || job.Result.Responses[0].Data != `{"exported":true}` {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if job.Finished.Before(job.Submitted) {
+		t.Errorf("finished %s before it was submitted %s", job.Finished, job.Submitted)
+	}
+
+	recorder = httptest.NewRecorder()
+	magic.HandleJob(recorder, httptest.NewRequest("GET", "/jobs/nope", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", recorder.Code)
+	}
+}
+
+func TestAsyncJobOutlivesTimeouts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits longer than DefaultTimeout")
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		time.Sleep(DefaultTimeout + 500*time.Millisecond)
+		writer.Write([]byte("slow"))
+	}))
+	defer backend.Close()
+
+	magic := &Magic{}
+	job, err := magic.Submit(nil, Workload{Async: true, Requests: []Request{{Id: "export", URL: backend.URL, Method: "GET"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(DefaultTimeout + 5*time.Second)
+	for time.Now().Before(deadline) {
+		if saved, _ := magic.jobStore().Load(job.Id); saved.Status == JobDone {
+			if response := saved.Result.Responses[0]; response.Code != 200 || response.Data != "slow" {
+				t.Errorf("expected the slow call to finish, got %+v", response)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("the job never finished")
+}
+
+func TestAsyncJobAccept(t *testing.T) {
+	magic := &Magic{}
+	req := httptest.NewRequest("POST", "/magic", strings.NewReader(`{"async":true,"requests":[]}`))
+	req.Header.Set("Accept", "application/msgpack")
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, req)
+	if recorder.Code != http.StatusAccepted || recorder.Header().Get("Content-Type") != "application/msgpack" {
+		t.Fatalf("expected a msgpack 202, got %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	var job Job
+	decoder := msgpack.NewDecoder(recorder.Body)
+	decoder.SetCustomStructTag("json")
+	if err := decoder.Decode(&job); err != nil || job.Id == "" {
+		t.Fatalf("unexpected job %+v %v", job, err)
+	}
+
+	req = httptest.NewRequest("GET", recorder.Header().Get("Location"), nil)
+	req.Header.Set("Accept", "application/cbor")
+	recorder = httptest.NewRecorder()
+	magic.HandleJob(recorder, req)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/cbor" {
+		t.Errorf("expected the job as cbor, got %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestAsyncJobCallback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	delivered := make(chan Job, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		var job Job
+		json.NewDecoder(req.Body).Decode(&job)
+		if req.Header.Get("X-Ensemble-Job") != job.Id {
+			t.Errorf("X-Ensemble-Job %q doesn't match %q", req.Header.Get("X-Ensemble-Job"), job.Id)
+		}
+		delivered <- job
+	}))
+	defer callback.Close()
+
+	magic := &Magic{}
+	job, err := magic.Submit(nil, Workload{Async: true, Callback: callback.URL,
+		Requests: []Request{{Id: "one", URL: backend.URL, Method: "GET"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-delivered:
+		if got.Id != job.Id || got.Status != JobDone || got.Result.Responses[0].Data != "ok" {
+			t.Errorf("unexpected callback %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the callback was never called")
+	}
+}
+
+func TestShutdownWaitsForCallback(t *testing.T) {
+	delivered := make(chan string, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		delivered <- req.Header.Get("X-Ensemble-Job")
+	}))
+	defer callback.Close()
+
+	magic := &Magic{}
+	job, err := magic.Submit(nil, Workload{Async: true, Callback: callback.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if abandoned, err := magic.Shutdown(ctx); err != nil || len(abandoned) != 0 {
+		t.Fatalf("expected a clean drain, got %v %v", abandoned, err)
+	}
+	select {
+	case id := <-delivered:
+		if id != job.Id {
+			t.Errorf("expected job %s, got %s", job.Id, id)
+		}
+	default:
+		t.Error("Shutdown returned before the callback was delivered")
+	}
+	if _, err = magic.Submit(nil, Workload{Async: true}); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestAsyncJobOwner(t *testing.T) {
+	magic := &Magic{Authenticator: &APIKeyAuthenticator{Keys: map[string]string{"k1": "alice", "k2": "bob"}}}
+	job, err := magic.Submit(&Principal{Name: "alice"}, Workload{Async: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForJob(t, magic.HandleJob, "/jobs/"+job.Id, http.Header{"X-Api-Key": {"k1"}})
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/jobs/"+job.Id, nil)
+	req.Header.Set("X-API-Key", "k2")
+	magic.HandleJob(recorder, req)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected someone else's job to be hidden, got %d", recorder.Code)
+	}
+}
+
+func TestAsyncCallbackAllowedHosts(t *testing.T) {
+	magic := &Magic{AllowedHosts: []string{"*.internal"}}
+	workload := &Workload{Async: true, Callback: "http://evil.example.com/hook"}
+	if code, err := magic.admit(nil, "", workload); code != http.StatusForbidden {
+		t.Errorf("expected the callback to be refused, got %d %v", code, err)
+	}
+}
+
+func TestMemoryJobStoreExpiry(t *testing.T) {
+	store := &MemoryJobStore{TTL: time.Minute}
+	store.Save(&Job{Id: "old", Status: JobDone, Finished: time.Now().Add(-time.Hour)})
+	store.Save(&Job{Id: "new", Status: JobPending})
+	if _, err := store.Load("old"); err != ErrJobNotFound {
+		t.Errorf("expected the old job to have expired, got %v", err)
+	}
+	if job, err := store.Load("new"); err != nil || job.Status != JobPending {
+		t.Errorf("expected the new job, got %+v %v", job, err)
+	}
+
+	// a job finished again is kept for the TTL from then
+	store.Save(&Job{Id: "again", Status: JobDone, Finished: time.Now().Add(-time.Hour)})
+	store.Save(&Job{Id: "again", Status: JobDone, Finished: time.Now()})
+	store.Save(&Job{Id: "other", Status: JobPending})
+	if _, err := store.Load("again"); err != nil {
+		t.Errorf("expected the job finished again to be kept, got %v", err)
+	}
+	if len(store.finished) != 1 {
+		t.Errorf("expected only the live finish to be indexed, got %+v", store.finished)
+	}
+}
@@ -0,0 +1,134 @@
+package ensemble
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Every workload a Magic runs is tracked from the moment it starts processing
+ * until its Result is ready, so Shutdown knows what is still in flight and
+ * can cancel it if it won't finish in time.
+ */
+
+// ErrShuttingDown is returned for workloads that arrive after Shutdown.
+var ErrShuttingDown = errors.New("ensemble is shutting down")
+
+// how long Shutdown waits for cancelled workloads and their calls to exit
+// before it closes the worker pool and upstream connections anyway
+const settleTimeout = 5 * time.Second
+
+// Abandoned describes a workload Shutdown cancelled.
+type Abandoned struct {
+	Started  time.Time `json:"started"`
+	Requests []string  `json:"requests"` // the ids of its top level requests
+}
+
+type lifecycle struct {
+	mutex   sync.Mutex
+	closing bool
+	running map[*inflight]struct{}
+	drained chan struct{}  // closed once nothing is running after Shutdown
+	calls   sync.WaitGroup // async requests still running, even ones their workload gave up on
+}
+
+type inflight struct {
+	started  time.Time
+	requests []string
+	cancel   context.CancelFunc
+}
+
+// begin registers a workload. call end once its Result is ready.
+func (magic *Magic) begin(workload *Workload) (ctx context.Context, end func(), err error) {
+	life := &magic.life
+	life.mutex.Lock()
+	defer life.mutex.Unlock()
+
+	if life.closing {
+		return nil, nil, ErrShuttingDown
+	}
+	if life.running == nil {
+		life.running = make(map[*inflight]struct{})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	work := &inflight{started: time.Now(), cancel: cancel}
+	for _, req := range workload.Requests {
+		work.requests = append(work.requests, req.Id)
+	}
+	life.running[work] = struct{}{}
+
+	end = func() {
+		cancel()
+		life.mutex.Lock()
+		defer life.mutex.Unlock()
+		if _, ok := life.running[work]; !ok {
+			return
+		}
+		delete(life.running, work)
+		if life.closing && len(life.running) == 0 {
+			close(life.drained)
+		}
+	}
+	return ctx, end, nil
+}
+
+// Shutdown stops the Magic accepting workloads and waits for the running ones
+// to finish. If ctx is done first, the rest are cancelled and returned along
+// with ctx's error. A Magic can't be used again after Shutdown.
+func (magic *Magic) Shutdown(ctx context.Context) (abandoned []Abandoned, err error) {
+	life := &magic.life
+	life.mutex.Lock()
+	if !life.closing {
+		life.closing = true
+		life.drained = make(chan struct{})
+		if len(life.running) == 0 {
+			close(life.drained)
+		}
+	}
+	drained := life.drained
+	life.mutex.Unlock()
+
+	select {
+	case <-drained:
+		magic.settle()
+		return nil, nil
+	case <-ctx.Done():
+	}
+
+	// the abandoned workloads stay registered, so drained is closed once the
+	// last of them has ended
+	life.mutex.Lock()
+	for work := range life.running {
+		work.cancel()
+		abandoned = append(abandoned, Abandoned{Started: work.started, Requests: work.requests})
+	}
+	life.mutex.Unlock()
+	magic.settle()
+
+	log.WithFields(log.Fields{"abandoned": len(abandoned)}).Warn("[Shutdown] cancelled workloads still running at the deadline")
+	return abandoned, ctx.Err()
+}
+
+// settle waits for the running workloads to end and for the calls they left
+// behind to return, then stops the worker pool and closes the upstream
+// connections. it gives up waiting after settleTimeout.
+func (magic *Magic) settle() {
+	settled := make(chan struct{})
+	go func() {
+		<-magic.life.drained
+		magic.life.calls.Wait()
+		close(settled)
+	}()
+	select {
+	case <-settled:
+	case <-time.After(settleTimeout):
+		log.Warn("[Shutdown] gave up waiting for cancelled calls to return")
+	}
+	magic.workers.stop()
+	magic.upstreams.close()
+}
@@ -0,0 +1,99 @@
+package ensemble
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		writer.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	magic := &Magic{Concurrency: 2}
+	results := make(chan Result)
+	go func() {
+		result, _ := magic.DoMagic(Workload{Requests: []Request{{Id: "slow", URL: backend.URL, Method: "GET"}}})
+		results <- result
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	abandoned, err := magic.Shutdown(ctx)
+	if err != nil || len(abandoned) != 0 {
+		t.Fatalf("expected a clean drain, got %v %v", abandoned, err)
+	}
+	if result := <-results; result.Responses[0].Data != "done" {
+		t.Errorf("expected the in-flight workload to finish, got %#v", result)
+	}
+
+	// nothing new is accepted
+	if _, err = magic.DoMagic(Workload{}); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, httptest.NewRequest("POST", "/magic", strings.NewReader(`{"requests":[]}`)))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", recorder.Code)
+	}
+}
+
+func TestShutdownAbandons(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer backend.Close()
+
+	magic := &Magic{}
+	results := make(chan Result)
+	go func() {
+		result, _ := magic.DoMagic(Workload{StrictOrder: true, Requests: []Request{{Id: "stuck", URL: backend.URL, Method: "GET"}}})
+		results <- result
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	abandoned, err := magic.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to pass, got %v", err)
+	}
+	if len(abandoned) != 1 || abandoned[0].Requests[0] != "stuck" {
+		t.Errorf("expected the stuck workload to be abandoned, got %+v", abandoned)
+	}
+	select {
+	case result := <-results:
+		if !strings.Contains(result.Responses[0].Data, "context canceled") {
+			t.Errorf("expected the call to be cancelled, got %#v", result.Responses[0])
+		}
+	case <-time.After(time.Second):
+		t.Error("the abandoned workload was not cancelled")
+	}
+}
+
+func TestShutdownWaitsForAbandonedCalls(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer backend.Close()
+
+	magic := &Magic{Concurrency: 2}
+	go magic.DoMagic(Workload{Requests: []Request{{Id: "stuck", URL: backend.URL, Method: "GET"}}})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if abandoned, _ := magic.Shutdown(ctx); len(abandoned) != 1 {
+		t.Fatalf("expected the stuck workload to be abandoned, got %+v", abandoned)
+	}
+	if stats := magic.PoolStats(); stats.Busy != 0 {
+		t.Errorf("expected the abandoned call to have returned, got %+v", stats)
+	}
+}
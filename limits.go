@@ -0,0 +1,184 @@
+package ensemble
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * A workload is attacker controlled: it can contain any number of requests,
+ * each with any number of dependencies. Limits puts a ceiling on how much
+ * work one workload can ask for and how often a client or host gets called.
+ * Zero values mean unlimited.
+ */
+
+// Limits are the quotas enforced by a Magic.
+type Limits struct {
+	MaxRequests      int       `json:"max_requests"`       // top level requests per workload
+	MaxDepth         int       `json:"max_depth"`          // how deep dependencies may nest
+	MaxCalls         int       `json:"max_calls"`          // upstream calls per workload, dependencies included
+	MaxRequestBytes  int64     `json:"max_request_bytes"`  // size of the workload body
+	MaxResponseBytes int64     `json:"max_response_bytes"` // size of each upstream response body
+	PerClient        RateLimit `json:"per_client"`         // workloads per principal, or remote address without auth
+	PerHost          RateLimit `json:"per_host"`           // upstream calls per host
+}
+
+// RateLimit is a token bucket refilled at Rate tokens a second, holding at
+// most Burst tokens. Burst defaults to Rate, rounded up.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// LimitError is returned when a workload exceeds a limit. Code is the http
+// status to answer with and RetryAfter, if set, goes in the Retry-After header.
+type LimitError struct {
+	Code       int
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (err *LimitError) Error() string {
+	return err.Reason
+}
+
+// check enforces the workload quotas, call it after resolve
+func (limits *Limits) check(workload *Workload) error {
+	if limits.MaxRequests > 0 && len(workload.Requests) > limits.MaxRequests {
+		return &LimitError{
+			Code:   http.StatusRequestEntityTooLarge,
+			Reason: fmt.Sprintf("workload has %d requests, the limit is %d", len(workload.Requests), limits.MaxRequests),
+		}
+	}
+	calls := 0
+	for index := range workload.Requests {
+		depth, count := measure(&workload.Requests[index])
+		calls += count
+		if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+			return &LimitError{
+				Code:   http.StatusRequestEntityTooLarge,
+				Reason: fmt.Sprintf("request %s nests dependencies %d deep, the limit is %d", workload.Requests[index].Id, depth, limits.MaxDepth),
+			}
+		}
+	}
+	if limits.MaxCalls > 0 && calls > limits.MaxCalls {
+		return &LimitError{
+			Code:   http.StatusRequestEntityTooLarge,
+			Reason: fmt.Sprintf("workload makes %d upstream calls, the limit is %d", calls, limits.MaxCalls),
+		}
+	}
+	return nil
+}
+
+// measure returns how deep the dependencies of req go and how many calls it makes
+func measure(req *Request) (depth, calls int) {
+	calls = 1
+	for index := range req.Dependents {
+		d, c := measure(&req.Dependents[index].Request)
+		if d+1 > depth {
+			depth = d + 1
+		}
+		calls += c
+	}
+	return
+}
+
+// how often the idle entries of the per client and per host maps are swept
+const sweepEvery = time.Minute
+
+// a set of token buckets, one per key. buckets that have refilled are
+// dropped, they're no different from a new one
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from key's bucket. if there isn't one, it says how long
+// until there will be.
+func (limiter *rateLimiter) allow(key string, limit RateLimit) (ok bool, retryAfter time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.buckets == nil {
+		limiter.buckets = make(map[string]*bucket)
+	}
+	now := time.Now()
+	if now.Sub(limiter.swept) >= sweepEvery {
+		for k, b := range limiter.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= burst {
+				delete(limiter.buckets, k)
+			}
+		}
+		limiter.swept = now
+	}
+	b, found := limiter.buckets[key]
+	if !found {
+		b = &bucket{tokens: burst, last: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// allowClient applies the per client rate limit to a workload
+func (magic *Magic) allowClient(principal *Principal, remote string) error {
+	key := remote
+	if principal != nil {
+		key = principal.Name
+	} else if host, _, err := net.SplitHostPort(remote); err == nil {
+		key = host
+	}
+	if key == "" {
+		return nil
+	}
+	if ok, retry := magic.clients.allow(key, magic.Limits.PerClient); !ok {
+		return &LimitError{Code: http.StatusTooManyRequests, RetryAfter: retry, Reason: "rate limit exceeded"}
+	}
+	return nil
+}
+
+// allowHost applies the per host rate limit to an upstream call. when the
+// limit is hit the response says so and no call is made.
+func (magic *Magic) allowHost(req *Request, response *Response) bool {
+	target, err := url.Parse(req.URL)
+	if err != nil {
+		return true
+	}
+	ok, retry := magic.hosts.allow(target.Host, magic.Limits.PerHost)
+	if !ok {
+		response.Id = req.Id
+		response.Code = http.StatusTooManyRequests
+		response.Data = fmt.Sprintf("rate limit exceeded for %s", target.Host)
+		response.Header = http.Header{"Retry-After": {retryAfterSeconds(retry)}}
+	}
+	return ok
+}
+
+func retryAfterSeconds(retry time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(retry.Seconds())))
+}
@@ -0,0 +1,96 @@
+package ensemble
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitsCheck(t *testing.T) {
+	nested := Request{Id: "1", Dependents: []Dependency{{Request: Request{Id: "2", Dependents: []Dependency{{Request: Request{Id: "3"}}}}}}}
+	workload := &Workload{Requests: []Request{nested, {Id: "4"}}}
+
+	cases := []struct {
+		limits Limits
+		fails  bool
+	}{
+		{Limits{}, false},
+		{Limits{MaxRequests: 1}, true},
+		{Limits{MaxRequests: 2, MaxDepth: 2, MaxCalls: 4}, false},
+		{Limits{MaxDepth: 1}, true},
+		{Limits{MaxCalls: 3}, true},
+	}
+	for _, c := range cases {
+		err := c.limits.check(workload)
+		if (err != nil) != c.fails {
+			t.Errorf("%+v: expected failure %v, got %v", c.limits, c.fails, err)
+		}
+		if err != nil && err.(*LimitError).Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413, got %d", err.(*LimitError).Code)
+		}
+	}
+}
+
+func TestHandleRateLimitsClients(t *testing.T) {
+	magic := &Magic{Limits: Limits{PerClient: RateLimit{Rate: 0.5, Burst: 1}}}
+
+	call := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/magic", strings.NewReader(`{"requests":[]}`))
+		recorder := httptest.NewRecorder()
+		magic.Handle(recorder, req)
+		return recorder
+	}
+
+	if code := call().Code; code != http.StatusOK {
+		t.Fatalf("expected the first workload through, got %d", code)
+	}
+	recorder := call()
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", recorder.Code)
+	}
+	if retry := recorder.Header().Get("Retry-After"); retry != "2" {
+		t.Errorf("expected Retry-After 2, got %q", retry)
+	}
+}
+
+func TestUpstreamLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer backend.Close()
+
+	magic := &Magic{Limits: Limits{MaxResponseBytes: 50, PerHost: RateLimit{Rate: 1, Burst: 1}}}
+	result, _ := magic.DoMagic(Workload{
+		StrictOrder: true,
+		Requests: []Request{
+			{Id: "1", URL: backend.URL, Method: "GET"},
+			{Id: "2", URL: backend.URL, Method: "GET"},
+		},
+	})
+
+	if result.Responses[0].Code != http.StatusBadGateway || len(result.Responses[0].Data) > 50 {
+		t.Errorf("expected the oversized body to be refused, got %d %q", result.Responses[0].Code, result.Responses[0].Data)
+	}
+	if result.Responses[1].Code != http.StatusTooManyRequests || result.Responses[1].Header.Get("Retry-After") == "" {
+		t.Errorf("expected the host rate limit to apply, got %#v", result.Responses[1])
+	}
+}
+
+func TestRateLimiterSweeps(t *testing.T) {
+	var limiter rateLimiter
+	limit := RateLimit{Rate: 10, Burst: 1}
+	for _, key := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		limiter.allow(key, limit)
+	}
+	// a full bucket is swept, one still refilling is kept
+	limiter.buckets["10.0.0.1"].last = time.Now().Add(-time.Second)
+	limiter.swept = time.Now().Add(-sweepEvery)
+	if ok, _ := limiter.allow("10.0.0.2", limit); ok {
+		t.Error("expected the bucket to still be empty")
+	}
+	if _, found := limiter.buckets["10.0.0.1"]; found || len(limiter.buckets) != 2 {
+		t.Errorf("expected only the refilled bucket to be swept, have %d", len(limiter.buckets))
+	}
+}
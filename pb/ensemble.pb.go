@@ -0,0 +1,851 @@
+// The ensemble service over gRPC. The messages mirror the JSON Workload,
+// Request and Result; free-form JSON (a response's object and a result's
+// composed document) travels as JSON encoded bytes.
+//
+// Regenerate with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative pb/ensemble.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        v5.29.3
+// source: pb/ensemble.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Workload struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Requests      []*Request             `protobuf:"bytes,1,rep,name=requests,proto3" json:"requests,omitempty"`
+	StrictOrder   bool                   `protobuf:"varint,2,opt,name=strict_order,json=strictOrder,proto3" json:"strict_order,omitempty"`
+	Timeout       int64                  `protobuf:"varint,3,opt,name=timeout,proto3" json:"timeout,omitempty"`
+	UseHeaders    bool                   `protobuf:"varint,4,opt,name=use_headers,json=useHeaders,proto3" json:"use_headers,omitempty"`
+	Compose       string                 `protobuf:"bytes,5,opt,name=compose,proto3" json:"compose,omitempty"`
+	ComposeOnly   bool                   `protobuf:"varint,6,opt,name=compose_only,json=composeOnly,proto3" json:"compose_only,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Workload) Reset() {
+	*x = Workload{}
+	mi := &file_pb_ensemble_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Workload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Workload) ProtoMessage() {}
+
+func (x *Workload) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Workload.ProtoReflect.Descriptor instead.
+func (*Workload) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Workload) GetRequests() []*Request {
+	if x != nil {
+		return x.Requests
+	}
+	return nil
+}
+
+func (x *Workload) GetStrictOrder() bool {
+	if x != nil {
+		return x.StrictOrder
+	}
+	return false
+}
+
+func (x *Workload) GetTimeout() int64 {
+	if x != nil {
+		return x.Timeout
+	}
+	return 0
+}
+
+func (x *Workload) GetUseHeaders() bool {
+	if x != nil {
+		return x.UseHeaders
+	}
+	return false
+}
+
+func (x *Workload) GetCompose() string {
+	if x != nil {
+		return x.Compose
+	}
+	return ""
+}
+
+func (x *Workload) GetComposeOnly() bool {
+	if x != nil {
+		return x.ComposeOnly
+	}
+	return false
+}
+
+type HeaderValues struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Values        []string               `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeaderValues) Reset() {
+	*x = HeaderValues{}
+	mi := &file_pb_ensemble_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeaderValues) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeaderValues) ProtoMessage() {}
+
+func (x *HeaderValues) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeaderValues.ProtoReflect.Descriptor instead.
+func (*HeaderValues) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *HeaderValues) GetValues() []string {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+type Hedge struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Delay         int64                  `protobuf:"varint,1,opt,name=delay,proto3" json:"delay,omitempty"` // milliseconds
+	Percentile    float64                `protobuf:"fixed64,2,opt,name=percentile,proto3" json:"percentile,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Hedge) Reset() {
+	*x = Hedge{}
+	mi := &file_pb_ensemble_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Hedge) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Hedge) ProtoMessage() {}
+
+func (x *Hedge) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Hedge.ProtoReflect.Descriptor instead.
+func (*Hedge) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Hedge) GetDelay() int64 {
+	if x != nil {
+		return x.Delay
+	}
+	return 0
+}
+
+func (x *Hedge) GetPercentile() float64 {
+	if x != nil {
+		return x.Percentile
+	}
+	return 0
+}
+
+type Dependency struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Request       *Request               `protobuf:"bytes,1,opt,name=request,proto3" json:"request,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Dependency) Reset() {
+	*x = Dependency{}
+	mi := &file_pb_ensemble_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Dependency) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Dependency) ProtoMessage() {}
+
+func (x *Dependency) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Dependency.ProtoReflect.Descriptor instead.
+func (*Dependency) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Dependency) GetRequest() *Request {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+type Request struct {
+	state            protoimpl.MessageState   `protogen:"open.v1"`
+	Id               string                   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Url              string                   `protobuf:"bytes,2,opt,name=url,proto3" json:"url,omitempty"`
+	Service          string                   `protobuf:"bytes,3,opt,name=service,proto3" json:"service,omitempty"`
+	Method           string                   `protobuf:"bytes,4,opt,name=method,proto3" json:"method,omitempty"`
+	Data             string                   `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+	Headers          map[string]*HeaderValues `protobuf:"bytes,6,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Dependencies     []*Dependency            `protobuf:"bytes,7,rep,name=dependencies,proto3" json:"dependencies,omitempty"`
+	UseData          bool                     `protobuf:"varint,8,opt,name=use_data,json=useData,proto3" json:"use_data,omitempty"`
+	UseDepHeader     bool                     `protobuf:"varint,9,opt,name=use_dep_header,json=useDepHeader,proto3" json:"use_dep_header,omitempty"`
+	DepHeaders       []string                 `protobuf:"bytes,10,rep,name=dep_headers,json=depHeaders,proto3" json:"dep_headers,omitempty"`
+	DoJoin           bool                     `protobuf:"varint,11,opt,name=do_join,json=doJoin,proto3" json:"do_join,omitempty"`
+	JoinChar         string                   `protobuf:"bytes,12,opt,name=join_char,json=joinChar,proto3" json:"join_char,omitempty"`
+	PassName         string                   `protobuf:"bytes,13,opt,name=pass_name,json=passName,proto3" json:"pass_name,omitempty"`
+	Hedge            *Hedge                   `protobuf:"bytes,14,opt,name=hedge,proto3" json:"hedge,omitempty"`
+	Fields           string                   `protobuf:"bytes,15,opt,name=fields,proto3" json:"fields,omitempty"`
+	DataEncoding     string                   `protobuf:"bytes,16,opt,name=data_encoding,json=dataEncoding,proto3" json:"data_encoding,omitempty"` // base64
+	Multipart        []*Part                  `protobuf:"bytes,17,rep,name=multipart,proto3" json:"multipart,omitempty"`
+	ResponseEncoding string                   `protobuf:"bytes,18,opt,name=response_encoding,json=responseEncoding,proto3" json:"response_encoding,omitempty"` // base64 or text
+	Query            map[string]*HeaderValues `protobuf:"bytes,19,rep,name=query,proto3" json:"query,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Form             map[string]*HeaderValues `protobuf:"bytes,20,rep,name=form,proto3" json:"form,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Json             []byte                   `protobuf:"bytes,21,opt,name=json,proto3" json:"json,omitempty"` // JSON
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Request) Reset() {
+	*x = Request{}
+	mi := &file_pb_ensemble_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Request) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Request) ProtoMessage() {}
+
+func (x *Request) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Request.ProtoReflect.Descriptor instead.
+func (*Request) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Request) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Request) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *Request) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *Request) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *Request) GetData() string {
+	if x != nil {
+		return x.Data
+	}
+	return ""
+}
+
+func (x *Request) GetHeaders() map[string]*HeaderValues {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *Request) GetDependencies() []*Dependency {
+	if x != nil {
+		return x.Dependencies
+	}
+	return nil
+}
+
+func (x *Request) GetUseData() bool {
+	if x != nil {
+		return x.UseData
+	}
+	return false
+}
+
+func (x *Request) GetUseDepHeader() bool {
+	if x != nil {
+		return x.UseDepHeader
+	}
+	return false
+}
+
+func (x *Request) GetDepHeaders() []string {
+	if x != nil {
+		return x.DepHeaders
+	}
+	return nil
+}
+
+func (x *Request) GetDoJoin() bool {
+	if x != nil {
+		return x.DoJoin
+	}
+	return false
+}
+
+func (x *Request) GetJoinChar() string {
+	if x != nil {
+		return x.JoinChar
+	}
+	return ""
+}
+
+func (x *Request) GetPassName() string {
+	if x != nil {
+		return x.PassName
+	}
+	return ""
+}
+
+func (x *Request) GetHedge() *Hedge {
+	if x != nil {
+		return x.Hedge
+	}
+	return nil
+}
+
+func (x *Request) GetFields() string {
+	if x != nil {
+		return x.Fields
+	}
+	return ""
+}
+
+func (x *Request) GetDataEncoding() string {
+	if x != nil {
+		return x.DataEncoding
+	}
+	return ""
+}
+
+func (x *Request) GetMultipart() []*Part {
+	if x != nil {
+		return x.Multipart
+	}
+	return nil
+}
+
+func (x *Request) GetResponseEncoding() string {
+	if x != nil {
+		return x.ResponseEncoding
+	}
+	return ""
+}
+
+func (x *Request) GetQuery() map[string]*HeaderValues {
+	if x != nil {
+		return x.Query
+	}
+	return nil
+}
+
+func (x *Request) GetForm() map[string]*HeaderValues {
+	if x != nil {
+		return x.Form
+	}
+	return nil
+}
+
+func (x *Request) GetJson() []byte {
+	if x != nil {
+		return x.Json
+	}
+	return nil
+}
+
+type Part struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value         string                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Filename      string                 `protobuf:"bytes,3,opt,name=filename,proto3" json:"filename,omitempty"`
+	ContentType   string                 `protobuf:"bytes,4,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	Encoding      string                 `protobuf:"bytes,5,opt,name=encoding,proto3" json:"encoding,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Part) Reset() {
+	*x = Part{}
+	mi := &file_pb_ensemble_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Part) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Part) ProtoMessage() {}
+
+func (x *Part) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Part.ProtoReflect.Descriptor instead.
+func (*Part) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Part) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Part) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+func (x *Part) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *Part) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+func (x *Part) GetEncoding() string {
+	if x != nil {
+		return x.Encoding
+	}
+	return ""
+}
+
+type Response struct {
+	state         protoimpl.MessageState   `protogen:"open.v1"`
+	Id            string                   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Data          string                   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Object        []byte                   `protobuf:"bytes,3,opt,name=object,proto3" json:"object,omitempty"` // JSON
+	Code          int32                    `protobuf:"varint,4,opt,name=code,proto3" json:"code,omitempty"`
+	Headers       map[string]*HeaderValues `protobuf:"bytes,5,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Err           string                   `protobuf:"bytes,6,opt,name=err,proto3" json:"err,omitempty"`
+	Encoding      string                   `protobuf:"bytes,7,opt,name=encoding,proto3" json:"encoding,omitempty"` // base64 if data is
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Response) Reset() {
+	*x = Response{}
+	mi := &file_pb_ensemble_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Response) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Response) ProtoMessage() {}
+
+func (x *Response) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Response.ProtoReflect.Descriptor instead.
+func (*Response) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Response) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Response) GetData() string {
+	if x != nil {
+		return x.Data
+	}
+	return ""
+}
+
+func (x *Response) GetObject() []byte {
+	if x != nil {
+		return x.Object
+	}
+	return nil
+}
+
+func (x *Response) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *Response) GetHeaders() map[string]*HeaderValues {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *Response) GetErr() string {
+	if x != nil {
+		return x.Err
+	}
+	return ""
+}
+
+func (x *Response) GetEncoding() string {
+	if x != nil {
+		return x.Encoding
+	}
+	return ""
+}
+
+type Result struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Responses     []*Response            `protobuf:"bytes,1,rep,name=responses,proto3" json:"responses,omitempty"`
+	Composed      []byte                 `protobuf:"bytes,2,opt,name=composed,proto3" json:"composed,omitempty"` // JSON
+	Err           string                 `protobuf:"bytes,3,opt,name=err,proto3" json:"err,omitempty"`
+	Code          int32                  `protobuf:"varint,4,opt,name=code,proto3" json:"code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Result) Reset() {
+	*x = Result{}
+	mi := &file_pb_ensemble_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Result) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Result) ProtoMessage() {}
+
+func (x *Result) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_ensemble_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Result.ProtoReflect.Descriptor instead.
+func (*Result) Descriptor() ([]byte, []int) {
+	return file_pb_ensemble_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Result) GetResponses() []*Response {
+	if x != nil {
+		return x.Responses
+	}
+	return nil
+}
+
+func (x *Result) GetComposed() []byte {
+	if x != nil {
+		return x.Composed
+	}
+	return nil
+}
+
+func (x *Result) GetErr() string {
+	if x != nil {
+		return x.Err
+	}
+	return ""
+}
+
+func (x *Result) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+var File_pb_ensemble_proto protoreflect.FileDescriptor
+
+const file_pb_ensemble_proto_rawDesc = "" +
+	"\n" +
+	"\x11pb/ensemble.proto\x12\bensemble\"\xd4\x01\n" +
+	"\bWorkload\x12-\n" +
+	"\brequests\x18\x01 \x03(\v2\x11.ensemble.RequestR\brequests\x12!\n" +
+	"\fstrict_order\x18\x02 \x01(\bR\vstrictOrder\x12\x18\n" +
+	"\atimeout\x18\x03 \x01(\x03R\atimeout\x12\x1f\n" +
+	"\vuse_headers\x18\x04 \x01(\bR\n" +
+	"useHeaders\x12\x18\n" +
+	"\acompose\x18\x05 \x01(\tR\acompose\x12!\n" +
+	"\fcompose_only\x18\x06 \x01(\bR\vcomposeOnly\"&\n" +
+	"\fHeaderValues\x12\x16\n" +
+	"\x06values\x18\x01 \x03(\tR\x06values\"=\n" +
+	"\x05Hedge\x12\x14\n" +
+	"\x05delay\x18\x01 \x01(\x03R\x05delay\x12\x1e\n" +
+	"\n" +
+	"percentile\x18\x02 \x01(\x01R\n" +
+	"percentile\"9\n" +
+	"\n" +
+	"Dependency\x12+\n" +
+	"\arequest\x18\x01 \x01(\v2\x11.ensemble.RequestR\arequest\"\xc9\a\n" +
+	"\aRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x10\n" +
+	"\x03url\x18\x02 \x01(\tR\x03url\x12\x18\n" +
+	"\aservice\x18\x03 \x01(\tR\aservice\x12\x16\n" +
+	"\x06method\x18\x04 \x01(\tR\x06method\x12\x12\n" +
+	"\x04data\x18\x05 \x01(\tR\x04data\x128\n" +
+	"\aheaders\x18\x06 \x03(\v2\x1e.ensemble.Request.HeadersEntryR\aheaders\x128\n" +
+	"\fdependencies\x18\a \x03(\v2\x14.ensemble.DependencyR\fdependencies\x12\x19\n" +
+	"\buse_data\x18\b \x01(\bR\auseData\x12$\n" +
+	"\x0euse_dep_header\x18\t \x01(\bR\fuseDepHeader\x12\x1f\n" +
+	"\vdep_headers\x18\n" +
+	" \x03(\tR\n" +
+	"depHeaders\x12\x17\n" +
+	"\ado_join\x18\v \x01(\bR\x06doJoin\x12\x1b\n" +
+	"\tjoin_char\x18\f \x01(\tR\bjoinChar\x12\x1b\n" +
+	"\tpass_name\x18\r \x01(\tR\bpassName\x12%\n" +
+	"\x05hedge\x18\x0e \x01(\v2\x0f.ensemble.HedgeR\x05hedge\x12\x16\n" +
+	"\x06fields\x18\x0f \x01(\tR\x06fields\x12#\n" +
+	"\rdata_encoding\x18\x10 \x01(\tR\fdataEncoding\x12,\n" +
+	"\tmultipart\x18\x11 \x03(\v2\x0e.ensemble.PartR\tmultipart\x12+\n" +
+	"\x11response_encoding\x18\x12 \x01(\tR\x10responseEncoding\x122\n" +
+	"\x05query\x18\x13 \x03(\v2\x1c.ensemble.Request.QueryEntryR\x05query\x12/\n" +
+	"\x04form\x18\x14 \x03(\v2\x1b.ensemble.Request.FormEntryR\x04form\x12\x12\n" +
+	"\x04json\x18\x15 \x01(\fR\x04json\x1aR\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12,\n" +
+	"\x05value\x18\x02 \x01(\v2\x16.ensemble.HeaderValuesR\x05value:\x028\x01\x1aP\n" +
+	"\n" +
+	"QueryEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12,\n" +
+	"\x05value\x18\x02 \x01(\v2\x16.ensemble.HeaderValuesR\x05value:\x028\x01\x1aO\n" +
+	"\tFormEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12,\n" +
+	"\x05value\x18\x02 \x01(\v2\x16.ensemble.HeaderValuesR\x05value:\x028\x01\"\x8b\x01\n" +
+	"\x04Part\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value\x12\x1a\n" +
+	"\bfilename\x18\x03 \x01(\tR\bfilename\x12!\n" +
+	"\fcontent_type\x18\x04 \x01(\tR\vcontentType\x12\x1a\n" +
+	"\bencoding\x18\x05 \x01(\tR\bencoding\"\x97\x02\n" +
+	"\bResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04data\x18\x02 \x01(\tR\x04data\x12\x16\n" +
+	"\x06object\x18\x03 \x01(\fR\x06object\x12\x12\n" +
+	"\x04code\x18\x04 \x01(\x05R\x04code\x129\n" +
+	"\aheaders\x18\x05 \x03(\v2\x1f.ensemble.Response.HeadersEntryR\aheaders\x12\x10\n" +
+	"\x03err\x18\x06 \x01(\tR\x03err\x12\x1a\n" +
+	"\bencoding\x18\a \x01(\tR\bencoding\x1aR\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12,\n" +
+	"\x05value\x18\x02 \x01(\v2\x16.ensemble.HeaderValuesR\x05value:\x028\x01\"|\n" +
+	"\x06Result\x120\n" +
+	"\tresponses\x18\x01 \x03(\v2\x12.ensemble.ResponseR\tresponses\x12\x1a\n" +
+	"\bcomposed\x18\x02 \x01(\fR\bcomposed\x12\x10\n" +
+	"\x03err\x18\x03 \x01(\tR\x03err\x12\x12\n" +
+	"\x04code\x18\x04 \x01(\x05R\x04code2;\n" +
+	"\bEnsemble\x12/\n" +
+	"\aDoMagic\x12\x12.ensemble.Workload\x1a\x10.ensemble.ResultB(Z&github.com/russellsimpkins/ensemble/pbb\x06proto3"
+
+var (
+	file_pb_ensemble_proto_rawDescOnce sync.Once
+	file_pb_ensemble_proto_rawDescData []byte
+)
+
+func file_pb_ensemble_proto_rawDescGZIP() []byte {
+	file_pb_ensemble_proto_rawDescOnce.Do(func() {
+		file_pb_ensemble_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pb_ensemble_proto_rawDesc), len(file_pb_ensemble_proto_rawDesc)))
+	})
+	return file_pb_ensemble_proto_rawDescData
+}
+
+var file_pb_ensemble_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
+var file_pb_ensemble_proto_goTypes = []any{
+	(*Workload)(nil),     // 0: ensemble.Workload
+	(*HeaderValues)(nil), // 1: ensemble.HeaderValues
+	(*Hedge)(nil),        // 2: ensemble.Hedge
+	(*Dependency)(nil),   // 3: ensemble.Dependency
+	(*Request)(nil),      // 4: ensemble.Request
+	(*Part)(nil),         // 5: ensemble.Part
+	(*Response)(nil),     // 6: ensemble.Response
+	(*Result)(nil),       // 7: ensemble.Result
+	nil,                  // 8: ensemble.Request.HeadersEntry
+	nil,                  // 9: ensemble.Request.QueryEntry
+	nil,                  // 10: ensemble.Request.FormEntry
+	nil,                  // 11: ensemble.Response.HeadersEntry
+}
+var file_pb_ensemble_proto_depIdxs = []int32{
+	4,  // 0: ensemble.Workload.requests:type_name -> ensemble.Request
+	4,  // 1: ensemble.Dependency.request:type_name -> ensemble.Request
+	8,  // 2: ensemble.Request.headers:type_name -> ensemble.Request.HeadersEntry
+	3,  // 3: ensemble.Request.dependencies:type_name -> ensemble.Dependency
+	2,  // 4: ensemble.Request.hedge:type_name -> ensemble.Hedge
+	5,  // 5: ensemble.Request.multipart:type_name -> ensemble.Part
+	9,  // 6: ensemble.Request.query:type_name -> ensemble.Request.QueryEntry
+	10, // 7: ensemble.Request.form:type_name -> ensemble.Request.FormEntry
+	11, // 8: ensemble.Response.headers:type_name -> ensemble.Response.HeadersEntry
+	6,  // 9: ensemble.Result.responses:type_name -> ensemble.Response
+	1,  // 10: ensemble.Request.HeadersEntry.value:type_name -> ensemble.HeaderValues
+	1,  // 11: ensemble.Request.QueryEntry.value:type_name -> ensemble.HeaderValues
+	1,  // 12: ensemble.Request.FormEntry.value:type_name -> ensemble.HeaderValues
+	1,  // 13: ensemble.Response.HeadersEntry.value:type_name -> ensemble.HeaderValues
+	0,  // 14: ensemble.Ensemble.DoMagic:input_type -> ensemble.Workload
+	7,  // 15: ensemble.Ensemble.DoMagic:output_type -> ensemble.Result
+	15, // [15:16] is the sub-list for method output_type
+	14, // [14:15] is the sub-list for method input_type
+	14, // [14:14] is the sub-list for extension type_name
+	14, // [14:14] is the sub-list for extension extendee
+	0,  // [0:14] is the sub-list for field type_name
+}
+
+func init() { file_pb_ensemble_proto_init() }
+func file_pb_ensemble_proto_init() {
+	if File_pb_ensemble_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pb_ensemble_proto_rawDesc), len(file_pb_ensemble_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   12,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pb_ensemble_proto_goTypes,
+		DependencyIndexes: file_pb_ensemble_proto_depIdxs,
+		MessageInfos:      file_pb_ensemble_proto_msgTypes,
+	}.Build()
+	File_pb_ensemble_proto = out.File
+	file_pb_ensemble_proto_goTypes = nil
+	file_pb_ensemble_proto_depIdxs = nil
+}
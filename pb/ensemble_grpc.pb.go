@@ -0,0 +1,131 @@
+// The ensemble service over gRPC. The messages mirror the JSON Workload,
+// Request and Result; free-form JSON (a response's object and a result's
+// composed document) travels as JSON encoded bytes.
+//
+// Regenerate with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative pb/ensemble.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: pb/ensemble.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Ensemble_DoMagic_FullMethodName = "/ensemble.Ensemble/DoMagic"
+)
+
+// EnsembleClient is the client API for Ensemble service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EnsembleClient interface {
+	// DoMagic runs a workload and returns its result.
+	DoMagic(ctx context.Context, in *Workload, opts ...grpc.CallOption) (*Result, error)
+}
+
+type ensembleClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEnsembleClient(cc grpc.ClientConnInterface) EnsembleClient {
+	return &ensembleClient{cc}
+}
+
+func (c *ensembleClient) DoMagic(ctx context.Context, in *Workload, opts ...grpc.CallOption) (*Result, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Result)
+	err := c.cc.Invoke(ctx, Ensemble_DoMagic_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EnsembleServer is the server API for Ensemble service.
+// All implementations must embed UnimplementedEnsembleServer
+// for forward compatibility.
+type EnsembleServer interface {
+	// DoMagic runs a workload and returns its result.
+	DoMagic(context.Context, *Workload) (*Result, error)
+	mustEmbedUnimplementedEnsembleServer()
+}
+
+// UnimplementedEnsembleServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedEnsembleServer struct{}
+
+func (UnimplementedEnsembleServer) DoMagic(context.Context, *Workload) (*Result, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DoMagic not implemented")
+}
+func (UnimplementedEnsembleServer) mustEmbedUnimplementedEnsembleServer() {}
+func (UnimplementedEnsembleServer) testEmbeddedByValue()                  {}
+
+// UnsafeEnsembleServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EnsembleServer will
+// result in compilation errors.
+type UnsafeEnsembleServer interface {
+	mustEmbedUnimplementedEnsembleServer()
+}
+
+func RegisterEnsembleServer(s grpc.ServiceRegistrar, srv EnsembleServer) {
+	// If the following call pancis, it indicates UnimplementedEnsembleServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Ensemble_ServiceDesc, srv)
+}
+
+func _Ensemble_DoMagic_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Workload)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EnsembleServer).DoMagic(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ensemble_DoMagic_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EnsembleServer).DoMagic(ctx, req.(*Workload))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Ensemble_ServiceDesc is the grpc.ServiceDesc for Ensemble service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Ensemble_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ensemble.Ensemble",
+	HandlerType: (*EnsembleServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "DoMagic",
+			Handler:    _Ensemble_DoMagic_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pb/ensemble.proto",
+}
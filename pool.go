@@ -0,0 +1,166 @@
+package ensemble
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ * Async requests run on a fixed set of workers shared by every workload. Each
+ * workload gets its own queue and workers take from the queues round robin,
+ * so a workload with a hundred requests can't starve one with two.
+ */
+
+// PoolStats is a snapshot of the worker pool, for metrics and the admin
+// endpoint.
+type PoolStats struct {
+	Workers   int           `json:"workers"`   // size of the pool
+	Busy      int           `json:"busy"`      // workers running a request
+	Queued    int           `json:"queued"`    // requests waiting for a worker
+	Workloads int           `json:"workloads"` // workloads with requests queued or running
+	Completed int64         `json:"completed"` // requests run since start
+	Dropped   int64         `json:"dropped"`   // queued requests dropped when their workload timed out
+	MeanWait  time.Duration `json:"mean_wait"` // average time a request spent queued
+}
+
+type pool struct {
+	mutex     sync.Mutex
+	ready     *sync.Cond
+	stopped   bool
+	size      int
+	queues    []*queue
+	next      int // the queue to look at first, for round robin
+	busy      int
+	completed int64
+	dropped   int64
+	waited    time.Duration
+}
+
+// the queued requests of one workload
+type queue struct {
+	tasks   []task
+	running int
+	limit   int // how many may run at once, 0 for no limit
+}
+
+type task struct {
+	run    func()
+	queued time.Time
+}
+
+// open registers a new workload queue, starting the workers on first use.
+func (p *pool) open(size, limit int) *queue {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.ready == nil {
+		p.ready = sync.NewCond(&p.mutex)
+		p.size = size
+		for i := 0; i < size; i++ {
+			go p.work()
+		}
+	}
+	q := &queue{limit: limit}
+	p.queues = append(p.queues, q)
+	return q
+}
+
+func (p *pool) submit(q *queue, run func()) {
+	p.mutex.Lock()
+	q.tasks = append(q.tasks, task{run: run, queued: time.Now()})
+	p.mutex.Unlock()
+	p.ready.Signal()
+}
+
+// close drops whatever the workload still has queued and forgets the queue.
+// it returns how many requests were dropped.
+func (p *pool) close(q *queue) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	dropped := len(q.tasks)
+	q.tasks = nil
+	p.dropped += int64(dropped)
+	for index, candidate := range p.queues {
+		if candidate == q {
+			p.queues = append(p.queues[:index], p.queues[index+1:]...)
+			break
+		}
+	}
+	return dropped
+}
+
+func (p *pool) work() {
+	for {
+		q, t, ok := p.take()
+		if !ok {
+			return
+		}
+		t.run()
+		p.mutex.Lock()
+		q.running--
+		p.busy--
+		p.completed++
+		p.mutex.Unlock()
+		// a slot in q may have opened up
+		p.ready.Broadcast()
+	}
+}
+
+// take blocks until there is a task a worker may run. once the pool is
+// stopped and the queues are empty it returns false.
+func (p *pool) take() (*queue, task, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		for i := 0; i < len(p.queues); i++ {
+			index := (p.next + i) % len(p.queues)
+			q := p.queues[index]
+			if len(q.tasks) == 0 || (q.limit > 0 && q.running >= q.limit) {
+				continue
+			}
+			t := q.tasks[0]
+			q.tasks = q.tasks[1:]
+			q.running++
+			p.busy++
+			p.waited += time.Since(t.queued)
+			p.next = index + 1
+			return q, t, true
+		}
+		if p.stopped {
+			return nil, task{}, false
+		}
+		p.ready.Wait()
+	}
+}
+
+// stop lets the workers exit once whatever is queued has run
+func (p *pool) stop() {
+	p.mutex.Lock()
+	p.stopped = true
+	ready := p.ready
+	p.mutex.Unlock()
+	if ready != nil {
+		ready.Broadcast()
+	}
+}
+
+func (p *pool) stats() (stats PoolStats) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats = PoolStats{Workers: p.size, Busy: p.busy, Completed: p.completed, Dropped: p.dropped}
+	for _, q := range p.queues {
+		stats.Queued += len(q.tasks)
+		if len(q.tasks) > 0 || q.running > 0 {
+			stats.Workloads++
+		}
+	}
+	if started := p.completed + int64(p.busy); started > 0 {
+		stats.MeanWait = p.waited / time.Duration(started)
+	}
+	return
+}
+
+// PoolStats reports on the worker pool. it is all zeros until Concurrency is
+// set and a workload has run.
+func (magic *Magic) PoolStats() PoolStats {
+	return magic.workers.stats()
+}
@@ -0,0 +1,85 @@
+package ensemble
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolIsFair(t *testing.T) {
+	var (
+		p     pool
+		order []string
+		mutex sync.Mutex
+		done  sync.WaitGroup
+	)
+	record := func(name string) func() {
+		done.Add(1)
+		return func() {
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+			done.Done()
+		}
+	}
+
+	// hold the only worker while both workloads queue up
+	hold := make(chan struct{})
+	big := p.open(1, 0)
+	done.Add(1)
+	p.submit(big, func() { <-hold; done.Done() })
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		p.submit(big, record("big"))
+	}
+	small := p.open(1, 0)
+	p.submit(small, record("small"))
+	close(hold)
+	done.Wait()
+
+	// big just had its turn, so small goes next rather than after all of big
+	if order[0] != "small" {
+		t.Errorf("expected the small workload to go next, got %v", order)
+	}
+	if stats := p.stats(); stats.Completed != 6 || stats.Queued != 0 || stats.Workers != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestWorkloadConcurrency(t *testing.T) {
+	var running, most int32
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		now := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&most)
+			if now <= seen || atomic.CompareAndSwapInt32(&most, seen, now) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}))
+	defer backend.Close()
+
+	magic := &Magic{Concurrency: 8, WorkloadConcurrency: 2}
+	workload := Workload{}
+	for i := 0; i < 6; i++ {
+		workload.Requests = append(workload.Requests, Request{Id: "x", URL: backend.URL, Method: "GET"})
+	}
+	result, _ := magic.DoMagic(workload)
+
+	for _, response := range result.Responses {
+		if response.Code != http.StatusOK {
+			t.Errorf("expected every request to run, got %#v", response)
+		}
+	}
+	if most > 2 {
+		t.Errorf("expected at most 2 requests at once, saw %d", most)
+	}
+	if stats := magic.PoolStats(); stats.Workers != 8 || stats.Completed != 6 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,291 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * A recipe is a named workload kept on the server, in a JSON or YAML file. Clients POST a small
+ * object of parameters to /recipes/{name} instead of the whole workload, and
+ * the workload can change without shipping a new app.
+ *
+ * Parameters appear in the workload as ${name} and are escaped for where
+ * they land: path escaped in a url's path, query escaped in its query, JSON
+ * string escaped in data and as is in headers.
+ */
+
+// Recipe is a stored, parameterized workload.
+type Recipe struct {
+	Name     string           `json:"name"`     // defaults to the file name
+	Params   map[string]Param `json:"params"`   // the parameters the workload uses
+	Workload json.RawMessage  `json:"workload"` // a Workload, with ${param} placeholders
+}
+
+// Param describes one recipe parameter.
+type Param struct {
+	Required bool   `json:"required"`
+	Default  string `json:"default"`
+	Pattern  string `json:"pattern"` // if set, the value must match this regular expression
+}
+
+var placeholder = regexp.MustCompile(`\$\{([A-Za-z0-9_.-]+)\}`)
+
+// the layout of a recipe file, which HCL needs to know what's a list
+type recipeFile struct {
+	Name     string           `json:"name"`
+	Params   map[string]Param `json:"params"`
+	Workload Workload         `json:"workload"`
+}
+
+// LoadRecipes reads every .json, .yaml, .yml and .hcl file in dir as a Recipe.
+func LoadRecipes(dir string) (recipes map[string]*Recipe, err error) {
+	var files []string
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml", "*.hcl"} {
+		var matches []string
+		if matches, err = filepath.Glob(filepath.Join(dir, pattern)); err != nil {
+			return
+		}
+		files = append(files, matches...)
+	}
+	recipes = make(map[string]*Recipe, len(files))
+	for _, file := range files {
+		var (
+			data   []byte
+			recipe Recipe
+		)
+		if data, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		}
+		switch filepath.Ext(file) {
+		case ".yaml", ".yml":
+			data, err = yamlToJSON(data)
+		case ".hcl":
+			data, err = hclToJSON(data, reflect.TypeOf(recipeFile{}))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse recipe %s: %s", file, err)
+		}
+		if err = json.Unmarshal(data, &recipe); err != nil {
+			return nil, fmt.Errorf("unable to parse recipe %s: %s", file, err)
+		}
+		if recipe.Name == "" {
+			recipe.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		if err = recipe.check(); err != nil {
+			return nil, fmt.Errorf("recipe %s: %s", file, err)
+		}
+		if _, exists := recipes[recipe.Name]; exists {
+			return nil, fmt.Errorf("recipe %s is defined twice", recipe.Name)
+		}
+		recipes[recipe.Name] = &recipe
+		log.WithFields(log.Fields{"name": recipe.Name, "file": file}).Debug("[LoadRecipes] loaded recipe")
+	}
+	return
+}
+
+// check makes sure the workload parses, the patterns compile and every
+// placeholder is a declared parameter
+func (recipe *Recipe) check() (err error) {
+	var work Workload
+	if err = json.Unmarshal(recipe.Workload, &work); err != nil {
+		return fmt.Errorf("unable to parse workload: %s", err)
+	}
+	for name, param := range recipe.Params {
+		if param.Pattern != "" {
+			if _, err = regexp.Compile(param.Pattern); err != nil {
+				return fmt.Errorf("param %s: %s", name, err)
+			}
+		}
+	}
+	for _, match := range placeholder.FindAllStringSubmatch(string(recipe.Workload), -1) {
+		if _, ok := recipe.Params[match[1]]; !ok {
+			return fmt.Errorf("${%s} is not a declared param", match[1])
+		}
+	}
+	return nil
+}
+
+// Expand returns the recipe's workload with the params filled in.
+func (recipe *Recipe) Expand(params map[string]interface{}) (work Workload, err error) {
+	values := make(map[string]string, len(recipe.Params))
+	for name, param := range recipe.Params {
+		raw, given := params[name]
+		value, set := param.Default, param.Default != ""
+		if given && raw != nil {
+			value, set = paramString(raw), true
+		}
+		if !given && param.Required {
+			return work, fmt.Errorf("missing param %s", name)
+		}
+		// an optional param left out with no default is empty, not a mismatch
+		if param.Pattern != "" && set {
+			pattern, err := regexp.Compile(param.Pattern)
+			if err != nil {
+				return work, fmt.Errorf("param %s: %s", name, err)
+			}
+			if !pattern.MatchString(value) {
+				return work, fmt.Errorf("param %s does not match %s", name, param.Pattern)
+			}
+		}
+		values[name] = value
+	}
+	for name := range params {
+		if _, ok := recipe.Params[name]; !ok {
+			return work, fmt.Errorf("unknown param %s", name)
+		}
+	}
+
+	if err = json.Unmarshal(recipe.Workload, &work); err != nil {
+		return
+	}
+	for index := range work.Requests {
+		if err = expandRequest(&work.Requests[index], values); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// paramString formats a param as it was written, so JSON numbers don't turn
+// into 1.2345678e+07
+func paramString(raw interface{}) string {
+	switch raw := raw.(type) {
+	case float64:
+		return strconv.FormatFloat(raw, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(raw), 'f', -1, 32)
+	}
+	return fmt.Sprint(raw)
+}
+
+func expandRequest(req *Request, values map[string]string) error {
+	req.URL = substituteURL(req.URL, values)
+	req.Data = substitute(req.Data, values, jsonEscape)
+	for name, headers := range req.Header {
+		for index, header := range headers {
+			header = substitute(header, values, func(value string) string { return value })
+			if strings.ContainsAny(header, "\r\n") {
+				return fmt.Errorf("header %s of request %s contains a line break", name, req.Id)
+			}
+			headers[index] = header
+		}
+	}
+	for _, params := range []Params{req.Query, req.Form} {
+		for _, items := range params {
+			for index, item := range items {
+				items[index] = substitute(item, values, func(value string) string { return value })
+			}
+		}
+	}
+	req.JSON = substituteJSON(req.JSON, values)
+	for index := range req.Dependents {
+		if err := expandRequest(&req.Dependents[index].Request, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func substitute(template string, values map[string]string, escape func(string) string) string {
+	return placeholder.ReplaceAllStringFunc(template, func(match string) string {
+		return escape(values[match[2:len(match)-1]])
+	})
+}
+
+// substituteURL escapes values as path segments before the ? and as query
+// values after it
+func substituteURL(template string, values map[string]string) string {
+	path, query, hasQuery := strings.Cut(template, "?")
+	path = substitute(path, values, url.PathEscape)
+	if !hasQuery {
+		return path
+	}
+	return path + "?" + substitute(query, values, url.QueryEscape)
+}
+
+// substituteJSON fills in the placeholders in a json body's strings
+func substituteJSON(value interface{}, values map[string]string) interface{} {
+	switch value := value.(type) {
+	case string:
+		return substitute(value, values, func(value string) string { return value })
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = substituteJSON(item, values)
+		}
+	case []interface{}:
+		for index, item := range value {
+			value[index] = substituteJSON(item, values)
+		}
+	}
+	return value
+}
+
+// the value as the inside of a JSON string, without the quotes
+func jsonEscape(value string) string {
+	var quoted bytes.Buffer
+	encoder := json.NewEncoder(&quoted)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	encoded := strings.TrimSpace(quoted.String())
+	return encoded[1 : len(encoded)-1]
+}
+
+// HandleRecipe runs the recipe named by the last element of the url path,
+// e.g. POST /recipes/home-screen, with the JSON object in the body as params.
+func (magic *Magic) HandleRecipe(writer http.ResponseWriter, req *http.Request) {
+	writer, done := magic.compress(writer, req)
+	defer done()
+
+	var (
+		work      Workload
+		err       error
+		body      []byte
+		params    map[string]interface{}
+		principal *Principal
+		ok        bool
+	)
+
+	if principal, ok = magic.authenticate(writer, req); !ok {
+		return
+	}
+
+	name := path.Base(req.URL.Path)
+	recipe, found := magic.Recipes[name]
+	if !found {
+		http.Error(writer, fmt.Sprintf("[ERROR] No such recipe: %s", name), http.StatusNotFound)
+		return
+	}
+
+	if body, ok = magic.readBody(writer, req); !ok {
+		return
+	}
+
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err = unmarshal(req.Header.Get("Content-Type"), body, &params); err != nil {
+			str := fmt.Sprintf("[ERROR] Unable to parse recipe params: %s", err)
+			http.Error(writer, str, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if work, err = recipe.Expand(params); err != nil {
+		str := fmt.Sprintf("[ERROR] Unable to expand recipe %s: %s", name, err)
+		http.Error(writer, str, http.StatusBadRequest)
+		return
+	}
+
+	magic.serve(writer, req, principal, &work, nil)
+}
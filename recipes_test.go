@@ -0,0 +1,141 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const homeScreen = `{
+	"params": {
+		"user": {"required": true, "pattern": "^[0-9]+$"},
+		"greeting": {"default": "hi there"}
+	},
+	"workload": {
+		"requests": [{
+			"id": "1",
+			"url": "/users/${user}?greeting=${greeting}",
+			"service": "api",
+			"method": "POST",
+			"data": "{\"greeting\":\"${greeting}\"}"
+		}],
+		"strictorder": true
+	}
+}`
+
+func TestLoadRecipes(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "home-screen.json"), []byte(homeScreen), 0600)
+	recipes, err := LoadRecipes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipe, ok := recipes["home-screen"]
+	if !ok {
+		t.Fatalf("expected the recipe to be named after its file, got %v", recipes)
+	}
+
+	work, err := recipe.Expand(map[string]interface{}{"user": 42, "greeting": `say "hello" & go`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := work.Requests[0]
+	if req.URL != "/users/42?greeting=say+%22hello%22+%26+go" {
+		t.Errorf("unexpected url %s", req.URL)
+	}
+	if req.Data != `{"greeting":"say \"hello\" & go"}` {
+		t.Errorf("unexpected data %s", req.Data)
+	}
+
+	// path segments are path escaped
+	template := *recipe
+	template.Params = map[string]Param{"name": {}}
+	template.Workload = json.RawMessage(`{"requests":[{"id":"1","url":"/users/${name}/a b?q=${name}"}]}`)
+	if work, err = template.Expand(map[string]interface{}{"name": "John Doe/2"}); err != nil || work.Requests[0].URL != "/users/John%20Doe%2F2/a b?q=John+Doe%2F2" {
+		t.Errorf("unexpected url %v %v", work.Requests, err)
+	}
+
+	// an optional param with a pattern may be left out
+	template.Params = map[string]Param{"name": {Pattern: "^[a-z]+$"}}
+	if work, err = template.Expand(map[string]interface{}{}); err != nil || work.Requests[0].URL != "/users//a b?q=" {
+		t.Errorf("unexpected url %v %v", work.Requests, err)
+	}
+	if _, err = template.Expand(map[string]interface{}{"name": "42"}); err == nil {
+		t.Error("expected a given value to be checked against the pattern")
+	}
+
+	// a decoded JSON number is a float64
+	if work, err = recipe.Expand(map[string]interface{}{"user": float64(12345678)}); err != nil || work.Requests[0].URL != "/users/12345678?greeting=hi+there" {
+		t.Errorf("unexpected url %v %v", work.Requests, err)
+	}
+
+	for _, params := range []map[string]interface{}{
+		{},
+		{"user": "42; drop"},
+		{"user": "42", "other": "x"},
+	} {
+		if _, err = recipe.Expand(params); err == nil {
+			t.Errorf("expected %v to be refused", params)
+		}
+	}
+
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"workload":{"requests":[{"url":"/${nope}"}]}}`), 0600)
+	if _, err = LoadRecipes(dir); err == nil {
+		t.Error("expected an undeclared placeholder to be refused")
+	}
+}
+
+func TestHandleRecipe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		writer.Write([]byte(req.URL.Path + " " + string(body)))
+	}))
+	defer backend.Close()
+
+	var recipe Recipe
+	json.Unmarshal([]byte(homeScreen), &recipe)
+	magic := &Magic{
+		Services: map[string]Service{"api": {Name: "api", BaseURL: backend.URL}},
+		Recipes:  map[string]*Recipe{"home-screen": &recipe},
+	}
+
+	recorder := httptest.NewRecorder()
+	magic.HandleRecipe(recorder, httptest.NewRequest("POST", "/recipes/home-screen", strings.NewReader(`{"user":"7"}`)))
+	var result Result
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unable to parse %s: %s", recorder.Body, err)
+	}
+	if got := result.Responses[0].Data; got != `/users/7 {"greeting":"hi there"}` {
+		t.Errorf("unexpected response %q", got)
+	}
+
+	recorder = httptest.NewRecorder()
+	magic.HandleRecipe(recorder, httptest.NewRequest("POST", "/recipes/nope", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", recorder.Code)
+	}
+}
+
+func TestExpandStructured(t *testing.T) {
+	recipe := &Recipe{
+		Params:   map[string]Param{"q": {Required: true}},
+		Workload: json.RawMessage(`{"requests":[{"id":"1","url":"/search","method":"POST","query":{"q":"${q}"},"json":{"filter":{"terms":["${q}"]}}}]}`),
+	}
+	work, err := recipe.Expand(map[string]interface{}{"q": `a&b "c"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := work.Requests[0]
+	if req.Query["q"][0] != `a&b "c"` {
+		t.Errorf("unexpected query %v", req.Query)
+	}
+	terms := req.JSON.(map[string]interface{})["filter"].(map[string]interface{})["terms"].([]interface{})
+	if terms[0] != `a&b "c"` {
+		t.Errorf("unexpected json %v", req.JSON)
+	}
+}
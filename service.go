@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
@@ -21,7 +22,20 @@ const DefaultTimeout = 10 * time.Second
 func MakeMagicEndpoint(magic *Magic) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(Workload)
+		if code, err := magic.admit(PrincipalFromContext(ctx), remoteFromContext(ctx), &req); err != nil {
+			return Result{Err: err.Error(), Code: code}, &StatusError{Code: code, Err: err}
+		}
+		if req.Async {
+			job, err := magic.Submit(PrincipalFromContext(ctx), req)
+			if err == ErrShuttingDown {
+				return nil, &StatusError{Code: http.StatusServiceUnavailable, Err: err}
+			}
+			return job, err
+		}
 		result, err := magic.DoMagic(req)
+		if err == ErrShuttingDown {
+			return result, &StatusError{Code: http.StatusServiceUnavailable, Err: err}
+		}
 		return result, err
 	}
 }
@@ -32,27 +46,91 @@ func (workload *Workload) SetHeader(h http.Header) {
 }
 
 func (magic *Magic) DoMagic(workload Workload) (result Result, err error) {
-	err = process(workload, &result)
+	if err = magic.resolve(&workload); err != nil {
+		return
+	}
+	err = magic.process(workload, &result)
 	return
 }
 
 // process is called from the go-kit func
-// process looks at the workload and calls requests syncronously or asyncronously
-func process(workload Workload, result *Result) (err error) {
+// process registers the workload so Shutdown can wait for it, then runs it
+func (magic *Magic) process(workload Workload, result *Result) (err error) {
+	// the context is cancelled if Shutdown gives up waiting on this workload
+	ctx, end, err := magic.begin(&workload)
+	if err != nil {
+		return
+	}
+	defer end()
+	return magic.run(ctx, workload, result)
+}
+
+// run looks at the workload and calls requests syncronously or asyncronously
+func (magic *Magic) run(ctx context.Context, workload Workload, result *Result) (err error) {
+
+	var (
+		q         *queue
+		semaphore chan struct{}
+	)
 
 	c := make(chan int, len(workload.Requests))
 	result.Responses = make([]Response, len(workload.Requests))
 
+	// async requests fill in their own response, which is only copied into
+	// the result while we're still waiting for it
+	var (
+		mutex    sync.Mutex
+		finished = make([]bool, len(workload.Requests))
+		waiting  = true
+	)
+	collect := func(index int, response *Response) {
+		mutex.Lock()
+		if waiting {
+			result.Responses[index], finished[index] = *response, true
+		}
+		mutex.Unlock()
+		c <- 1
+	}
+
+	// async requests go to the worker pool if there is one, otherwise each gets
+	// a go routine, optionally limited per workload
+	if !workload.StrictOrder && magic.Concurrency > 0 {
+		q = magic.workers.open(magic.Concurrency, magic.WorkloadConcurrency)
+	} else if !workload.StrictOrder && magic.WorkloadConcurrency > 0 {
+		semaphore = make(chan struct{}, magic.WorkloadConcurrency)
+	}
+	if !workload.StrictOrder {
+		magic.life.calls.Add(len(workload.Requests))
+	}
+
+	// the batch changesets with a failed call, the rest of their calls aren't made
+	failed := make(map[int]bool)
+
 	for index, _ := range workload.Requests {
 
 		if workload.UseHeaders {
-			replaceHeaderValues(&workload.Requests[index].Header, &workload.header)
+			forward := magic.headerPolicy(&workload.Requests[index]).Filter(workload.header, nil)
+			replaceHeaderValues(&workload.Requests[index].Header, &forward)
 		}
 
-		if workload.StrictOrder {
-			syncRequest(&workload.Requests[index], &result.Responses[index])
+		index, request := index, &workload.Requests[index]
+		if workload.StrictOrder && failed[request.atomic] {
+			result.Responses[index] = Response{Id: request.Id, Code: http.StatusFailedDependency, Err: ErrNotRun}
+		} else if workload.StrictOrder {
+			magic.syncRequest(ctx, request, &result.Responses[index])
+			if request.atomic != 0 && batchStatus(&result.Responses[index]) >= 300 {
+				failed[request.atomic] = true
+			}
+		} else if q != nil {
+			magic.workers.submit(q, func() { magic.asyncRequest(ctx, request, index, collect) })
+		} else if semaphore != nil {
+			go func() {
+				semaphore <- struct{}{}
+				magic.asyncRequest(ctx, request, index, collect)
+				<-semaphore
+			}()
 		} else {
-			go asyncRequest(&workload.Requests[index], &result.Responses[index], c)
+			go magic.asyncRequest(ctx, request, index, collect)
 		}
 	}
 
@@ -62,40 +140,127 @@ func process(workload Workload, result *Result) (err error) {
 		// create a timeout so we don't wait forever
 		var timeout <-chan time.Time
 
+		// a job's context has its deadline, which replaces the default
 		if workload.Timeout > 0 {
 			timeout = time.After(time.Duration(workload.Timeout))
-		} else {
+		} else if _, ok := ctx.Deadline(); !ok {
 			timeout = time.After(DefaultTimeout)
 		}
 
+	wait:
 		for index := 0; index < len(workload.Requests); index++ {
 			select {
 			case <-c:
 			case <-timeout:
 				log.Warn("[process] Timed out waiting for all go routines to complete")
-				break
+				break wait
+			case <-ctx.Done():
+				log.Warn("[process] Abandoned while waiting for go routines to complete")
+				break wait
 			}
 		}
+
+		// whatever finishes from here on is dropped
+		mutex.Lock()
+		waiting = false
+		for index, done := range finished {
+			if !done {
+				result.Responses[index] = Response{Id: workload.Requests[index].Id, Code: http.StatusGatewayTimeout}
+			}
+		}
+		mutex.Unlock()
+	}
+
+	if q != nil {
+		if dropped := magic.workers.close(q); dropped > 0 {
+			magic.life.calls.Add(-dropped)
+			log.WithFields(log.Fields{"dropped": dropped}).Warn("[process] Dropped queued requests")
+		}
+	}
+
+	if workload.Compose != "" {
+		if result.Composed, err = Compose(workload.Compose, result.Responses); err != nil {
+			result.Err, err = err.Error(), nil
+		} else if workload.ComposeOnly {
+			result.Responses = nil
+		}
+	}
+	return
+}
+
+// admit decides if a workload may run: it resolves the services, checks the
+// limits and authorizes the principal. on failure it returns the http status.
+func (magic *Magic) admit(principal *Principal, remote string, workload *Workload) (code int, err error) {
+	if err = magic.allowClient(principal, remote); err != nil {
+		return err.(*LimitError).Code, err
+	}
+	if err = magic.resolve(workload); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Unable to resolve workload: %s", err)
+	}
+	if workload.Compose != "" {
+		if err = checkCompose(workload); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	if err = checkFields(workload.Requests); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err = magic.Limits.check(workload); err != nil {
+		return err.(*LimitError).Code, err
+	}
+	if err = magic.Authorize(principal, workload); err != nil {
+		return http.StatusForbidden, fmt.Errorf("Forbidden: %s", err)
+	}
+	return http.StatusOK, nil
+}
+
+// resolve points requests that name a service at that service's base url.
+// dependencies are resolved too, so authorization sees the real targets.
+func (magic *Magic) resolve(workload *Workload) (err error) {
+	for index := range workload.Requests {
+		if err = magic.resolveRequest(&workload.Requests[index]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (magic *Magic) resolveRequest(req *Request) (err error) {
+	if req.Service != "" && !req.resolved {
+		service, ok := magic.Services[req.Service]
+		if !ok {
+			return fmt.Errorf("unknown service %q in request %s", req.Service, req.Id)
+		}
+		req.URL = strings.TrimSuffix(service.BaseURL, "/") + "/" + strings.TrimPrefix(req.URL, "/")
+		req.service = &service
+		req.resolved = true
+	}
+	for index := range req.Dependents {
+		if err = magic.resolveRequest(&req.Dependents[index].Request); err != nil {
+			return
+		}
 	}
 	return
 }
 
 // for making async requests
-func asyncRequest(request *Request, response *Response, c chan int) {
-	syncRequest(request, response)
-	c <- 1
+func (magic *Magic) asyncRequest(ctx context.Context, request *Request, index int, collect func(int, *Response)) {
+	defer magic.life.calls.Done()
+	var response Response
+	magic.syncRequest(ctx, request, &response)
+	collect(index, &response)
 }
 
 // SyncRequest will process any request dependencies and then call MakeRequest
 // if there are errors, it's returned in the response
-func syncRequest(request *Request, response *Response) {
+func (magic *Magic) syncRequest(ctx context.Context, request *Request, response *Response) {
 	var (
 		err error
 	)
 
 	if request.Dependents != nil {
 		log.Debugf("[syncRequest] There are dependencies")
-		processDependencies(request, response)
+		magic.processDependencies(ctx, request, response)
 		if response.Code != 200 {
 			log.Debugf("[syncRequest] bad response code")
 			log.Debugf("[syncRequest] %#v", response)
@@ -105,9 +270,13 @@ func syncRequest(request *Request, response *Response) {
 
 	log.WithFields(log.Fields{"method": request.Method, "URL": request.URL, "data": request.Data}).Debugf("[syncRequest] Making a request.")
 
-	if err = MakeRequest(request, response); err != nil {
+	if err = magic.makeRequest(ctx, request, response); err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("[syncRequest] unable to call MakeRequest")
 		response.Data = err.Error()
+	} else if request.Fields != "" {
+		if pruned, ok := selectFields(request, response); ok {
+			response.Object, response.Data = pruned, ""
+		}
 	}
 
 	return
@@ -117,7 +286,7 @@ func syncRequest(request *Request, response *Response) {
 // is a problem, the problem is in the Resposne.
 // TODO - add support for "allowed response codes" t
 // TODO - add support for "abort on failure = true/false" - current behavior = true
-func processDependencies(request *Request, response *Response) {
+func (magic *Magic) processDependencies(ctx context.Context, request *Request, response *Response) {
 
 	var (
 		err     error
@@ -138,18 +307,28 @@ func processDependencies(request *Request, response *Response) {
 
 	for index, dep := range request.Dependents {
 		dep := dep
-		err = MakeRequest(&dep.Request, &results[index])
+		err = magic.makeRequest(ctx, &dep.Request, &results[index])
 		// if any of the caller's dependency calls fails, we fail fast
-		if results[index].Code >= 200 && results[index].Code < 300 || err != nil {
-			log.WithFields(log.Fields{"code": results[index].Code}).Debugf("[ProcessDependencies] bad response")
+		if err != nil || results[index].Code < 200 || results[index].Code >= 300 {
+			log.WithFields(log.Fields{"code": results[index].Code, "err": err}).Debugf("[ProcessDependencies] bad response")
 			response.Id = dep.Request.Id
 			response.Code = results[index].Code
 			response.Data = results[index].Data
+			if err != nil {
+				response.Data = err.Error()
+			}
 			return
 		}
+		if dep.Request.Fields != "" {
+			if pruned, ok := selectFields(&dep.Request, &results[index]); ok {
+				data, _ := json.Marshal(pruned)
+				results[index].Data = string(data)
+			}
+		}
 		dataset[index] = results[index].Data
 		if request.UseDepHeader {
-			replaceHeaderValues(&request.Header, &results[index].Header)
+			forward := magic.headerPolicy(request).Filter(results[index].Header, request.DepHeader)
+			replaceHeaderValues(&request.Header, &forward)
 		}
 	}
 
@@ -182,19 +361,42 @@ func processDependencies(request *Request, response *Response) {
 	return
 }
 
+// makeRequest is how a Magic calls upstream: MakeRequest with the Magic's
+// limits, circuit breakers and hedging applied.
+func (magic *Magic) makeRequest(ctx context.Context, req *Request, response *Response) (err error) {
+	if !magic.allowHost(req, response) {
+		return
+	}
+	req.maxBody = magic.Limits.MaxResponseBytes
+	req.transport = magic.Transport
+	return magic.callBreaker(req, response, func() error {
+		if delay, ok := magic.hedgeDelay(req); ok {
+			return magic.hedge(ctx, req, response, delay)
+		}
+		return magic.attempt(ctx, req, response)
+	})
+}
+
 /*
  * we expect a valid url. GET requests support name value pairs.
  * Data will always go in the body of the request. It's more for backward compatability
  * since I know of services that combine request data with query strings.
  */
 func MakeRequest(req *Request, response *Response) (err error) {
+	return MakeRequestContext(context.Background(), req, response)
+}
+
+// MakeRequestContext is MakeRequest with a context, cancelling the context
+// abandons the call.
+func MakeRequestContext(ctx context.Context, req *Request, response *Response) (err error) {
 
 	var (
-		body    []byte
-		client  *http.Client
-		request *http.Request
-		resp    *http.Response
-		sr      io.Reader
+		body        []byte
+		contentType string
+		client      *http.Client
+		request     *http.Request
+		resp        *http.Response
+		sr          io.Reader
 	)
 
 	method := strings.ToUpper(req.Method)
@@ -206,33 +408,55 @@ func MakeRequest(req *Request, response *Response) (err error) {
 		return
 	}
 
-	timeout := time.Duration(1 * time.Second) // one second timeout
+	timeout := callTimeout(ctx) // one second, longer for a job
+
+	if sr, contentType, err = requestBody(req); err != nil {
+		response.Data = err.Error()
+		response.Code = http.StatusBadRequest
+		return nil
+	}
 
-	if len(req.Data) > 0 {
-		sr = strings.NewReader(req.Data)
+	// so a recording Cassette keeps no more of the body than we read
+	if req.maxBody > 0 {
+		ctx = context.WithValue(ctx, responseLimitKey{}, req.maxBody)
 	}
 
-	if request, err = http.NewRequest(method, req.URL, sr); err != nil {
+	if request, err = http.NewRequestWithContext(ctx, method, withQuery(req.URL, req.Query), sr); err != nil {
 		log.WithFields(log.Fields{"method": method, "url": req.URL, "data": req.Data}).Debugf("[MakeRequest] Unable to create http.Request")
 		return
 	}
 
 	request.Close = true
 
+	// a copy, hedged attempts share the request's headers
 	if req.Header != nil {
-		request.Header = req.Header
+		request.Header = req.Header.Clone()
 	} else if request.Header == nil {
 		request.Header = make(map[string][]string)
 	}
 
-	// set a default content type if it isn't already set
-	if t := request.Header.Get("Content-Type"); len(t) <= 0 {
-		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	// the body's content type unless the client set one, a multipart body
+	// needs its boundary so it always wins
+	if contentType != "" && (len(req.Multipart) > 0 || request.Header.Get("Content-Type") == "") {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	// we decompress the body ourselves, whatever the client accepts
+	request.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+
+	// server side credentials win over anything the client sent
+	if req.service != nil && req.service.Credentials != nil {
+		if err = req.service.Credentials.Apply(request); err != nil {
+			log.WithFields(log.Fields{"url": req.URL, "err": err}).Error("[MakeRequest] Unable to apply credentials")
+			response.Code = 500
+			return
+		}
 	}
 
 	client = &http.Client{
 		CheckRedirect: nil,
 		Timeout:       timeout,
+		Transport:     req.transport,
 	}
 
 	if resp, err = client.Do(request); err != nil {
@@ -243,10 +467,32 @@ func MakeRequest(req *Request, response *Response) (err error) {
 	response.Header = resp.Header
 	response.Code = resp.StatusCode
 
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+	var reader io.Reader = resp.Body
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		decoded, err := decompress(encoding, resp.Body)
+		if err != nil {
+			response.Code = http.StatusBadGateway
+			response.Data = err.Error()
+			return nil
+		}
+		defer decoded.Close()
+		reader = decoded
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+	// limits the decompressed body
+	if req.maxBody > 0 {
+		reader = io.LimitReader(reader, req.maxBody+1)
+	}
+
+	if body, err = ioutil.ReadAll(reader); err != nil {
 		response.Data = err.Error()
+	} else if req.maxBody > 0 && int64(len(body)) > req.maxBody {
+		body = nil
+		response.Code = http.StatusBadGateway
+		response.Data = fmt.Sprintf("response body exceeds %d bytes", req.maxBody)
 	} else {
-		response.Data = string(body)
+		setBody(req, response, body)
 	}
 
 	log.WithFields(log.Fields{"body": string(body)}).Debugf("[MakeRequest] response returned.")
@@ -255,7 +501,7 @@ func MakeRequest(req *Request, response *Response) (err error) {
 
 // utility method to validate the HTTP method someone desires to use.
 func IsValidHTTPMethod(method *string) (valid bool) {
-	valid, _ = regexp.Match("^(GET|PUT|POST|DELETE)$", []byte(*method))
+	valid, _ = regexp.Match("^(GET|PUT|POST|PATCH|DELETE)$", []byte(*method))
 	return valid
 }
 
@@ -263,8 +509,8 @@ func IsValidHTTPMethod(method *string) (valid bool) {
 // this leaves any header values in the target that aren't in the source
 // if you wanted that, don't call this fuction.
 func replaceHeaderValues(target *http.Header, source *http.Header) {
-	if target == nil {
-		target = new(http.Header)
+	if *target == nil {
+		*target = make(http.Header)
 	}
 	for name, vals := range *source {
 		target.Del(name)
@@ -397,41 +643,147 @@ You can also add dependency calls into the mix. Let's say you want an API call d
 	return
 }
 
+// the Magic used by the package level Handle. it has no services and no
+// authentication configured.
+var defaultMagic = &Magic{}
+
 // Handle function is entry point for all http request.
 func Handle(writer http.ResponseWriter, req *http.Request) {
+	defaultMagic.Handle(writer, req)
+}
+
+// Handle is the entry point for http requests against a configured Magic.
+func (magic *Magic) Handle(writer http.ResponseWriter, req *http.Request) {
+	writer, done := magic.compress(writer, req)
+	defer done()
 
 	var (
-		work Workload
-		err  error
-		res  Result
-		body []byte
+		work      Workload
+		err       error
+		body      []byte
+		principal *Principal
+		ok        bool
 	)
 
-	body, err = ioutil.ReadAll(req.Body)
+	if principal, ok = magic.authenticate(writer, req); !ok {
+		return
+	}
+
+	if body, ok = magic.readBody(writer, req); !ok {
+		return
+	}
+
+	batch := batchFor(req.Header.Get("Content-Type"))
+	if batch != nil {
+		work, err = batch.decode(req, body)
+	} else {
+		err = unmarshal(req.Header.Get("Content-Type"), body, &work)
+	}
 
 	if err != nil {
-		str := fmt.Sprintf("[Handle] Unable to read in the body of the request: %s", body)
-		log.Error(str)
+		str := fmt.Sprintf("[ERROR] Unable to parse workload: %s", err)
 		http.Error(writer, str, 500)
 		return
 	}
 
-	err = json.Unmarshal(body, &work)
+	magic.serve(writer, req, principal, &work, batch)
+}
+
+// authenticate the caller if the Magic has an Authenticator. on failure it
+// has already answered the request.
+func (magic *Magic) authenticate(writer http.ResponseWriter, req *http.Request) (principal *Principal, ok bool) {
+	var err error
+	if magic.Authenticator != nil {
+		// an HMAC signature is checked against the body, so it's limited
+		// before anyone is authenticated
+		if magic.Limits.MaxRequestBytes > 0 && req.Body != nil {
+			req.Body = http.MaxBytesReader(writer, req.Body, magic.Limits.MaxRequestBytes)
+		}
+		if principal, err = magic.Authenticator.Authenticate(req); err != nil {
+			if _, ok := err.(*http.MaxBytesError); ok {
+				http.Error(writer, fmt.Sprintf("[ERROR] %s", err), http.StatusRequestEntityTooLarge)
+				return nil, false
+			}
+			log.WithFields(log.Fields{"err": err}).Warn("[Handle] authentication failed")
+			http.Error(writer, "[ERROR] Unauthorized", http.StatusUnauthorized)
+			return nil, false
+		}
+	}
+	return principal, true
+}
+
+// readBody reads the request body, within Limits.MaxRequestBytes. on failure
+// it has already answered the request.
+func (magic *Magic) readBody(writer http.ResponseWriter, req *http.Request) (body []byte, ok bool) {
+	var err error
+
+	if magic.Limits.MaxRequestBytes > 0 {
+		req.Body = http.MaxBytesReader(writer, req.Body, magic.Limits.MaxRequestBytes)
+	}
+
+	body, err = ioutil.ReadAll(req.Body)
 
 	if err != nil {
-		str := fmt.Sprintf("[ERROR] Unable to parse workload JSON: %s", err)
+		if _, ok := err.(*http.MaxBytesError); ok {
+			http.Error(writer, fmt.Sprintf("[ERROR] %s", err), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		str := fmt.Sprintf("[Handle] Unable to read in the body of the request: %s", body)
+		log.Error(str)
 		http.Error(writer, str, 500)
+		return nil, false
+	}
+	return body, true
+}
+
+// serve admits, processes and answers with a decoded workload, in the batch
+// format it came in if it isn't nil
+func (magic *Magic) serve(writer http.ResponseWriter, req *http.Request, principal *Principal, work *Workload, batch batchFormat) {
+
+	var (
+		err error
+		res Result
+	)
+
+	work.SetHeader(req.Header)
+
+	if code, err := magic.admit(principal, req.RemoteAddr, work); err != nil {
+		if limit, ok := err.(*LimitError); ok && limit.RetryAfter > 0 {
+			writer.Header().Set("Retry-After", retryAfterSeconds(limit.RetryAfter))
+		}
+		str := fmt.Sprintf("[ERROR] %s", err)
+		http.Error(writer, str, code)
+		return
+	}
+
+	if work.Async {
+		job, err := magic.Submit(principal, *work)
+		if err == ErrShuttingDown {
+			http.Error(writer, fmt.Sprintf("[ERROR] %s", err), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(writer, fmt.Sprintf("[ERROR] Unable to submit workload: %s", err), 500)
+			return
+		}
+		writeJob(writer, req.Header.Get("Accept"), job)
 		return
 	}
 
-	err = process(work, &res)
+	err = magic.process(*work, &res)
 
-	if err != nil {
+	if err == ErrShuttingDown {
+		http.Error(writer, fmt.Sprintf("[ERROR] %s", err), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		str := fmt.Sprintf("[ERROR] Problems processing workload: %s", err)
 		http.Error(writer, str, 500)
 		return
 	}
 
-	body, _ = json.Marshal(res)
-	writer.Write(body)
+	if batch != nil {
+		batch.encode(writer, res)
+		return
+	}
+
+	writeReply(writer, req.Header.Get("Accept"), res)
 }
@@ -1,9 +1,13 @@
 package ensemble
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -88,35 +92,33 @@ func StartListener() {
 	}
 }
 
-func DontTestCallHandle(t *testing.T) {
+// go test -run TestCallHandleReplay -record re-records the cassette against
+// StartListener on port 8080
+var recordCassettes = flag.Bool("record", false, "record test cassettes against live backends")
+
+func TestCallHandleReplay(t *testing.T) {
 	var (
-		url          string
-		method       string
-		data         string
-		response     string
-		responseCode int
-		err          error
-		contentType  string
-		header       *http.Header
+		cassette *Cassette
+		err      error
 	)
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
+	const path = "testdata/call_handle.json"
 
-	go StartListener()
-	//url = "http://localhost/test.php?a=b"
-	url = "http://localhost:8080/test"
-	method = "POST"
-	data = "{\"foo\":\"bar\"}"
-	//data = "foo=bar&cool=false"
-	//data = ""
+	if *recordCassettes {
+		go StartListener()
+		time.Sleep(100 * time.Millisecond)
+		cassette, err = NewCassette(path, CassetteRecord)
+	} else {
+		cassette, err = NewCassette(path, CassetteReplay)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	data = `{
+	data := `{
     "requests": [{
         "id": "1",
         "url": "http://localhost:8080/test1",
         "method": "GET",
-        "rawData": "foo=bar",
         "headers": {
             "Content-Type": ["application/x-www-form-urlencoded"]
         },
@@ -126,7 +128,6 @@ func DontTestCallHandle(t *testing.T) {
         "url": "http://localhost:8080/test2",
         "method": "POST",
         "data": "{\"data\":[%s]}",
-        "evalJson": true,
         "headers": {
             "Content-Type": ["application/x-www-form-urlencoded"]
         },
@@ -147,34 +148,129 @@ func DontTestCallHandle(t *testing.T) {
         "doJoin": true,
         "joinChar": ","
     }],
-    "strictorder": true,
-    "hasDependencies": true
+    "strictorder": true
 }`
 
-	//	data = `{"requests":[{"id":"1","url":"http://www.nytimes.com/adx/bin/adxrun.html?v=3&page=homepage.nytimes.com/index.html&positions=Box1&keywords=adxeng-adxcon-test1"},{"id":"2","url":"http://platforms.nytimes.com/mobile/v2/json/iphone/latestfeed.json","graphics8Access":true,"graphicsPath":"/mobile/v2/json/iphone/"}],"strictorder":false,"hasDependencies":false}`
+	magic := &Magic{Transport: cassette}
+	recorder := httptest.NewRecorder()
+	magic.Handle(recorder, httptest.NewRequest("POST", "/test", strings.NewReader(data)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", recorder.Code, recorder.Body)
+	}
 
-	contentType = "application/json"
-	// the key is to set the correct Content-Type for Go to work right!
-	// so, we need to define the callers and check the content type
-	contentType = "application/x-www-form-urlencoded"
-	//contentType = ""
-	header = &http.Header{}
+	var result Result
+	if err = json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Responses) != 2 {
+		t.Fatalf("expected two responses, got %+v", result)
+	}
+	if result.Responses[0].Data != "This worked" {
+		t.Errorf("unexpected response to 1: %q", result.Responses[0].Data)
+	}
+	if expected := `{"data":[{"is this":"magic?"},{"yup":"magic happens"}]}`; result.Responses[1].Data != expected {
+		t.Errorf("expected the joined dependencies %s, got %q", expected, result.Responses[1].Data)
+	}
 
-	header.Add("Content-Type", contentType)
-	//header = nil
-	t.Logf("I'm using %s method to this url %s\n", method, url)
+	if *recordCassettes {
+		if err = cassette.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
 
-	req := Request{URL: url, Method: method, Header: *header, Data: data}
-	res := new(Response)
+func TestProcessTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		writer.Write([]byte("ok"))
+	}))
+	defer backend.Close()
 
-	err = MakeRequest(&req, res)
+	result, err := (&Magic{}).DoMagic(Workload{
+		Timeout: int64(50 * time.Millisecond),
+		Requests: []Request{
+			{Id: "fast", URL: backend.URL + "/fast", Method: "GET"},
+			{Id: "slow", URL: backend.URL + "/slow", Method: "GET"},
+		},
+	})
 	if err != nil {
-		fmt.Println()
-		fmt.Printf("Code: %v. Response: %s\n", responseCode, response)
-		t.Error("Error: ", err, "Code: %v. Response: %s\n", responseCode, response)
+		t.Fatal(err)
 	}
+	// the slow request finishing now mustn't touch the result
+	close(release)
+	if _, err = json.Marshal(result); err != nil {
+		t.Fatal(err)
+	}
+	if fast := result.Responses[0]; fast.Code != 200 || fast.Data != "ok" {
+		t.Errorf("unexpected fast response %+v", fast)
+	}
+	if slow := result.Responses[1]; slow.Id != "slow" || slow.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected the slow request to time out, got %+v", slow)
+	}
+}
+
+func TestReplaceHeaderValues(t *testing.T) {
+	var target http.Header
+	source := http.Header{"X-Trace": {"a", "b"}}
+	replaceHeaderValues(&target, &source)
+	if got := target["X-Trace"]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("expected a nil target to receive the source headers, got %v", target)
+	}
+
+	target = http.Header{"X-Trace": {"old"}, "X-Keep": {"kept"}}
+	replaceHeaderValues(&target, &source)
+	if got := target.Get("X-Trace"); got != "a" || len(target["X-Trace"]) != 2 {
+		t.Errorf("expected X-Trace to be replaced, got %v", target["X-Trace"])
+	}
+	if got := target.Get("X-Keep"); got != "kept" {
+		t.Errorf("expected X-Keep to be left alone, got %q", got)
+	}
+}
 
-	t.Logf("It worked! Response data: %s", res)
+func TestProcessDependencies(t *testing.T) {
+	var parents int
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			writer.Write([]byte(`{"ok":true}`))
+		case "/broken":
+			http.Error(writer, "broken", http.StatusInternalServerError)
+		default:
+			parents++
+			writer.Write([]byte("parent"))
+		}
+	}))
+	defer backend.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	request := func(dep string) Request {
+		return Request{Id: "parent", URL: backend.URL + "/parent", Method: "GET",
+			Dependents: []Dependency{{Request: Request{Id: "dep", URL: dep, Method: "GET"}}}}
+	}
+	result, err := (&Magic{}).DoMagic(Workload{Requests: []Request{
+		request(backend.URL + "/ok"),
+		request(backend.URL + "/broken"),
+		request(closed.URL),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parents != 1 {
+		t.Errorf("expected only the request with a healthy dependency to run, ran %d", parents)
+	}
+	if ok := result.Responses[0]; ok.Id != "parent" || ok.Code != 200 || ok.Data != "parent" {
+		t.Errorf("unexpected response after a healthy dependency %+v", ok)
+	}
+	if broken := result.Responses[1]; broken.Id != "dep" || broken.Code != 500 {
+		t.Errorf("expected the failed dependency to be reported, got %+v", broken)
+	}
+	if down := result.Responses[2]; down.Id != "dep" || down.Code == 200 || down.Data == "" {
+		t.Errorf("expected the dependency's error to be reported, got %+v", down)
+	}
 }
 
 /*
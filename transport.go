@@ -0,0 +1,117 @@
+package ensemble
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// StatusError is an error with the http status it should be answered with.
+// go-kit's default error encoder uses StatusCode and Headers.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (err *StatusError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *StatusError) Unwrap() error {
+	return err.Err
+}
+
+func (err *StatusError) StatusCode() int {
+	return err.Code
+}
+
+// Headers adds Retry-After when the error is a rate limit.
+func (err *StatusError) Headers() http.Header {
+	if limit, ok := err.Err.(*LimitError); ok && limit.RetryAfter > 0 {
+		return http.Header{"Retry-After": {retryAfterSeconds(limit.RetryAfter)}}
+	}
+	return nil
+}
+
+// MakeHTTPHandler serves MakeMagicEndpoint over http with go-kit. It
+// authenticates the caller before decoding, so the endpoint can authorize.
+func MakeHTTPHandler(magic *Magic, options ...httptransport.ServerOption) http.Handler {
+	options = append([]httptransport.ServerOption{httptransport.ServerBefore(httptransport.PopulateRequestContext)}, options...)
+	server := httptransport.NewServer(
+		MakeMagicEndpoint(magic),
+		magic.decodeWorkload,
+		encodeResult,
+		options...,
+	)
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer, done := magic.compress(writer, req)
+		defer done()
+		principal, ok := magic.authenticate(writer, req)
+		if !ok {
+			return
+		}
+		ctx := context.WithValue(NewContext(req.Context(), principal), remoteKey{}, req.RemoteAddr)
+		ctx = context.WithValue(ctx, batchKey{}, &batchSlot{})
+		server.ServeHTTP(writer, req.WithContext(ctx))
+	})
+}
+
+type remoteKey struct{}
+
+type batchKey struct{}
+
+// the batch format a request came in, decodeWorkload fills it in for
+// encodeResult
+type batchSlot struct {
+	format batchFormat
+}
+
+// the caller's address, for the per client rate limit when there's no principal
+func remoteFromContext(ctx context.Context) string {
+	remote, _ := ctx.Value(remoteKey{}).(string)
+	return remote
+}
+
+func (magic *Magic) decodeWorkload(ctx context.Context, req *http.Request) (interface{}, error) {
+	if magic.Limits.MaxRequestBytes > 0 {
+		req.Body = http.MaxBytesReader(nil, req.Body, magic.Limits.MaxRequestBytes)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return nil, &StatusError{Code: http.StatusRequestEntityTooLarge, Err: err}
+		}
+		return nil, err
+	}
+	var work Workload
+	if batch := batchFor(req.Header.Get("Content-Type")); batch != nil {
+		work, err = batch.decode(req, body)
+		if slot, ok := ctx.Value(batchKey{}).(*batchSlot); ok {
+			slot.format = batch
+		}
+	} else {
+		work, err = DecodeWorkload(req.Header.Get("Content-Type"), body)
+	}
+	if err != nil {
+		return nil, &StatusError{Code: http.StatusBadRequest, Err: err}
+	}
+	work.SetHeader(req.Header)
+	return work, nil
+}
+
+func encodeResult(ctx context.Context, writer http.ResponseWriter, response interface{}) error {
+	accept, _ := ctx.Value(httptransport.ContextKeyRequestAccept).(string)
+	if job, ok := response.(*Job); ok {
+		writeJob(writer, accept, job)
+		return nil
+	}
+	if slot, ok := ctx.Value(batchKey{}).(*batchSlot); ok && slot.format != nil {
+		if result, ok := response.(Result); ok {
+			slot.format.encode(writer, result)
+			return nil
+		}
+	}
+	return writeReply(writer, accept, response)
+}
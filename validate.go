@@ -0,0 +1,78 @@
+package ensemble
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Validate reports everything wrong with a workload without running it: the
+// things process would trip over, unknown services and exceeded limits.
+func (magic *Magic) Validate(workload *Workload) error {
+	var problems []error
+
+	if err := magic.resolve(workload); err != nil {
+		problems = append(problems, err)
+	}
+	if err := magic.Limits.check(workload); err != nil {
+		problems = append(problems, err)
+	}
+
+	if workload.Callback != "" {
+		if target, err := url.Parse(workload.Callback); err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			problems = append(problems, fmt.Errorf("callback %q is not an http url", workload.Callback))
+		}
+		if !workload.Async {
+			problems = append(problems, errors.New("a callback is only used by async workloads"))
+		}
+	}
+
+	if workload.Compose != "" {
+		if err := checkCompose(workload); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if err := checkFields(workload.Requests); err != nil {
+		problems = append(problems, err)
+	}
+
+	seen := make(map[string]bool)
+	for index := range workload.Requests {
+		problems = append(problems, validateRequest(&workload.Requests[index], seen)...)
+	}
+	return errors.Join(problems...)
+}
+
+func validateRequest(req *Request, seen map[string]bool) (problems []error) {
+	name := req.Id
+	if name == "" {
+		name = "(no id)"
+		problems = append(problems, fmt.Errorf("a request to %q has no id", req.URL))
+	} else if seen[req.Id] {
+		problems = append(problems, fmt.Errorf("request id %s is used more than once", req.Id))
+	}
+	seen[req.Id] = true
+
+	method := strings.ToUpper(req.Method)
+	if !IsValidHTTPMethod(&method) && !(isGRPC(req.URL) && method == "") {
+		problems = append(problems, fmt.Errorf("request %s: invalid method %q", name, req.Method))
+	}
+	if req.URL == "" {
+		problems = append(problems, fmt.Errorf("request %s: no url", name))
+	}
+	if req.UseData && req.Data == "" {
+		problems = append(problems, fmt.Errorf("request %s: useData is set but data is empty", name))
+	}
+	if req.UseData && req.DoJoin && !strings.Contains(req.Data, "%s") {
+		problems = append(problems, fmt.Errorf("request %s: doJoin needs a %%s in data", name))
+	}
+	for _, problem := range checkBody(req) {
+		problems = append(problems, fmt.Errorf("request %s: %s", name, problem))
+	}
+	for index := range req.Dependents {
+		problems = append(problems, validateRequest(&req.Dependents[index].Request, seen)...)
+	}
+	return
+}